@@ -0,0 +1,415 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type benchOp int
+
+const (
+	OP_READ benchOp = iota
+	OP_UPDATE
+	OP_INSERT
+	OP_SCAN
+	OP_READ_MODIFY_WRITE
+	OP_CHECKPOINT
+	opCount
+)
+
+func (op benchOp) String() string {
+	return [...]string{"read", "update", "insert", "scan", "rmw", "checkpoint"}[op]
+}
+
+// workload is the mix of operations, proportions add up to 1
+type workload struct {
+	read, update, insert, scan, rmw float64
+
+	// latest skews reads towards the most recent inserts (ycsb d)
+	latest bool
+	// sequential keys are inserted in order, the others in a scrambled order
+	sequential bool
+}
+
+// the ycsb core workloads, plus single operation ones
+var workloads = map[string]workload{
+	"a":           {read: 0.5, update: 0.5},
+	"b":           {read: 0.95, update: 0.05},
+	"c":           {read: 1},
+	"d":           {read: 0.95, insert: 0.05, latest: true},
+	"e":           {scan: 0.95, insert: 0.05},
+	"f":           {read: 0.5, rmw: 0.5},
+	"seq-insert":  {insert: 1, sequential: true},
+	"rand-insert": {insert: 1},
+	"read":        {read: 1},
+	"scan":        {scan: 1},
+}
+
+type benchConfig struct {
+	workload     string
+	records      int // loaded before the timed run
+	ops          int
+	distribution string // uniform or zipfian
+	valueSize    int
+	scanLength   int
+	concurrency  int
+	// checkpoint after this many writes, 0 only checkpoints after loading.
+	// reads are served from the in-memory tree, checkpoints are the datafile i/o
+	checkpointEvery int
+	seed            int64
+}
+
+type benchResult struct {
+	config    benchConfig
+	degree    int
+	pageSize  int
+	direct    bool // the datafile was opened with DirectIO
+	elapsed   time.Duration
+	latencies [opCount][]time.Duration
+	misses    int64
+}
+
+// writes between checkpoints of a bench run by default, without them a run never
+// touches the datafile and the options that shape it's i/o measure nothing
+const DEFAULT_BENCH_CHECKPOINT_EVERY = 10_000
+
+// zipfian draws from [0, n) with item 0 the most popular, it's the
+// generator from "quickly generating billion-record synthetic databases"
+// which ycsb uses with a skew of 0.99.
+type zipfian struct {
+	n                   int
+	theta, alpha, zetan float64
+	eta                 float64
+}
+
+const ZIPFIAN_SKEW = 0.99
+
+func newZipfian(n int, theta float64) *zipfian {
+	zeta := func(n int) float64 {
+		sum := 0.0
+		for i := 1; i <= n; i++ {
+			sum += 1 / math.Pow(float64(i), theta)
+		}
+		return sum
+	}
+
+	z := &zipfian{n: n, theta: theta, alpha: 1 / (1 - theta), zetan: zeta(n)}
+	z.eta = (1 - math.Pow(2/float64(n), 1-theta)) / (1 - zeta(2)/z.zetan)
+
+	return z
+}
+
+func (z *zipfian) next(r *rand.Rand) int {
+	u := r.Float64()
+	uz := u * z.zetan
+
+	if uz < 1 {
+		return 0
+	}
+
+	if uz < 1+math.Pow(0.5, z.theta) {
+		return 1
+	}
+
+	return min(int(float64(z.n)*math.Pow(z.eta*u-z.eta+1, z.alpha)), z.n-1)
+}
+
+// scramble spreads the popular items of a zipfian draw over the keyspace
+func scramble(i, n int) int {
+	h := fnv.New64a()
+	h.Write(encodeKey(i))
+
+	return int(h.Sum64() % uint64(n))
+}
+
+// benchKey maps the i'th record to it's key, multiplying by an odd constant
+// is a bijection so keys never collide yet arrive in a random order.
+func benchKey(i int, sequential bool) int {
+	if sequential {
+		return i
+	}
+
+	return int(uint64(i) * 0x9e3779b97f4a7c15)
+}
+
+// Bench loads cfg.records keys and then runs cfg.ops operations of the
+// workload across cfg.concurrency goroutines.
+func Bench(db *DB, cfg benchConfig) (*benchResult, error) {
+	w, ok := workloads[cfg.workload]
+	if !ok {
+		return nil, fmt.Errorf("unknown workload %q", cfg.workload)
+	}
+
+	if cfg.distribution != "uniform" && cfg.distribution != "zipfian" {
+		return nil, fmt.Errorf("unknown distribution %q, want uniform or zipfian", cfg.distribution)
+	}
+
+	if limit := db.maxValueSize(); cfg.valueSize > limit {
+		return nil, fmt.Errorf("values are at most %v bytes with %v byte pages", limit, db.pageSize)
+	}
+
+	cfg.concurrency = max(cfg.concurrency, 1)
+	t := db.tree
+	value := make([]byte, cfg.valueSize)
+	rand.New(rand.NewSource(cfg.seed)).Read(value)
+
+	for i := 0; i < cfg.records; i++ {
+		if err := t.Put(benchKey(i, w.sequential), value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.Checkpoint(); err != nil {
+		return nil, err
+	}
+
+	var zipf *zipfian
+	if cfg.distribution == "zipfian" && cfg.records > 1 {
+		zipf = newZipfian(cfg.records, ZIPFIAN_SKEW)
+	}
+
+	res := &benchResult{config: cfg, degree: t.maxDegree, pageSize: db.pageSize, direct: db.opts.DirectIO}
+	inserted := atomic.Int64{}
+	inserted.Store(int64(cfg.records))
+	writes := atomic.Int64{}
+
+	var mu sync.Mutex
+	var errs error
+	var wg sync.WaitGroup
+
+	start := time.Now()
+
+	for worker := 0; worker < cfg.concurrency; worker++ {
+		ops := cfg.ops / cfg.concurrency
+		if worker < cfg.ops%cfg.concurrency {
+			ops++
+		}
+
+		wg.Add(1)
+		go func(r *rand.Rand, ops int) {
+			defer wg.Done()
+
+			var latencies [opCount][]time.Duration
+			var misses int64
+
+			// existing picks a record already in the tree
+			existing := func() int {
+				n := int(inserted.Load())
+
+				switch {
+				case n == 0:
+					return 0
+				case w.latest && zipf != nil:
+					return max(n-1-zipf.next(r), 0)
+				case zipf != nil:
+					return scramble(zipf.next(r), cfg.records)
+				default:
+					return r.Intn(n)
+				}
+			}
+
+			for i := 0; i < ops; i++ {
+				var op benchOp
+				var err error
+
+				switch p := r.Float64(); {
+				case p < w.read:
+					op = OP_READ
+				case p < w.read+w.update:
+					op = OP_UPDATE
+				case p < w.read+w.update+w.insert:
+					op = OP_INSERT
+				case p < w.read+w.update+w.insert+w.scan:
+					op = OP_SCAN
+				default:
+					op = OP_READ_MODIFY_WRITE
+				}
+
+				began := time.Now()
+
+				switch op {
+				case OP_READ:
+					if _, err = t.Lookup(benchKey(existing(), w.sequential)); err != nil {
+						misses, err = misses+1, nil
+					}
+				case OP_UPDATE:
+					err = t.Put(benchKey(existing(), w.sequential), value)
+				case OP_INSERT:
+					err = t.Put(benchKey(int(inserted.Add(1)-1), w.sequential), value)
+				case OP_SCAN:
+					t.Scan(benchKey(existing(), w.sequential), r.Intn(cfg.scanLength)+1, func(int, []byte) {})
+				case OP_READ_MODIFY_WRITE:
+					key := benchKey(existing(), w.sequential)
+					if _, err = t.Lookup(key); err == nil {
+						err = t.Put(key, value)
+					} else {
+						misses, err = misses+1, nil
+					}
+				}
+
+				latencies[op] = append(latencies[op], time.Since(began))
+
+				if err == nil && op != OP_READ && op != OP_SCAN && cfg.checkpointEvery > 0 &&
+					writes.Add(1)%int64(cfg.checkpointEvery) == 0 {
+					began = time.Now()
+					err = db.Checkpoint()
+					latencies[OP_CHECKPOINT] = append(latencies[OP_CHECKPOINT], time.Since(began))
+				}
+
+				if err != nil {
+					mu.Lock()
+					errs = errors.Join(errs, err)
+					mu.Unlock()
+					return
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			for op := range latencies {
+				res.latencies[op] = append(res.latencies[op], latencies[op]...)
+			}
+			res.misses += misses
+		}(rand.New(rand.NewSource(cfg.seed+int64(worker)+1)), ops)
+	}
+
+	wg.Wait()
+	res.elapsed = time.Since(start)
+
+	for op := range res.latencies {
+		slices.Sort(res.latencies[op])
+	}
+
+	return res, errs
+}
+
+// percentile of sorted latencies, p in [0, 1]
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	return sorted[min(int(p*float64(len(sorted))), len(sorted)-1)]
+}
+
+func (res *benchResult) ops() int {
+	n := 0
+	for op := OP_READ; op < OP_CHECKPOINT; op++ {
+		n += len(res.latencies[op])
+	}
+
+	return n
+}
+
+func (res *benchResult) Print(w io.Writer) {
+	cfg := res.config
+	throughput := float64(res.ops()) / res.elapsed.Seconds()
+
+	mode := "buffered"
+	if res.direct {
+		mode = "direct"
+	}
+
+	fmt.Fprintf(w, "workload %v: %v records, %v distribution, %v byte values, degree %v, page size %v, %v i/o, %v goroutines\n",
+		cfg.workload, cfg.records, cfg.distribution, cfg.valueSize, res.degree, res.pageSize, mode, cfg.concurrency)
+	fmt.Fprintf(w, "%v ops in %v, %.0f ops/s\n", res.ops(), res.elapsed.Round(time.Millisecond), throughput)
+
+	// the checkpoints are timed within the ops that triggered them, they hold the
+	// tree's lock so they don't overlap
+	checkpoints := res.latencies[OP_CHECKPOINT]
+	if len(checkpoints) == 0 {
+		fmt.Fprintln(w, "warning: no checkpoint ran, the run never touched the datafile so direct i/o, sync modes and compression made no difference")
+	} else {
+		var spent time.Duration
+		for _, d := range checkpoints {
+			spent += d
+		}
+
+		fmt.Fprintf(w, "%v checkpoints took %v, %.0f%% of the run, %.1f checkpoints/s\n", len(checkpoints), spent.Round(time.Millisecond),
+			100*spent.Seconds()/res.elapsed.Seconds(), float64(len(checkpoints))/res.elapsed.Seconds())
+	}
+
+	fmt.Fprintf(w, "%-10v %10v %10v %10v %10v %10v\n", "op", "count", "p50", "p99", "p999", "max")
+
+	for op, sorted := range res.latencies {
+		if len(sorted) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "%-10v %10v %10v %10v %10v %10v\n", benchOp(op), len(sorted),
+			percentile(sorted, 0.5), percentile(sorted, 0.99), percentile(sorted, 0.999), sorted[len(sorted)-1])
+	}
+
+	if res.misses > 0 {
+		fmt.Fprintf(w, "%v reads missed a key still being inserted\n", res.misses)
+	}
+}
+
+// bubblegum bench [--workload name] [--records n] [--ops n] [--distribution uniform|zipfian]
+// [--value-size n] [--scan-length n] [--concurrency n] [--degree n] [--page-size n] [--checkpoint-every n] [--direct-io] [--datafile path]
+func runBench(args []string) error {
+	var cfg benchConfig
+
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	flags.StringVar(&cfg.workload, "workload", "a", "a-f (ycsb), seq-insert, rand-insert, read or scan")
+	flags.IntVar(&cfg.records, "records", 100_000, "keys loaded before the run")
+	flags.IntVar(&cfg.ops, "ops", 100_000, "operations in the run")
+	flags.StringVar(&cfg.distribution, "distribution", "zipfian", "key distribution: uniform or zipfian")
+	flags.IntVar(&cfg.valueSize, "value-size", 100, "bytes per value")
+	flags.IntVar(&cfg.scanLength, "scan-length", 100, "maximum keys per scan")
+	flags.IntVar(&cfg.concurrency, "concurrency", 1, "goroutines issuing operations")
+	flags.IntVar(&cfg.checkpointEvery, "checkpoint-every", DEFAULT_BENCH_CHECKPOINT_EVERY, "checkpoint after this many writes, 0 to never checkpoint during the run which then does no datafile i/o")
+	flags.Int64Var(&cfg.seed, "seed", 1, "random seed")
+	degree := flags.Int("degree", DEFAULT_DEGREE, "degree of the tree")
+	pageSize := flags.Int("page-size", PAGE_SIZE, "bytes per page, a power of two from 1KiB to 64KiB")
+	direct := flags.Bool("direct-io", false, "open the datafile with O_DIRECT, run again without it to compare against buffered i/o")
+	datafile := flags.String("datafile", "", "datafile to create, a temporary one is removed afterwards")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("usage: bubblegum bench [flags], see bubblegum bench -h")
+	}
+
+	if cfg.scanLength < 1 {
+		return errors.New("scan length must be at least 1")
+	}
+
+	path := *datafile
+	if path == "" {
+		dir, err := os.MkdirTemp("", "bubblegum-bench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		path = filepath.Join(dir, "bench.db")
+	} else if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%v already exists, bench needs a fresh datafile", path)
+	}
+
+	db, err := Open(path, &Options{MaxDegree: *degree, PageSize: *pageSize, CreateIfMissing: true, DirectIO: *direct})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	res, err := Bench(db, cfg)
+	if err != nil {
+		return err
+	}
+
+	res.Print(os.Stdout)
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZipfianSkew(t *testing.T) {
+	z := newZipfian(1000, ZIPFIAN_SKEW)
+	r := rand.New(rand.NewSource(1))
+	counts := make([]int, 1000)
+
+	for i := 0; i < 100_000; i++ {
+		n := z.next(r)
+		assert.True(t, n >= 0 && n < 1000)
+		counts[n]++
+	}
+
+	// item 0 is drawn about 1/zeta(1000) of the time
+	assert.InDelta(t, 100_000/z.zetan, counts[0], 1000)
+	assert.Greater(t, counts[0], counts[1])
+	assert.Greater(t, counts[1], counts[100])
+}
+
+func TestBenchWorkloads(t *testing.T) {
+	for name := range workloads {
+		for _, distribution := range []string{"uniform", "zipfian"} {
+			db, err := OpenDB(filepath.Join(t.TempDir(), "db"), 8)
+			assert.NoError(t, err)
+
+			cfg := benchConfig{workload: name, records: 500, ops: 1000, distribution: distribution,
+				valueSize: 32, scanLength: 10, concurrency: 3, checkpointEvery: 100, seed: 7}
+
+			res, err := Bench(db, cfg)
+			assert.NoError(t, err, name)
+			assert.Equal(t, 1000, res.ops(), name)
+
+			w := workloads[name]
+			if w.insert > 0 {
+				assert.Equal(t, 500+len(res.latencies[OP_INSERT]), db.tree.Len(), name)
+			}
+
+			if w.insert+w.update+w.rmw == 0 {
+				assert.Empty(t, res.latencies[OP_CHECKPOINT], name)
+				assert.Zero(t, res.misses, name)
+			}
+
+			var out bytes.Buffer
+			res.Print(&out)
+			assert.Contains(t, out.String(), "p999")
+
+			if len(res.latencies[OP_CHECKPOINT]) == 0 {
+				assert.Contains(t, out.String(), "warning: no checkpoint ran", name)
+			} else {
+				assert.Contains(t, out.String(), "checkpoints took", name)
+			}
+
+			db.Close()
+		}
+	}
+}
+
+func TestBenchKeysAreUnique(t *testing.T) {
+	seen := map[int]bool{}
+
+	for i := 0; i < 10_000; i++ {
+		key := benchKey(i, false)
+		assert.False(t, seen[key])
+		seen[key] = true
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 1000)
+	for i := range sorted {
+		sorted[i] = time.Duration(i)
+	}
+
+	assert.Equal(t, time.Duration(500), percentile(sorted, 0.5))
+	assert.Equal(t, time.Duration(990), percentile(sorted, 0.99))
+	assert.Equal(t, time.Duration(999), percentile(sorted, 0.999))
+	assert.Equal(t, time.Duration(999), percentile(sorted, 1))
+	assert.Zero(t, percentile(nil, 0.5))
+}
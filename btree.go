@@ -1,11 +1,11 @@
 package main
 
 import (
-	"errors"
+	"bytes"
 	"fmt"
-	"math"
 	"slices"
 	"sort"
+	"strconv"
 	"sync"
 )
 
@@ -21,6 +21,16 @@ type BTree struct {
 	root      *node
 	nodeCount int
 	maxDegree int
+	// how keys are stored so they sort in the order of the comparator, see: COMPARATORS
+	order keyOrder
+
+	// bumped by every write, transactions use it to detect conflicting writers
+	version uint64
+	// the version the last checkpoint wrote out, see: DB.Close
+	checkpointed uint64
+	// pages of the nodes merges and collapses took out of the tree, the next
+	// checkpoint frees them
+	dropped []uint32
 
 	db *DB
 	mu sync.RWMutex
@@ -35,11 +45,17 @@ type node struct {
 	keys     []int
 	children []*node
 	data     []int
+	// leaf records, values[i] belongs to data[i]
+	values [][]byte
 
 	// sibling pointers
 	next     *node
 	previous *node
 
+	// number of keys stored in the leaves below (and including) this node,
+	// this is what makes rank/select queries O(log n)
+	size int
+
 	// dir index
 	pageId int64
 }
@@ -75,141 +91,213 @@ func (t *BTree) Get(key int) ([]int, int, error) {
 	defer t.mu.RUnlock()
 
 	if t.root == nil {
-		return nil, 0, errors.New("empty tree")
+		return nil, 0, fmt.Errorf("%w: empty tree", ErrNotFound)
 	} else {
-		node, idx, _ := t.root.search(key)
+		node, idx, _ := t.root.search(t.order.key(key))
 
-		return node.data, idx, nil
+		return t.order.keys(node.data), idx, nil
 	}
 }
 
+// Lookup returns the value stored under key.
+func (t *BTree) Lookup(key int) ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.lookup(key)
+}
+
+func (t *BTree) lookup(key int) ([]byte, error) {
+	n, idx, err := t.root.search(t.order.key(key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotFound, key)
+	}
+
+	return n.values[idx], nil
+}
+
+// Upsert stores value in it's decimal form
 func (t *BTree) Upsert(key int, value int) error {
+	return t.Put(key, strconv.AppendInt(nil, int64(value), 10))
+}
+
+// Put inserts key or replaces it's value if the key is already present.
+func (t *BTree) Put(key int, value []byte) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	return t.put(key, value)
+}
+
+// CompareAndSwap replaces the value of key only if it currently holds old,
+// it reports whether the swap happened. a missing key never swaps.
+func (t *BTree) CompareAndSwap(key int, old, value []byte) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current, err := t.lookup(key)
+	if err != nil || !bytes.Equal(current, old) {
+		return false, nil
+	}
+
+	return true, t.put(key, value)
+}
+
+// maxValueSize follows the page size of the db, a tree of it's own has 4KiB pages
+func (t *BTree) maxValueSize() int {
+	if t.db != nil {
+		return t.db.maxValueSize()
+	}
+
+	return OVERFLOW_PAGE_SIZE
+}
+
+func (t *BTree) put(key int, value []byte) error {
+	// TODO: spill large values into overflow pages
+	if limit := t.maxValueSize(); len(value) > limit {
+		return fmt.Errorf("value of %v bytes exceeds the %v byte cell limit", len(value), limit)
+	}
+
+	value = slices.Clone(value)
+	key = t.order.key(key)
+	t.version++
+
 	if t.root == nil {
 		t.root = &node{kind: ROOT_NODE}
-		t.root.insert(t, key)
+		t.root.insert(t, key, value)
 
 		t.nodeCount++
 		return nil
 	} else {
 		// find leaf node to Upsert into or root at first
-		n, _, err := t.root.search(key)
+		n, idx, err := t.root.search(key)
 
 		if n == nil {
 			return fmt.Errorf("leaf node not found: %v", err)
 		}
 
+		// the key is already present, only the value changes
+		if err == nil {
+			n.values[idx] = value
+			return nil
+		}
+
 		t.nodeCount++
-		return n.insert(t, key)
+		return n.insert(t, key, value)
 	}
 }
 
+// search descends to the leaf that holds (or would hold) key.
+// the returned index is the position of key in the leaf, or its insertion point on a miss.
 func (n *node) search(key int) (*node, int, error) {
+	if n.isLeaf() {
+		idx, found := slices.BinarySearch(n.data, key)
+
+		if !found {
+			return n, idx, ErrNotFound
+		}
+
+		return n, idx, nil
+	}
+
+	return n.children[n.childIndex(key)].search(key)
+}
+
+// childIndex picks the child to descend into, a separator at keys[i]
+// divides children[i] (< keys[i]) from children[i+1] (>= keys[i])
+func (n *node) childIndex(key int) int {
 	idx, found := slices.BinarySearch(n.keys, key)
 
 	if found {
-		if len(n.children) == 0 {
-			/*
-				// Binary search for the key
-					if node.kind == LEAF_NODE || node.kind == INTERNAL_NODE {
-						start, end := 0, len(node.keys)-1
-
-						for start <= end {
-							mid := start + (end-start)/2
-							if node.keys[mid] == key {
-								// Calculate the offset and seek to it
-								offset := int64(binary.LittleEndian.Uint64([]byte(strconv.Itoa(node.keys[mid]))))
-								if _, err := t.db.datafile.Seek(offset, io.SeekStart); err != nil {
-									return nil, err
-								}
-
-								// TODO: factor out when using binary format
-								// read to delimiter
-								value, err := reader.ReadBytes('\n')
-								if err != nil {
-									return nil, err
-								}
-
-								return value, nil
-							} else if node.keys[mid] < key {
-								start = mid + 1
-							} else {
-								end = mid - 1
-							}
-						}
-						return nil, errors.New("key not found")
-					}
-
-			*/
-			return n, idx, nil
-		} else {
-			return n.children[idx].search(key)
-		}
+		return idx + 1
 	}
 
-	if len(n.children) == 0 {
-		return n, 0, errors.New("key not found, at leaf containing key")
+	return idx
+}
+
+func (n *node) isLeaf() bool {
+	return len(n.children) == 0
+}
+
+// indexOf finds n's position in it's parent
+func (n *node) indexOf() int {
+	return slices.Index(n.parent.children, n)
+}
+
+// resize propagates a change in the number of keys up to the root
+func (n *node) resize(delta int) {
+	for p := n; p != nil; p = p.parent {
+		p.size += delta
 	}
+}
 
-	if idx >= len(n.children) {
-		return n.children[idx-1].search(key)
+// recount recomputes the subtree size of n from it's immediate children
+func (n *node) recount() {
+	if n.isLeaf() {
+		n.size = len(n.data)
+		return
 	}
 
-	return n.children[idx].search(key)
+	n.size = 0
+	for _, child := range n.children {
+		n.size += child.size
+	}
 }
 
-func (n *node) insert(t *BTree, key int) error {
+func (n *node) insert(t *BTree, key int, value []byte) error {
 	if n.kind == ROOT_NODE && len(n.children) == 0 {
-		n.data = findInsertAt(n.data, key)
 		n.keys = findInsertAt(n.keys, key)
 	}
 
-	if n.kind == LEAF_NODE {
-		n.data = findInsertAt(n.data, key)
-	}
+	idx, _ := slices.BinarySearch(n.data, key)
+	n.data = slices.Insert(n.data, idx, key)
+	n.values = slices.Insert(n.values, idx, value)
+
+	n.resize(1)
 
 	if len(n.data) < t.maxDegree {
 		return nil
 	} else {
 
-		n.split(t, len(n.data)/2)
+		return n.split(t, len(n.data)/2)
 	}
-
-	return nil
 }
 
 func (n *node) split(t *BTree, midIdx int) error {
 	switch n.kind {
 	case LEAF_NODE:
-		splitPoint := n.data[midIdx]
-		left, right := n.data[:midIdx], n.data[midIdx:]
-		n.data = left
+		splitPoint := shortestSeparator(n.data[midIdx-1], n.data[midIdx])
+		left, right := slices.Clone(n.data[:midIdx]), slices.Clone(n.data[midIdx:])
+		leftValues, rightValues := slices.Clone(n.values[:midIdx]), slices.Clone(n.values[midIdx:])
+		n.data, n.values = left, leftValues
 
-		newNode := &node{kind: LEAF_NODE, parent: n.parent, data: right}
-
-		n.parent.children = append(n.parent.children, newNode)
+		newNode := &node{kind: LEAF_NODE, parent: n.parent, data: right, values: rightValues}
+		n.parent.children = slices.Insert(n.parent.children, n.indexOf()+1, newNode)
 		n.parent.keys = findInsertAt(n.parent.keys, splitPoint)
 
 		// sibling pointers - only on leaf nodes
+		newNode.next, newNode.previous = n.next, n
+		if n.next != nil {
+			n.next.previous = newNode
+		}
 		n.next = newNode
-		newNode.previous = n
+
+		n.recount()
+		newNode.recount()
 
 	case INTERNAL_NODE:
 		splitPoint := n.keys[midIdx]
 
 		// NB: note it's index/key + 1 for internal
-		left, right := n.keys[:midIdx], n.keys[midIdx+1:]
+		left, right := slices.Clone(n.keys[:midIdx]), slices.Clone(n.keys[midIdx+1:])
 		n.keys = left
 
 		newNode := &node{kind: INTERNAL_NODE, keys: right, parent: n.parent}
-		n.parent.children = append(n.parent.children, newNode)
+		n.parent.children = slices.Insert(n.parent.children, n.indexOf()+1, newNode)
 		n.parent.keys = findInsertAt(n.parent.keys, splitPoint)
 
 		// pointer relocation/bookkeeping
-		mid := len(n.children) / 2
-		leftPointers, rightPointers := n.children[:mid], n.children[mid:]
+		leftPointers, rightPointers := slices.Clone(n.children[:midIdx+1]), slices.Clone(n.children[midIdx+1:])
 
 		for _, child := range rightPointers {
 			child.parent = newNode
@@ -217,19 +305,21 @@ func (n *node) split(t *BTree, midIdx int) error {
 
 		n.children, newNode.children = leftPointers, rightPointers
 
+		n.recount()
+		newNode.recount()
+
 	case ROOT_NODE:
-		if len(n.data) == 0 {
+		if len(n.children) != 0 {
 			splitPoint := n.keys[midIdx]
-			left, right := n.keys[:midIdx], n.keys[midIdx+1:]
+			left, right := slices.Clone(n.keys[:midIdx]), slices.Clone(n.keys[midIdx+1:])
 
 			// demote current root
-			newRoot := &node{kind: ROOT_NODE, parent: nil}
+			newRoot := &node{kind: ROOT_NODE, parent: nil, size: n.size}
 			newRoot.keys = findInsertAt(newRoot.keys, splitPoint)
 			t.root = newRoot
 
 			// pointer relocation/bookkeeping
-			mid := len(n.children) / 2
-			leftPointers, rightPointers := n.children[:mid], n.children[mid:]
+			leftPointers, rightPointers := slices.Clone(n.children[:midIdx+1]), slices.Clone(n.children[midIdx+1:])
 			sibling := &node{kind: INTERNAL_NODE, keys: left, children: leftPointers, parent: newRoot}
 			n.kind, n.keys, n.children, n.parent = INTERNAL_NODE, right, rightPointers, newRoot
 			newRoot.children = append(newRoot.children, sibling, n)
@@ -238,23 +328,27 @@ func (n *node) split(t *BTree, midIdx int) error {
 				child.parent = sibling
 			}
 
+			sibling.recount()
+			n.recount()
+
 		} else {
 			// demote current root to a leaf
 			n.keys = []int{}
 			n.kind = LEAF_NODE
-			newRoot := &node{kind: ROOT_NODE, parent: nil}
+			newRoot := &node{kind: ROOT_NODE, parent: nil, size: n.size}
 			n.parent = newRoot
 			t.root = newRoot
 
 			newRoot.children = append(newRoot.children, n)
 
-			n.split(t, len(n.data)/2)
+			return n.split(t, len(n.data)/2)
 		}
 
+		return nil
 	}
 
 	if len(n.parent.keys) > t.maxDegree-1 {
-		n.parent.split(t, len(n.parent.keys)/2)
+		return n.parent.split(t, len(n.parent.keys)/2)
 	}
 
 	return nil
@@ -264,138 +358,104 @@ func (t *BTree) Delete(key int) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	return t.remove(key)
+}
+
+func (t *BTree) remove(key int) error {
 	if t.root == nil {
-		return errors.New("empty tree")
+		return fmt.Errorf("%w: empty tree", ErrNotFound)
 	} else {
 		// find leaf node to delete from or root
-		n, _, err := t.root.searchDel(key)
+		n, _, err := t.root.search(t.order.key(key))
 
 		if err == nil {
 			t.nodeCount--
-			return n.delete(t, key)
+			t.version++
+			return n.delete(t, t.order.key(key))
 		}
 
-		return errors.New("key not in tree")
+		return fmt.Errorf("%w: %v", ErrNotFound, key)
 	}
 }
 
-// TODO(refactor): collapse this function into one
-func (n *node) searchDel(key int) (*node, int, error) {
-	idx, found := slices.BinarySearch(n.keys, key)
-
-	if found {
-		if n.kind == LEAF_NODE {
-			return n, idx, nil
-		} else {
-			if len(n.children) == 0 {
-				return n, 0, nil
-			}
+// Deletion is the most complicated operation for a B-Tree.
+// this covers part one, "merging"
+// see: https://opendatastructures.org/ods-python/14_2_B_Trees.html#SECTION001723000000000000000
+func (n *node) delete(t *BTree, key int) error {
+	if idx, found := slices.BinarySearch(n.data, key); found {
+		n.data = cut(idx, n.data)
+		n.values = slices.Delete(n.values, idx, idx+1)
+	}
 
-			if idx+1 > len(n.children) {
-				return n.children[idx].searchDel(key)
-			}
+	n.resize(-1)
 
-			return n.children[idx+1].searchDel(key)
+	if n.kind == ROOT_NODE {
+		if idx, found := slices.BinarySearch(n.keys, key); found {
+			n.keys = cut(idx, n.keys)
 		}
+
+		return nil
 	}
 
-	if len(n.children) == 0 {
-		return n, 0, nil
+	// is the leaf empty or underflown?
+	if len(n.data) == 0 || len(n.data) < t.minKeys() {
+		return n.rebalance(t)
 	}
 
-	return n.children[idx].searchDel(key)
+	return nil
 }
 
-// Deletion is the most complicated operation for a B-Tree.
-// this covers part one, "merging"
-// see: https://opendatastructures.org/ods-python/14_2_B_Trees.html#SECTION001723000000000000000
-func (n *node) delete(t *BTree, key int) error {
-	for i, v := range n.data {
-		if v == key {
-			n.data = cut(i, n.data)
-		}
-	}
+// minimum occupancy of a non-root node before it is considered underflown
+func (t *BTree) minKeys() int {
+	return (t.maxDegree - 1) / 2
+}
 
+// rebalance restores the occupancy of an underflown node: it prefers merging into
+// it's left neighbour, falls back to the right neighbour and only steals a key
+// when neither neighbour has room to absorb it.
+func (n *node) rebalance(t *BTree) error {
 	if n.kind == ROOT_NODE {
+		// the root only shrinks the tree once it is left with a single child
+		if len(n.children) == 1 {
+			n.collapse(t)
+		}
+
 		return nil
 	}
 
-	// is the leaf empty or underflown?
-	if n.kind == LEAF_NODE && len(n.data) < (t.maxDegree/2) {
-		if sibling, _, err := n.preMerge(t.maxDegree); err == nil {
-			return n.mergeSibling(t, sibling, key)
-		} else {
-			return errors.New("see rebalancing.go")
-		}
-	} else {
-		// should we update the parent's separator?
-		if n.parent.keys[0] < n.data[0] {
-			// delete the key from the parent
-			for i, k := range n.parent.keys {
-				if k == key {
-					n.parent.keys = cut(i, n.parent.keys)
-					newSeperator := len(n.data) / 2
-					n.parent.keys = append(n.parent.keys, n.data[newSeperator])
-				}
-			}
+	idx := n.indexOf()
+
+	if idx > 0 {
+		if sibling := n.parent.children[idx-1]; sibling.canMerge(t, n) {
+			return sibling.mergeSibling(t, n, idx-1)
 		}
 	}
 
-	// underflow triggers a merge cascade recurse to parent
-	// recurse UPWARD and check invariants
-	if len(n.parent.keys) < ((t.maxDegree - 1) / 2) {
-		if sibling, _, err := n.parent.preMerge(t.maxDegree); err == nil {
-			return n.parent.mergeSibling(t, sibling, key)
-		} else {
-			return errors.New("see rebalancing.go")
+	if idx < len(n.parent.children)-1 {
+		if sibling := n.parent.children[idx+1]; n.canMerge(t, sibling) {
+			return n.mergeSibling(t, sibling, idx)
 		}
 	}
-	return nil
-}
 
-// preMerge if two adjacent leaf nodes have a common parent and their contents fit into a single node
-func (n *node) preMerge(size int) (*node, int, error) {
-	switch n.kind {
-	case INTERNAL_NODE:
-		// no sibling pointers so we have to go up to parent
-		// we check all our siblings if we can re-distribute
-
-		for i, sibling := range n.parent.children {
-			if n == sibling {
-				// cannot merge with self
-				continue
-			} else {
-				// can merge with sibling?
-				if len(sibling.keys)+len(n.keys) < size {
-					return sibling, i, nil
-
-				}
-			}
-		}
+	if idx > 0 {
+		return n.steal(n.parent.children[idx-1], idx-1, true)
+	}
 
-	case LEAF_NODE:
-		if n.previous != nil {
-			if len(n.previous.data)+len(n.data) < size {
-				n.previous.next = n.next
-				return n.previous, 0, nil
-			}
-		}
+	if idx < len(n.parent.children)-1 {
+		return n.steal(n.parent.children[idx+1], idx, false)
+	}
 
-		if n.next != nil {
-			if len(n.next.data)+len(n.data) < size {
-				n.next.previous = n.previous
-				return n.next, 0, nil
-			}
-		}
+	return nil
+}
 
-	case ROOT_NODE:
-		// if underfull merge with first left child
-		if len(n.keys)+len(n.children[0].keys) <= size {
-			return n.children[0], 0, nil
-		}
+// canMerge checks if the contents of n and it's right neighbour fit into a single node
+func (n *node) canMerge(t *BTree, right *node) bool {
+	if n.isLeaf() {
+		return len(n.data)+len(right.data) < t.maxDegree
 	}
 
-	return nil, 0, errors.New("cannot merge with sibling")
+	// the separator is pulled down from the parent
+	return len(n.keys)+len(right.keys)+1 <= t.maxDegree-1
 }
 
 // merging can be... very interesting.
@@ -406,63 +466,329 @@ func (n *node) preMerge(size int) (*node, int, error) {
 // iterator/cursor: https://github.com/cockroachdb/pebble/blob/c4daad9128e053e496fa7916fda8b6df57256823/internal/manifest/btree.go#L973 &&
 // https://github.com/cockroachdb/pebble/blob/c4daad9128e053e496fa7916fda8b6df57256823/internal/manifest/btree.go#L891
 
-// the actual merge operation
+// the actual merge operation, the right neighbour is folded into n and
+// the separator at sepIdx is removed from the (common) parent
 // https://github.com/cockroachdb/pebble/blob/c4daad9128e053e496fa7916fda8b6df57256823/internal/manifest/btree.go#L620
-func (n *node) mergeSibling(t *BTree, sibling *node, key int) error {
+func (n *node) mergeSibling(t *BTree, right *node, sepIdx int) error {
+	if n.parent != right.parent {
+		return fmt.Errorf("%w: merging nodes without a common ancestor", ErrCorrupt)
+	}
+
+	parent := n.parent
+
 	switch n.kind {
 	case LEAF_NODE:
-		_assert(n.parent == sibling.parent, "non-common ancestor")
-		sibling.data = append(sibling.data, n.data...)
+		n.data = append(n.data, right.data...)
+		n.values = append(n.values, right.values...)
 
-		// deallocate/collapse underflow node
-		for i, node := range sibling.parent.children {
-			if node == n {
-				n.parent.children = append(n.parent.children[:i], n.parent.children[i+1:]...)
-			}
+		// deallocate/collapse the right node
+		n.next = right.next
+		if right.next != nil {
+			right.next.previous = n
 		}
 
-		for i, k := range sibling.parent.keys {
-			if k == key {
-				sibling.parent.keys = cut(i, sibling.parent.keys)
-
-				if len(n.parent.keys) < int(math.Ceil(float64(t.maxDegree)/2)) {
-					if sibling, _, err := sibling.parent.preMerge(t.maxDegree); err == nil {
-						return n.parent.mergeSibling(t, sibling, key)
-					} else {
-						return errors.New("see rebalancing.go")
-					}
-				}
-			}
+	case INTERNAL_NODE:
+		n.keys = append(n.keys, parent.keys[sepIdx])
+		n.keys = append(n.keys, right.keys...)
+		n.children = append(n.children, right.children...)
+
+		for _, child := range right.children {
+			child.parent = n
+		}
+	}
+
+	n.size += right.size
+	parent.keys = cut(sepIdx, parent.keys)
+	parent.children = slices.Delete(parent.children, sepIdx+1, sepIdx+2)
+	t.drop(right)
+
+	// underflow triggers a merge cascade recurse to parent
+	// recurse UPWARD and check invariants
+	if parent.kind == ROOT_NODE || len(parent.keys) == 0 || len(parent.keys) < t.minKeys() {
+		return parent.rebalance(t)
+	}
+
+	return nil
+}
+
+// steal moves a single key from a neighbour into n, fromLeft marks the donor as
+// n's left neighbour, sepIdx is the separator between the two in the parent.
+func (n *node) steal(sibling *node, sepIdx int, fromLeft bool) error {
+	parent := n.parent
+
+	if len(sibling.data) < 2 && len(sibling.keys) < 1 {
+		// nothing to lend, the underflow is tolerated
+		return nil
+	}
+
+	switch n.kind {
+	case LEAF_NODE:
+		if fromLeft {
+			last := len(sibling.data) - 1
+			n.data = slices.Insert(n.data, 0, sibling.data[last])
+			n.values = slices.Insert(n.values, 0, sibling.values[last])
+			sibling.data, sibling.values = sibling.data[:last], sibling.values[:last]
+			parent.keys[sepIdx] = shortestSeparator(sibling.data[last-1], n.data[0])
+		} else {
+			n.data = append(n.data, sibling.data[0])
+			n.values = append(n.values, sibling.values[0])
+			sibling.data, sibling.values = slices.Delete(sibling.data, 0, 1), slices.Delete(sibling.values, 0, 1)
+			parent.keys[sepIdx] = shortestSeparator(n.data[len(n.data)-1], sibling.data[0])
 		}
 
 	case INTERNAL_NODE:
-		_assert(n.parent == sibling.parent, "non-common ancestor")
-		sibling.keys = append(sibling.keys, n.keys...)
-		sibling.children = append(sibling.children, n.children...)
-
-		// mark n for deallocation
-		for i, child := range n.parent.children {
-			if child == n {
-				n.parent.children = append(n.parent.children[:i], n.parent.children[i+1:]...)
+		var child *node
+
+		if fromLeft {
+			last := len(sibling.keys) - 1
+			child = sibling.children[last+1]
+
+			n.keys = slices.Insert(n.keys, 0, parent.keys[sepIdx])
+			n.children = slices.Insert(n.children, 0, child)
+			parent.keys[sepIdx] = sibling.keys[last]
+			sibling.keys, sibling.children = sibling.keys[:last], sibling.children[:last+1]
+		} else {
+			child = sibling.children[0]
+
+			n.keys = append(n.keys, parent.keys[sepIdx])
+			n.children = append(n.children, child)
+			parent.keys[sepIdx] = sibling.keys[0]
+			sibling.keys, sibling.children = slices.Delete(sibling.keys, 0, 1), slices.Delete(sibling.children, 0, 1)
+		}
+
+		child.parent = n
+	}
+
+	n.recount()
+	sibling.recount()
+
+	return nil
+}
+
+// collapse replaces a root left with a single child by that child, shrinking the tree height
+func (n *node) collapse(t *BTree) {
+	child := n.children[0]
+	child.kind, child.parent = ROOT_NODE, nil
+
+	if child.isLeaf() {
+		// a root leaf mirrors it's data into it's keys
+		child.keys = slices.Clone(child.data)
+		child.next, child.previous = nil, nil
+	}
+
+	t.root = child
+	t.drop(n)
+}
+
+// drop remembers the page of a node taken out of the tree
+func (t *BTree) drop(n *node) {
+	if n.pageId != 0 {
+		t.dropped = append(t.dropped, uint32(n.pageId))
+	}
+}
+
+// Rank is the number of keys in the tree strictly less than key.
+func (t *BTree) Rank(key int) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.rank(t.order.key(key))
+}
+
+func (t *BTree) rank(key int) int {
+	rank, n := 0, t.root
+
+	for !n.isLeaf() {
+		idx := n.childIndex(key)
+
+		for _, child := range n.children[:idx] {
+			rank += child.size
+		}
+
+		n = n.children[idx]
+	}
+
+	idx, _ := slices.BinarySearch(n.data, key)
+	return rank + idx
+}
+
+// Select returns the i-th smallest key in the tree (zero indexed).
+func (t *BTree) Select(i int) (int, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if i < 0 || i >= t.root.size {
+		return 0, fmt.Errorf("select index %v out of range [0, %v)", i, t.root.size)
+	}
+
+	n := t.root
+
+	for !n.isLeaf() {
+		for _, child := range n.children {
+			if i < child.size {
+				n = child
 				break
 			}
+
+			i -= child.size
 		}
+	}
 
-		// recursive case
-		if len(n.parent.children) < int(math.Ceil(float64(t.maxDegree)/2)) {
-			if sibling, _, err := n.parent.preMerge(t.maxDegree); err == nil {
-				return n.parent.mergeSibling(t, sibling, key)
-			} else {
-				return errors.New("see rebalancing.go")
-			}
+	return t.order.key(n.data[i]), nil
+}
+
+// CountRange counts the keys within [start, end) using only the subtree counts
+// along the two root to leaf paths, the leaves in between are never visited.
+func (t *BTree) CountRange(start, end int) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	start, end = t.order.key(start), t.order.key(end)
+	if end <= start {
+		return 0
+	}
+
+	return t.rank(end) - t.rank(start)
+}
+
+// Len is the number of distinct keys stored in the tree.
+// unwritten is whether the tree changed since it's last checkpoint
+func (t *BTree) unwritten() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.version != t.checkpointed
+}
+
+func (t *BTree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.root.size
+}
+
+// Ceiling returns the smallest key greater than or equal to key.
+func (t *BTree) Ceiling(key int) (int, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	leaf, idx, _ := t.root.search(t.order.key(key))
+	return t.order.found(leaf.ceiling(idx))
+}
+
+// Higher returns the smallest key strictly greater than key.
+func (t *BTree) Higher(key int) (int, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	leaf, idx, err := t.root.search(t.order.key(key))
+	if err == nil {
+		idx++
+	}
+
+	return t.order.found(leaf.ceiling(idx))
+}
+
+// Floor returns the largest key less than or equal to key.
+func (t *BTree) Floor(key int) (int, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	leaf, idx, err := t.root.search(t.order.key(key))
+	if err != nil {
+		idx--
+	}
+
+	return t.order.found(leaf.floor(idx))
+}
+
+// Lower returns the largest key strictly less than key.
+func (t *BTree) Lower(key int) (int, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	leaf, idx, _ := t.root.search(t.order.key(key))
+	return t.order.found(leaf.floor(idx - 1))
+}
+
+// Min returns the smallest key in the tree.
+func (t *BTree) Min() (int, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.order.found(t.root.leftmost().ceiling(0))
+}
+
+// Max returns the largest key in the tree.
+func (t *BTree) Max() (int, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	leaf := t.root.rightmost()
+	return t.order.found(leaf.floor(len(leaf.data) - 1))
+}
+
+func (n *node) leftmost() *node {
+	for !n.isLeaf() {
+		n = n.children[0]
+	}
+
+	return n
+}
+
+func (n *node) rightmost() *node {
+	for !n.isLeaf() {
+		n = n.children[len(n.children)-1]
+	}
+
+	return n
+}
+
+// ceiling reads the key at idx, when idx runs past the end of the leaf
+// the answer lives in the next leaf over so follow the sibling link.
+func (n *node) ceiling(idx int) (int, bool) {
+	for n != nil {
+		if idx < len(n.data) {
+			return n.data[idx], true
 		}
-	case ROOT_NODE:
-		sibling.keys = append(sibling.keys, n.keys...)
-		sibling.kind = ROOT_NODE
-		t.root = sibling
+
+		n, idx = n.next, 0
 	}
 
-	return nil
+	return 0, false
+}
+
+// floor is the mirror of ceiling, walking the previous sibling links.
+func (n *node) floor(idx int) (int, bool) {
+	for n != nil {
+		if idx >= 0 {
+			return n.data[idx], true
+		}
+
+		n = n.previous
+		if n != nil {
+			idx = len(n.data) - 1
+		}
+	}
+
+	return 0, false
+}
+
+// shortestSeparator picks the separator for a leaf split as in a prefix B-tree:
+// any key in (left, right] routes correctly, so take the shortest prefix of right's
+// encoding that still sorts after left and zero fill the rest. key pages drop the
+// trailing zero bytes, which keeps internal cells small.
+// see: Bayer & Unterauer, Prefix B-Trees (1977)
+func shortestSeparator(left, right int) int {
+	_assert(left < right, "separator bounds out of order %v >= %v", left, right)
+
+	l, r := encodeKey(left), encodeKey(right)
+	i := len(commonPrefix(l, r))
+
+	separator := make([]byte, KEY_SIZE)
+	copy(separator, r[:i+1])
+
+	return decodeKey(separator)
 }
 
 // finds the offset in the page and writes to it
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// compare against the checked in baseline with benchstat, see the README
+var benchDegrees = []int{4, 16, 64, 256}
+
+const BENCH_KEYS = 100_000
+
+func forEachDegree(b *testing.B, bench func(b *testing.B, degree int)) {
+	for _, degree := range benchDegrees {
+		b.Run(fmt.Sprintf("degree=%v", degree), func(b *testing.B) {
+			b.ReportAllocs()
+			bench(b, degree)
+		})
+	}
+}
+
+func filledTree(degree int, keys int) *BTree {
+	tree := NewBTree(degree)
+	for i := 0; i < keys; i++ {
+		_ = tree.Upsert(benchKey(i, false), i)
+	}
+
+	return tree
+}
+
+func BenchmarkUpsertSequential(b *testing.B) {
+	forEachDegree(b, func(b *testing.B, degree int) {
+		tree := NewBTree(degree)
+
+		for i := 0; i < b.N; i++ {
+			_ = tree.Upsert(i, i)
+		}
+	})
+}
+
+func BenchmarkUpsertRandom(b *testing.B) {
+	forEachDegree(b, func(b *testing.B, degree int) {
+		tree := NewBTree(degree)
+
+		for i := 0; i < b.N; i++ {
+			_ = tree.Upsert(benchKey(i, false), i)
+		}
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	forEachDegree(b, func(b *testing.B, degree int) {
+		tree := filledTree(degree, BENCH_KEYS)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			_, _, _ = tree.Get(benchKey(i%BENCH_KEYS, false))
+		}
+	})
+}
+
+func BenchmarkLookup(b *testing.B) {
+	forEachDegree(b, func(b *testing.B, degree int) {
+		tree := filledTree(degree, BENCH_KEYS)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			_, _ = tree.Lookup(benchKey(i%BENCH_KEYS, false))
+		}
+	})
+}
+
+func BenchmarkDelete(b *testing.B) {
+	forEachDegree(b, func(b *testing.B, degree int) {
+		tree := filledTree(degree, b.N)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			_ = tree.Delete(benchKey(i, false))
+		}
+	})
+}
+
+// BenchmarkRangeScan reads 100 consecutive keys per op
+func BenchmarkRangeScan(b *testing.B) {
+	forEachDegree(b, func(b *testing.B, degree int) {
+		tree := NewBTree(degree)
+		for i := 0; i < BENCH_KEYS; i++ {
+			_ = tree.Upsert(i, i)
+		}
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			start := i % (BENCH_KEYS - 100)
+
+			for c := tree.SeekRange(start, start+100); c.Valid(); c.Next() {
+				_ = c.Value()
+			}
+		}
+	})
+}
+
+func BenchmarkFindInsertAt(b *testing.B) {
+	for _, size := range benchDegrees {
+		b.Run(fmt.Sprintf("len=%v", size), func(b *testing.B) {
+			b.ReportAllocs()
+
+			elems := make([]int, size)
+			for i := range elems {
+				elems[i] = i * 2
+			}
+
+			// room for one more key, it measures the search and shift but not growing the slice
+			scratch := make([]int, size, size+1)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				copy(scratch, elems)
+				_ = findInsertAt(scratch[:size], (i%size)*2+1)
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"slices"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 type nodeData *[]int
@@ -85,14 +89,14 @@ func TestBTreeMultiDelete(t *testing.T) {
 		_ = tree.Upsert(e, e)
 	}
 
-	// deletion works slightly differently from how one
-	// would expect a b-tree to merge.
-	// it prefers the leftmost neighbour and doesn't steal.
+	// deletion prefers merging into the left neighbour and only
+	// steals when neither neighbour has room, the emptied leaf {5}
+	// folds into {4} and the underflown parent folds into {2}.
 	_ = tree.Delete(5)
 
 	expectedTree := map[nodeData][]int{
-		&tree.root.keys:                         {4, 6},
-		&tree.root.children[0].keys:             {2},
+		&tree.root.keys:                         {6},
+		&tree.root.children[0].keys:             {2, 4},
 		&tree.root.children[0].children[0].data: {1},
 		&tree.root.children[0].children[1].data: {2, 3},
 		&tree.root.children[0].children[2].data: {4},
@@ -109,6 +113,337 @@ func TestBTreeMultiDelete(t *testing.T) {
 
 }
 
+func TestBTreeRandomUpsertDelete(t *testing.T) {
+	for _, degree := range []int{3, 4, 5, 16} {
+		tree := NewBTree(degree)
+		r := rand.New(rand.NewSource(int64(degree)))
+		model := map[int]bool{}
+
+		for i := 0; i < 5_000; i++ {
+			key := r.Intn(1_000)
+
+			if r.Intn(3) == 0 {
+				err := tree.Delete(key)
+				if model[key] != (err == nil) {
+					t.Fatalf("degree %v: delete %v returned %v", degree, key, err)
+				}
+				delete(model, key)
+			} else {
+				_ = tree.Upsert(key, key)
+				model[key] = true
+			}
+		}
+
+		checkTree(t, tree)
+
+		if tree.Len() != len(model) || tree.nodeCount != len(model) {
+			t.Fatalf("degree %v: expected %v keys got %v (nodeCount %v)", degree, len(model), tree.Len(), tree.nodeCount)
+		}
+
+		for key := range model {
+			if !keyExists(tree, key) {
+				t.Fatalf("degree %v: lost key %v", degree, key)
+			}
+		}
+	}
+}
+
+func TestBTreePutLookup(t *testing.T) {
+	tree := NewBTree(4)
+
+	for k := 0; k < 200; k++ {
+		assert.NoError(t, tree.Put(k, []byte(fmt.Sprint("msg_", k))))
+	}
+
+	// replacing a value doesn't add a key
+	assert.NoError(t, tree.Put(7, []byte("seven")))
+	assert.NoError(t, tree.Upsert(8, 88))
+	assert.Equal(t, 200, tree.Len())
+
+	for k := 0; k < 200; k += 2 {
+		assert.NoError(t, tree.Delete(k))
+	}
+	checkTree(t, tree)
+
+	value, err := tree.Lookup(7)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("seven"), value)
+
+	value, _ = tree.Lookup(151)
+	assert.Equal(t, []byte("msg_151"), value)
+
+	_, err = tree.Lookup(8)
+	assert.Error(t, err)
+
+	assert.Error(t, tree.Put(1, make([]byte, OVERFLOW_PAGE_SIZE+1)))
+}
+
+func TestBTreeCompareAndSwap(t *testing.T) {
+	tree := NewBTree(4)
+
+	swapped, err := tree.CompareAndSwap(1, nil, []byte("a"))
+	assert.NoError(t, err)
+	assert.False(t, swapped, "a missing key never swaps")
+
+	assert.NoError(t, tree.Put(1, []byte("a")))
+
+	swapped, _ = tree.CompareAndSwap(1, []byte("b"), []byte("c"))
+	assert.False(t, swapped)
+
+	swapped, _ = tree.CompareAndSwap(1, []byte("a"), []byte("b"))
+	assert.True(t, swapped)
+
+	value, _ := tree.Lookup(1)
+	assert.Equal(t, []byte("b"), value)
+	assert.Equal(t, 1, tree.Len())
+}
+
+func TestBTreeRankSelect(t *testing.T) {
+	tree := NewBTree(4)
+	keys := rand.New(rand.NewSource(1)).Perm(500)
+
+	for _, k := range keys {
+		// only even keys, so odd keys probe the gaps
+		_ = tree.Upsert(k*2, k*2)
+	}
+
+	// duplicates must not inflate the counts
+	_ = tree.Upsert(10, 10)
+	_ = tree.Upsert(10, 10)
+
+	for i := 0; i < 500; i++ {
+		key, err := tree.Select(i)
+		if err != nil || key != i*2 {
+			t.Fatalf("select(%v) = %v, %v", i, key, err)
+		}
+
+		if rank := tree.Rank(i * 2); rank != i {
+			t.Fatalf("rank(%v) = %v", i*2, rank)
+		}
+
+		if rank := tree.Rank(i*2 + 1); rank != i+1 {
+			t.Fatalf("rank(%v) = %v", i*2+1, rank)
+		}
+	}
+
+	if _, err := tree.Select(500); err == nil {
+		t.Errorf("select past the end must fail")
+	}
+
+	if _, err := tree.Select(-1); err == nil {
+		t.Errorf("select of a negative index must fail")
+	}
+
+	assert.Equal(t, 500, tree.Len())
+	assert.Equal(t, 0, tree.Rank(-5))
+	assert.Equal(t, 500, tree.Rank(1_000_000))
+	assert.Equal(t, 50, tree.CountRange(100, 200))
+	assert.Equal(t, 51, tree.CountRange(100, 201))
+	assert.Equal(t, 0, tree.CountRange(200, 100))
+	assert.Equal(t, 500, tree.CountRange(-1, 1_000))
+
+	for k := 0; k < 250; k++ {
+		_ = tree.Delete(k * 4)
+	}
+
+	checkTree(t, tree)
+	assert.Equal(t, 250, tree.Len())
+	assert.Equal(t, 50, tree.CountRange(0, 200))
+
+	key, _ := tree.Select(0)
+	assert.Equal(t, 2, key)
+}
+
+func TestBTreeNeighbourLookups(t *testing.T) {
+	tree := NewBTree(3)
+
+	if _, ok := tree.Min(); ok {
+		t.Errorf("empty tree has no minimum")
+	}
+
+	if _, ok := tree.Ceiling(1); ok {
+		t.Errorf("empty tree has no ceiling")
+	}
+
+	// keys 10, 20 .. 500 spread over many leaves
+	for _, k := range rand.New(rand.NewSource(7)).Perm(50) {
+		_ = tree.Upsert((k+1)*10, k)
+	}
+
+	for key := 5; key <= 505; key++ {
+		below, above := (key/10)*10, ((key+9)/10)*10
+		hit := key%10 == 0
+
+		floor, ok := tree.Floor(key)
+		assert.Equal(t, below >= 10, ok, "floor(%v)", key)
+		if ok {
+			assert.Equal(t, below, floor, "floor(%v)", key)
+		}
+
+		ceiling, ok := tree.Ceiling(key)
+		assert.Equal(t, above <= 500, ok, "ceiling(%v)", key)
+		if ok {
+			assert.Equal(t, above, ceiling, "ceiling(%v)", key)
+		}
+
+		lower, ok := tree.Lower(key)
+		if hit {
+			below -= 10
+		}
+		assert.Equal(t, below >= 10, ok, "lower(%v)", key)
+		if ok {
+			assert.Equal(t, below, lower, "lower(%v)", key)
+		}
+
+		higher, ok := tree.Higher(key)
+		if hit {
+			above += 10
+		}
+		assert.Equal(t, above <= 500, ok, "higher(%v)", key)
+		if ok {
+			assert.Equal(t, above, higher, "higher(%v)", key)
+		}
+	}
+
+	min, _ := tree.Min()
+	max, _ := tree.Max()
+	assert.Equal(t, 10, min)
+	assert.Equal(t, 500, max)
+
+	_ = tree.Delete(10)
+	_ = tree.Delete(500)
+
+	min, _ = tree.Min()
+	max, _ = tree.Max()
+	assert.Equal(t, 20, min)
+	assert.Equal(t, 490, max)
+}
+
+func TestShortestSeparator(t *testing.T) {
+	cases := []struct{ left, right, expected int }{
+		{1, 2, 2},
+		{0x1234_5678, 0x1299_0000, 0x1299_0000},
+		{0x1234_5678, 0x1235_0001, 0x1235_0000},
+		{0x10_ffff_ffff, 0x11_0000_0003, 0x11_0000_0000},
+		{-1, 0, 0},
+		{-5, 1 << 40, 0},
+	}
+
+	for _, c := range cases {
+		sep := shortestSeparator(c.left, c.right)
+		assert.Equal(t, c.expected, sep, "separator of (%v, %v]", c.left, c.right)
+		assert.True(t, c.left < sep && sep <= c.right)
+	}
+}
+
+func TestBTreeSplitPromotesShortSeparators(t *testing.T) {
+	tree := NewBTree(3)
+
+	for _, k := range []int{0x1234_5678, 0x1235_0001, 0x1235_0002} {
+		_ = tree.Upsert(k, k)
+	}
+
+	assert.Equal(t, []int{0x1235_0000}, tree.root.keys)
+	checkTree(t, tree)
+
+	// a key between the separator and the right leaf still routes left
+	_ = tree.Upsert(0x1234_ffff, 0)
+	checkTree(t, tree)
+	assert.True(t, keyExists(tree, 0x1234_ffff))
+}
+
+// checkTree walks the tree and verifies key ordering, separators, parent
+// pointers, sibling links and subtree counts
+func checkTree(t *testing.T, tree *BTree) {
+	t.Helper()
+
+	if err := verifyTree(tree); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// verifyTree checks the structural invariants: sorted nodes, keys within their
+// separators, parent and sibling pointers, subtree sizes and a value per key
+func verifyTree(tree *BTree) error {
+	var leaves []*node
+	var walk func(n *node, lo, hi *int) (int, error)
+
+	walk = func(n *node, lo, hi *int) (int, error) {
+		if !slices.IsSorted(n.keys) || !slices.IsSorted(n.data) {
+			return 0, fmt.Errorf("unsorted node %v %v", n.keys, n.data)
+		}
+
+		if n.isLeaf() {
+			for _, k := range n.data {
+				if (lo != nil && k < *lo) || (hi != nil && k >= *hi) {
+					return 0, fmt.Errorf("key %v outside of separators", k)
+				}
+			}
+
+			if n.size != len(n.data) {
+				return 0, fmt.Errorf("leaf size %v but holds %v keys", n.size, len(n.data))
+			}
+
+			if len(n.values) != len(n.data) {
+				return 0, fmt.Errorf("leaf holds %v keys but %v values", len(n.data), len(n.values))
+			}
+
+			leaves = append(leaves, n)
+			return n.size, nil
+		}
+
+		if len(n.children) != len(n.keys)+1 {
+			return 0, fmt.Errorf("%v children for %v keys", len(n.children), len(n.keys))
+		}
+
+		total := 0
+		for i, child := range n.children {
+			if child.parent != n {
+				return 0, errors.New("broken parent pointer")
+			}
+
+			clo, chi := lo, hi
+			if i > 0 {
+				clo = &n.keys[i-1]
+			}
+			if i < len(n.keys) {
+				chi = &n.keys[i]
+			}
+
+			size, err := walk(child, clo, chi)
+			if err != nil {
+				return 0, err
+			}
+
+			total += size
+		}
+
+		if n.size != total {
+			return 0, fmt.Errorf("internal size %v but subtree holds %v keys", n.size, total)
+		}
+
+		return total, nil
+	}
+
+	if _, err := walk(tree.root, nil, nil); err != nil {
+		return err
+	}
+
+	if len(leaves) > 1 {
+		for i, leaf := range leaves {
+			if i > 0 && leaf.previous != leaves[i-1] {
+				return errors.New("broken previous sibling pointer")
+			}
+
+			if i < len(leaves)-1 && leaf.next != leaves[i+1] {
+				return errors.New("broken next sibling pointer")
+			}
+		}
+	}
+
+	return nil
+}
+
 func BenchmarkBTree(b *testing.B) {
 	tree := NewBTree(3)
 
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// model based testing: random operations are applied to a BTree and to a
+// sorted map, every result is compared and the invariants are checked after
+// each step. a failing sequence is shrunk and printed as a Go test.
+
+type propOpKind int
+
+const (
+	PROP_UPSERT propOpKind = iota
+	PROP_GET
+	PROP_DELETE
+	PROP_RANGE
+	PROP_CURSOR
+)
+
+type propOp struct {
+	kind  propOpKind
+	key   int
+	value int // upsert
+	end   int // range end, cursor steps
+}
+
+// goString renders the op as the statement of a reproducer
+func (op propOp) goString() string {
+	switch op.kind {
+	case PROP_UPSERT:
+		return fmt.Sprintf("_ = tree.Upsert(%v, %v)", op.key, op.value)
+	case PROP_GET:
+		return fmt.Sprintf("_, _ = tree.Lookup(%v)", op.key)
+	case PROP_DELETE:
+		return fmt.Sprintf("_ = tree.Delete(%v)", op.key)
+	case PROP_RANGE:
+		return fmt.Sprintf("_ = tree.Range(%v, %v)", op.key, op.end)
+	default:
+		return fmt.Sprintf("for c, i := tree.Seek(%v), 0; c.Valid() && i < %v; i++ {\n\t\tc.Next()\n\t}", op.key, op.end)
+	}
+}
+
+// sortedModel is the reference, a map plus it's keys in order
+type sortedModel struct {
+	keys   []int
+	values map[int]string
+}
+
+func (m *sortedModel) upsert(key int, value string) {
+	if _, ok := m.values[key]; !ok {
+		idx, _ := slices.BinarySearch(m.keys, key)
+		m.keys = slices.Insert(m.keys, idx, key)
+	}
+
+	m.values[key] = value
+}
+
+func (m *sortedModel) delete(key int) bool {
+	idx, found := slices.BinarySearch(m.keys, key)
+	if found {
+		m.keys = slices.Delete(m.keys, idx, idx+1)
+		delete(m.values, key)
+	}
+
+	return found
+}
+
+// from returns the keys >= start
+func (m *sortedModel) from(start int) []int {
+	idx, _ := slices.BinarySearch(m.keys, start)
+	return m.keys[idx:]
+}
+
+// genOps draws n operations over a small keyspace so keys collide often
+func genOps(r *rand.Rand, n int) []propOp {
+	keyspace := 8 << r.Intn(5)
+	ops := make([]propOp, n)
+
+	for i := range ops {
+		op := propOp{key: r.Intn(keyspace) - keyspace/4}
+
+		switch p := r.Intn(100); {
+		case p < 45:
+			op.kind, op.value = PROP_UPSERT, r.Intn(1000)
+		case p < 60:
+			op.kind = PROP_GET
+		case p < 85:
+			op.kind = PROP_DELETE
+		case p < 93:
+			op.kind, op.end = PROP_RANGE, op.key+r.Intn(keyspace/2)
+		default:
+			op.kind, op.end = PROP_CURSOR, r.Intn(keyspace/2)
+		}
+
+		ops[i] = op
+	}
+
+	return ops
+}
+
+// runOps replays ops against a fresh tree, it returns the step that went
+// wrong and why, or -1. panics are failures too.
+func runOps(degree int, ops []propOp) (step int, err error) {
+	tree := NewBTree(degree)
+	model := &sortedModel{values: map[int]string{}}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	for step = range ops {
+		if err = applyOp(tree, model, ops[step]); err != nil {
+			return step, err
+		}
+
+		if err = verifyTree(tree); err != nil {
+			return step, err
+		}
+
+		if tree.Len() != len(model.keys) {
+			return step, fmt.Errorf("tree counts %v keys, want %v", tree.Len(), len(model.keys))
+		}
+	}
+
+	return -1, nil
+}
+
+func applyOp(tree *BTree, model *sortedModel, op propOp) error {
+	switch op.kind {
+	case PROP_UPSERT:
+		if err := tree.Upsert(op.key, op.value); err != nil {
+			return fmt.Errorf("upsert: %v", err)
+		}
+
+		model.upsert(op.key, strconv.Itoa(op.value))
+
+	case PROP_GET:
+		value, err := tree.Lookup(op.key)
+		want, ok := model.values[op.key]
+
+		if ok != (err == nil) || string(value) != want {
+			return fmt.Errorf("lookup(%v) = %q, %v want %q, present %v", op.key, value, err, want, ok)
+		}
+
+		data, idx, _ := tree.Get(op.key)
+		if ok != (idx < len(data) && data[idx] == op.key) {
+			return fmt.Errorf("get(%v) = %v at %v, present %v", op.key, data, idx, ok)
+		}
+
+	case PROP_DELETE:
+		err := tree.Delete(op.key)
+		if ok := model.delete(op.key); ok != (err == nil) {
+			return fmt.Errorf("delete(%v) = %v, present %v", op.key, err, ok)
+		}
+
+	case PROP_RANGE:
+		var want []int
+		for _, k := range model.from(op.key) {
+			if k >= op.end {
+				break
+			}
+			want = append(want, k)
+		}
+
+		if got := tree.Range(op.key, op.end); !slices.Equal(got, want) {
+			return fmt.Errorf("range(%v, %v) = %v want %v", op.key, op.end, got, want)
+		}
+
+	case PROP_CURSOR:
+		want := model.from(op.key)
+		c := tree.Seek(op.key)
+
+		for i := 0; i < op.end; i++ {
+			if c.Valid() != (i < len(want)) {
+				return fmt.Errorf("seek(%v) step %v valid %v want %v", op.key, i, c.Valid(), i < len(want))
+			}
+
+			if !c.Valid() {
+				break
+			}
+
+			if c.Key() != want[i] || string(c.Value()) != model.values[want[i]] {
+				return fmt.Errorf("seek(%v) step %v = %v:%q want %v:%q", op.key, i, c.Key(), c.Value(), want[i], model.values[want[i]])
+			}
+
+			c.Next()
+		}
+	}
+
+	return nil
+}
+
+// shrink minimises a failing sequence: it drops chunks of ops, halving the
+// chunk size down to single ops, then pulls keys and values towards zero.
+func shrink(ops []propOp, fails func([]propOp) bool) []propOp {
+	for chunk := len(ops) / 2; chunk >= 1; {
+		removed := false
+
+		for start := 0; start+chunk <= len(ops); {
+			candidate := slices.Delete(slices.Clone(ops), start, start+chunk)
+
+			if fails(candidate) {
+				ops, removed = candidate, true
+			} else {
+				start += chunk
+			}
+		}
+
+		if !removed {
+			chunk /= 2
+		}
+	}
+
+	simpler := func(v int) []int {
+		if v == 0 {
+			return nil
+		}
+
+		return []int{0, v / 2, v - v/abs(v)}
+	}
+
+	for i := range ops {
+		for _, field := range []*int{&ops[i].key, &ops[i].value, &ops[i].end} {
+			for progress := true; progress; {
+				progress = false
+
+				for _, v := range simpler(*field) {
+					old := *field
+					*field = v
+
+					if fails(ops) {
+						progress = true
+						break
+					}
+
+					*field = old
+				}
+			}
+		}
+	}
+
+	return ops
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+
+	return v
+}
+
+// reproducer prints the ops as a test that can be pasted into btree_index_test.go
+func reproducer(degree int, ops []propOp, err error) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "func TestBTreeRepro(t *testing.T) {\n")
+	fmt.Fprintf(&b, "\ttree := NewBTree(%v)\n", degree)
+
+	for _, op := range ops {
+		fmt.Fprintf(&b, "\t%v\n", op.goString())
+	}
+
+	fmt.Fprintf(&b, "\tcheckTree(t, tree)\n")
+	fmt.Fprintf(&b, "\t// %v\n}\n", err)
+
+	return b.String()
+}
+
+func TestBTreeModel(t *testing.T) {
+	seeds := 500
+	if testing.Short() {
+		seeds = 50
+	}
+
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		r := rand.New(rand.NewSource(seed))
+		degree := []int{3, 4, 5, 8}[r.Intn(4)]
+		ops := genOps(r, 300)
+
+		step, err := runOps(degree, ops)
+		if err == nil {
+			continue
+		}
+
+		minimal := shrink(ops[:step+1], func(candidate []propOp) bool {
+			_, err := runOps(degree, candidate)
+			return err != nil
+		})
+
+		_, err = runOps(degree, minimal)
+		t.Fatalf("seed %v failed at step %v, shrunk from %v to %v ops:\n\n%v",
+			seed, step, step+1, len(minimal), reproducer(degree, minimal, err))
+	}
+}
+
+func TestShrinkFindsMinimalSequence(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	ops := genOps(r, 200)
+
+	// a made up bug: deleting 7 after it was upserted twice
+	ops = append(ops, propOp{kind: PROP_UPSERT, key: 7, value: 99}, propOp{kind: PROP_UPSERT, key: 7, value: 3},
+		propOp{kind: PROP_DELETE, key: 7})
+
+	fails := func(candidate []propOp) bool {
+		upserts := 0
+		for _, op := range candidate {
+			switch {
+			case op.kind == PROP_UPSERT && op.key == 7:
+				upserts++
+			case op.kind == PROP_DELETE && op.key == 7 && upserts >= 2:
+				return true
+			}
+		}
+
+		return false
+	}
+
+	minimal := shrink(ops, fails)
+
+	want := []propOp{{kind: PROP_UPSERT, key: 7}, {kind: PROP_UPSERT, key: 7}, {kind: PROP_DELETE, key: 7}}
+	if !slices.Equal(minimal, want) {
+		t.Fatalf("shrunk to %v want %v", minimal, want)
+	}
+
+	repro := reproducer(3, minimal, nil)
+	if !strings.Contains(repro, "\t_ = tree.Upsert(7, 0)\n\t_ = tree.Upsert(7, 0)\n\t_ = tree.Delete(7)\n") {
+		t.Fatalf("unexpected reproducer:\n%v", repro)
+	}
+}
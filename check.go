@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// CheckReport is the outcome of auditing a datafile offline, errors are
+// inconsistencies that lose or misplace data, warnings only waste space.
+type CheckReport struct {
+	Header fileHeader
+
+	Pages         int
+	TreePages     int
+	FreePages     int
+	FreelistPages int
+	Depth         int
+	Keys          int
+
+	Errors   []string
+	Warnings []string
+
+	Repaired bool
+	Dropped  int
+}
+
+func (r *CheckReport) errorf(format string, v ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, v...))
+}
+
+func (r *CheckReport) warnf(format string, v ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, v...))
+}
+
+func (r *CheckReport) Print(w io.Writer) {
+	h := r.Header
+	fmt.Fprintf(w, "header: version %v, page size %v, degree %v, generation %v\n", h.Version, h.PageSize, h.MaxDegree, h.Generation)
+	fmt.Fprintf(w, "pages: %v total, %v tree, %v free, %v freelist\n", r.Pages, r.TreePages, r.FreePages, r.FreelistPages)
+	fmt.Fprintf(w, "tree: root page %v, depth %v, %v keys\n", h.RootPage, r.Depth, r.Keys)
+
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(w, "warning: %v\n", warning)
+	}
+
+	for _, err := range r.Errors {
+		fmt.Fprintf(w, "error: %v\n", err)
+	}
+
+	if r.Repaired {
+		fmt.Fprintf(w, "repaired: freelist rebuilt with %v pages, %v pages dropped\n", r.FreePages, r.Dropped)
+	}
+
+	if len(r.Errors) == 0 {
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// checker holds the state of a single audit
+type checker struct {
+	datafile File
+	pageSize int
+	cipher   *pageCipher
+	report   *CheckReport
+
+	pages     map[uint32]*Page // pages that decoded cleanly
+	reachable map[uint32]bool
+	leafDepth int
+}
+
+// CheckFile walks the header, every page, the tree from the root and the freelist.
+// with repair set the freelist is rebuilt from the pages the tree doesn't reach
+// and unreachable pages at the end of the file are truncated. keys is nil unless the
+// datafile is encrypted.
+func CheckFile(path string, repair bool, keys KeyProvider) (*CheckReport, error) {
+	return checkFile(OSFS, path, repair, keys)
+}
+
+func checkFile(fs VFS, path string, repair bool, keys KeyProvider) (*CheckReport, error) {
+	flags := os.O_RDONLY
+	if repair {
+		flags = os.O_RDWR
+	}
+
+	datafile, err := fs.OpenFile(path, flags, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer datafile.Close()
+
+	// a repair rewrites the freelist, nobody else may have the file open
+	if err = datafile.Lock(repair); err != nil {
+		return nil, fmt.Errorf("locking %v: %w", path, err)
+	}
+
+	report, err := check(datafile, repair, keys)
+
+	// otherwise a writer may have reused pages of the checkpoint under audit, they
+	// would turn up as errors so the audit starts over from the next one
+	for retry := 0; !repair && report != nil && retry < READ_ONLY_RELOADS && headerMoved(datafile, report.Header); retry++ {
+		report, err = check(datafile, repair, keys)
+	}
+
+	return report, err
+}
+
+// Check audits the datafile of an open db as of it's last checkpoint
+func (db *DB) Check() (*CheckReport, error) {
+	if err := db.readable(); err != nil {
+		return nil, err
+	}
+
+	// no checkpoint or compaction may run under the audit
+	db.storeMu.Lock()
+	defer db.storeMu.Unlock()
+
+	db.tree.mu.RLock()
+	defer db.tree.mu.RUnlock()
+
+	return check(db.datafile, false, db.opts.Keys)
+}
+
+func check(datafile File, repair bool, keys KeyProvider) (*CheckReport, error) {
+	h, err := ReadHeader(datafile)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher, err := headerCipher(h, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checker{
+		datafile:  datafile,
+		pageSize:  int(h.PageSize),
+		cipher:    cipher,
+		report:    &CheckReport{Header: h, Pages: int(h.PageCount)},
+		pages:     map[uint32]*Page{},
+		reachable: map[uint32]bool{},
+		leafDepth: -1,
+	}
+
+	c.checkPages()
+	c.checkTree()
+	// the tree errors, a page the walk couldn't read may still lead to pages in use
+	treeErrors := len(c.report.Errors)
+	free, freelistPages := c.checkFreelist()
+
+	for id := uint32(1); id <= h.PageCount; id++ {
+		if !c.reachable[id] && !slices.Contains(free, id) && !slices.Contains(freelistPages, id) {
+			c.report.warnf("page %v is unreachable and not on the freelist", id)
+		}
+	}
+
+	if repair && treeErrors > 0 {
+		return c.report, fmt.Errorf("%w: not repairing a tree with %v errors, every page it can't reach would be freed", errCheckFailed, treeErrors)
+	}
+
+	if repair {
+		if err := c.repair(freelistPages); err != nil {
+			return c.report, err
+		}
+	}
+
+	return c.report, nil
+}
+
+// checkPages verifies the checksum and the slotted layout of every allocated page
+func (c *checker) checkPages() {
+	size, err := c.datafile.Size()
+	if err != nil {
+		c.report.errorf("stat: %v", err)
+		return
+	}
+
+	expected := c.report.Header.end()
+	if size < expected {
+		c.report.errorf("file is %v bytes, %v pages need %v bytes", size, c.report.Header.PageCount, expected)
+	} else if size > expected {
+		c.report.warnf("%v trailing bytes past the last page", size-expected)
+	}
+
+	for id := uint32(1); id <= c.report.Header.PageCount; id++ {
+		page, err := openPage(int(id), c.pageSize, c.report.Header.pageStart(), c.cipher, c.datafile)
+		if err != nil {
+			// only an error once it turns out the page is in use
+			continue
+		}
+
+		if problem := verifyLayout(&page); problem != "" {
+			c.report.errorf("page %v: %v", id, problem)
+			continue
+		}
+
+		c.pages[id] = &page
+	}
+}
+
+// verifyLayout bounds checks the slot array and every cell before anything is decoded
+func verifyLayout(p *Page) string {
+	size, high := p.end(), p.high()
+
+	if int(p.PLower) != PAGE_HEADER_SIZE+int(p.PrefixLen)+2*int(p.NumSlots) {
+		return fmt.Sprintf("PLower %v does not end the slot array of %v slots", p.PLower, p.NumSlots)
+	}
+
+	if int(p.PLower) > high || high > size {
+		return fmt.Sprintf("PLower %v and PHigh %v out of bounds", p.PLower, high)
+	}
+
+	if int(p.FreeSlots) != high-int(p.PLower) {
+		return fmt.Sprintf("%v free bytes recorded, %v between PLower and PHigh", p.FreeSlots, high-int(p.PLower))
+	}
+
+	if p.PrefixLen > KEY_SIZE {
+		return fmt.Sprintf("key prefix of %v bytes", p.PrefixLen)
+	}
+
+	for i := 0; i < int(p.NumSlots); i++ {
+		offset := p.cellOffset(i)
+		if offset < high || offset >= size {
+			return fmt.Sprintf("cell %v at offset %v outside of the cell area [%v, %v)", i, offset, high, size)
+		}
+
+		var end int
+		switch p.CellLayout {
+		case KEY_CELL:
+			end = offset + 1 + int(p.buf[offset]) + 4
+			if int(p.buf[offset]) > KEY_SIZE-int(p.PrefixLen) {
+				return fmt.Sprintf("cell %v key suffix of %v bytes", i, p.buf[offset])
+			}
+		case KEY_VALUE_CELL:
+			end = offset + KEY_SIZE - int(p.PrefixLen)
+			if end < size {
+				length, n := binary.Uvarint(p.buf[end:])
+				if n <= 0 || length > uint64(size) {
+					return fmt.Sprintf("cell %v has a malformed value length", i)
+				}
+
+				end += n + int(length)
+			}
+		default:
+			return fmt.Sprintf("unknown cell layout %v", p.CellLayout)
+		}
+
+		if end > size {
+			return fmt.Sprintf("cell %v runs past the end of the page", i)
+		}
+	}
+
+	keys := p.Keys()
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			return fmt.Sprintf("keys out of order at slot %v: %v >= %v", i, keys[i-1], keys[i])
+		}
+	}
+
+	return ""
+}
+
+func (c *checker) checkTree() {
+	root := c.report.Header.RootPage
+	if root == 0 {
+		return
+	}
+
+	c.walk(root, 0, nil, nil)
+
+	if c.report.Keys != int(c.report.Header.KeyCount) {
+		c.report.errorf("header records %v keys, the leaves hold %v", c.report.Header.KeyCount, c.report.Keys)
+	}
+}
+
+// walk descends from the root checking every child is a valid, unvisited page
+// and that keys stay within the [lo, hi) bounds set by the separators above
+func (c *checker) walk(id uint32, depth int, lo, hi *int) {
+	if id == 0 || id > c.report.Header.PageCount {
+		c.report.errorf("reference to page %v outside of the file", id)
+		return
+	}
+
+	if c.reachable[id] {
+		c.report.errorf("page %v is referenced more than once", id)
+		return
+	}
+
+	c.reachable[id] = true
+	c.report.TreePages++
+
+	page, ok := c.pages[id]
+	if !ok {
+		if _, err := openPage(int(id), c.pageSize, c.report.Header.pageStart(), c.cipher, c.datafile); err != nil {
+			c.report.errorf("tree page %v: %v", id, err)
+		}
+		return
+	}
+
+	switch {
+	case depth == 0 && page.PageType != ROOT_NODE:
+		c.report.errorf("root page %v has page type %v", id, page.PageType)
+	case depth > 0 && page.PageType != INTERNAL_NODE && page.PageType != LEAF_NODE:
+		c.report.errorf("page %v has page type %v", id, page.PageType)
+	}
+
+	keys := page.Keys()
+	if len(keys) > 0 && ((lo != nil && keys[0] < *lo) || (hi != nil && keys[len(keys)-1] >= *hi)) {
+		c.report.errorf("page %v holds keys outside of it's parent's separators", id)
+	}
+
+	if page.CellLayout == KEY_VALUE_CELL {
+		c.report.Keys += len(keys)
+
+		if c.leafDepth == -1 {
+			c.leafDepth = depth
+			c.report.Depth = depth + 1
+		} else if c.leafDepth != depth {
+			c.report.errorf("leaf page %v at depth %v, expected %v", id, depth, c.leafDepth)
+		}
+
+		return
+	}
+
+	for i := 0; i <= len(keys); i++ {
+		clo, chi := lo, hi
+		if i > 0 {
+			clo = &keys[i-1]
+		}
+		if i < len(keys) {
+			chi = &keys[i]
+		}
+
+		c.walk(page.Child(i), depth+1, clo, chi)
+	}
+}
+
+// checkFreelist walks the freelist chain, returning the free pages it lists and
+// the pages making up the chain
+func (c *checker) checkFreelist() (free, chain []uint32) {
+	h := c.report.Header
+
+	for id := h.FreeList; id != 0; {
+		if id > h.PageCount || slices.Contains(chain, id) {
+			c.report.errorf("freelist chain is broken at page %v", id)
+			break
+		}
+
+		page, ok := c.pages[id]
+		if !ok || page.PageType != FREELIST_PAGE {
+			c.report.errorf("page %v in the freelist chain is not a valid freelist page", id)
+			break
+		}
+
+		if c.reachable[id] {
+			c.report.errorf("freelist page %v is in use by the tree", id)
+		}
+
+		chain = append(chain, id)
+		id = page.RightChild
+
+		for _, k := range page.Keys() {
+			free = append(free, uint32(k))
+		}
+	}
+
+	listed := map[uint32]bool{}
+	for _, id := range free {
+		switch {
+		case id == 0 || id > h.PageCount:
+			c.report.errorf("freelist lists page %v outside of the file", id)
+		case c.reachable[id]:
+			c.report.errorf("freelist lists page %v which is in use by the tree", id)
+		case slices.Contains(chain, id):
+			c.report.errorf("freelist lists it's own page %v", id)
+		case listed[id]:
+			c.report.errorf("freelist lists page %v twice", id)
+		}
+
+		listed[id] = true
+	}
+
+	c.report.FreePages, c.report.FreelistPages = len(free), len(chain)
+	return free, chain
+}
+
+// repair rebuilds the freelist out of every page the tree doesn't reach and
+// truncates the unreachable pages at the end of the file. it only runs on a tree
+// that checked out, otherwise pages under a corrupt one would be handed out.
+func (c *checker) repair(oldChain []uint32) error {
+	h := c.report.Header
+	last := uint32(0)
+
+	for id := range c.reachable {
+		last = max(last, id)
+	}
+
+	// the old chain stays intact until the new header is written
+	var free, pending []uint32
+	for id := uint32(1); id <= last; id++ {
+		switch {
+		case c.reachable[id]:
+		case slices.Contains(oldChain, id):
+			pending = append(pending, id)
+		default:
+			free = append(free, id)
+		}
+	}
+
+	sm := StoreManager{datafile: c.datafile, header: h, free: free, cipher: c.cipher}
+	sm.header.PageCount = last
+
+	if err := sm.writeFreelist(pending); err != nil {
+		return err
+	}
+
+	if err := sm.WriteHeader(); err != nil {
+		return err
+	}
+
+	if err := c.datafile.Truncate(sm.header.end()); err != nil {
+		return err
+	}
+
+	c.report.Repaired = true
+	c.report.Dropped = int(h.PageCount) - int(sm.header.PageCount)
+	c.report.Header = sm.header
+	c.report.Pages, c.report.FreePages, c.report.FreelistPages = int(sm.header.PageCount), len(sm.free), len(sm.freelistPages)
+	c.report.Warnings = nil
+
+	return nil
+}
+
+var errCheckFailed = errors.New("integrity check failed")
+
+// bubblegum check [--repair] [--key-file path] <datafile>
+func runCheck(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "rebuild the freelist and drop unreachable pages")
+	keyFile := flags.String("key-file", "", "file holding the key of an encrypted datafile hex encoded")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: bubblegum check [--repair] [--key-file path] <datafile>")
+	}
+
+	keys, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	report, err := CheckFile(flags.Arg(0), *repair, keys)
+	if report != nil {
+		report.Print(os.Stdout)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("%w: %v errors", errCheckFailed, len(report.Errors))
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func checkpointedDB(t *testing.T, keys int) string {
+	path := filepath.Join(t.TempDir(), "db")
+
+	db, err := OpenDB(path, 6)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	for k := 0; k < keys; k++ {
+		_ = db.tree.Upsert(k, k)
+	}
+
+	assert.NoError(t, db.Checkpoint())
+	assert.NoError(t, db.Checkpoint())
+
+	return path
+}
+
+func TestCheckCleanFile(t *testing.T) {
+	path := checkpointedDB(t, 500)
+
+	report, err := CheckFile(path, false, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Empty(t, report.Warnings)
+	assert.Equal(t, 500, report.Keys)
+	assert.Equal(t, report.Pages, report.TreePages+report.FreePages+report.FreelistPages)
+	assert.Greater(t, report.FreePages, 0)
+}
+
+func TestCheckCorruptTreePage(t *testing.T) {
+	path := checkpointedDB(t, 500)
+
+	db, _ := OpenDB(path, 6)
+	root := db.storeManager.header.RootPage
+	offset := db.pageStart + int64(root-1)*PAGE_SIZE
+	_, _ = db.datafile.WriteAt([]byte{0xde, 0xad}, offset+PAGE_SIZE-2)
+	db.Close()
+
+	report, err := CheckFile(path, false, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, report.Errors[0], "corrupt page")
+	assert.Contains(t, report.Errors[1], "the leaves hold 0")
+}
+
+// pages under a corrupt internal page can't be told apart from leaked ones
+func TestCheckRepairRefusesCorruptTree(t *testing.T) {
+	path := checkpointedDB(t, 500)
+
+	db, _ := OpenDB(path, 6)
+	internal, start := db.tree.root.children[0].pageId, db.pageStart
+	db.Close()
+
+	datafile, _ := OSFS.OpenFile(path, os.O_RDWR, 0)
+	_, _ = datafile.WriteAt([]byte{0xde, 0xad}, start+internal*PAGE_SIZE-2)
+	datafile.Close()
+
+	before, _ := os.ReadFile(path)
+
+	report, err := CheckFile(path, true, nil)
+	assert.ErrorIs(t, err, errCheckFailed)
+	assert.ErrorContains(t, err, "not repairing")
+	assert.False(t, report.Repaired)
+	assert.NotEmpty(t, report.Errors)
+
+	after, _ := os.ReadFile(path)
+	assert.Equal(t, before, after)
+}
+
+func TestCheckRepairLeakedPages(t *testing.T) {
+	path := checkpointedDB(t, 500)
+
+	// leak the freelist, and the tail of the file along with it
+	db, _ := OpenDB(path, 6)
+	pages := db.storeManager.header.PageCount
+	db.storeManager.header.FreeList = 0
+	assert.NoError(t, db.storeManager.WriteHeader())
+	db.Close()
+
+	report, err := CheckFile(path, false, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.NotEmpty(t, report.Warnings)
+
+	report, err = CheckFile(path, true, nil)
+	assert.NoError(t, err)
+	assert.True(t, report.Repaired)
+	assert.Less(t, report.Header.PageCount, pages)
+
+	report, err = CheckFile(path, false, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Empty(t, report.Warnings)
+
+	db, err = OpenDB(path, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, 500, db.tree.Len())
+	db.Close()
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Checkpoint persists the in-memory tree as of now. pages are never updated in place:
+// every node is written to a page that is free as of the previous checkpoint, then
+// the freelist, and only then the header is switched over to the new root.
+// a crash at any point before the header write leaves the previous checkpoint intact.
+// see: https://www.sqlite.org/atomiccommit.html && bbolt's meta pages
+// a failed write or fsync poisons the db, see: DB.poison
+func (db *DB) Checkpoint() (err error) {
+	if err = db.writable(); err != nil {
+		return err
+	}
+
+	defer db.recoverInvariant(&err)
+
+	if err = db.checkpoint(); errors.Is(err, ErrIO) {
+		db.poison(err)
+	}
+
+	return err
+}
+
+func (db *DB) checkpoint() error {
+	t := db.tree
+
+	db.storeMu.Lock()
+	defer db.storeMu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return db.writeCheckpoint()
+}
+
+// writeCheckpoint is checkpoint with storeMu held and the tree locked
+func (db *DB) writeCheckpoint() (err error) {
+	t := db.tree
+	sm := &db.storeManager
+
+	// the previous checkpoint's pages are only released once the header moves on
+	var pending []uint32
+	var pages []*Page
+	var moved []movedNode
+
+	if err = sm.syncHeader(); err != nil {
+		return err
+	}
+
+	// a failed checkpoint leaves the freelist and the header as they were, the
+	// pages it wrote are free again and the nodes keep the pages of the last one
+	header, free, freelistPages := sm.header, sm.free, sm.freelistPages
+	defer func() {
+		if err != nil {
+			sm.header, sm.free, sm.freelistPages = header, free, freelistPages
+		}
+	}()
+
+	root, err := db.writeNode(t.root, &pending, &pages, &moved)
+	if err != nil {
+		return err
+	}
+
+	// the nodes must be on disk before anything points at them
+	if err = sm.flushPages(pages); err != nil {
+		return err
+	}
+
+	// nodes merged away since the last checkpoint are still on it's pages too
+	pending = append(pending, t.dropped...)
+	pending = append(pending, sm.freelistPages...)
+	if err = sm.writeFreelist(pending); err != nil {
+		return err
+	}
+
+	sm.header.RootPage = root
+	sm.header.MaxDegree = uint32(t.maxDegree)
+	sm.header.KeyCount = uint64(t.root.size)
+	sm.header.Generation++
+
+	if err = sm.WriteHeader(); err != nil {
+		return err
+	}
+
+	for _, m := range moved {
+		m.node.pageId = int64(m.pageId)
+	}
+	t.dropped = nil
+
+	t.checkpointed = t.version
+	return nil
+}
+
+// movedNode is a node's page in the checkpoint being written, it's only
+// assigned once the header points at it
+type movedNode struct {
+	node   *node
+	pageId uint32
+}
+
+// writeNode lays out the subtree under n into new pages bottom up, children
+// first so their page ids can be stored in the parent
+func (db *DB) writeNode(n *node, pending *[]uint32, pages *[]*Page, moved *[]movedNode) (uint32, error) {
+	var children []uint32
+
+	for _, child := range n.children {
+		id, err := db.writeNode(child, pending, pages, moved)
+		if err != nil {
+			return 0, err
+		}
+
+		children = append(children, id)
+	}
+
+	page, err := db.storeManager.NewPage()
+	if err != nil {
+		return 0, err
+	}
+
+	keys := n.keys
+	if n.isLeaf() {
+		keys = n.data
+		err = page.writeCells(n.data, n.values, nil)
+	} else {
+		err = page.writeCells(n.keys, nil, children)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("node with %v keys does not fit a page, lower the degree: %w", len(keys), err)
+	}
+
+	page.PageType = n.kind
+	*pages = append(*pages, page)
+
+	if n.pageId != 0 {
+		*pending = append(*pending, uint32(n.pageId))
+	}
+
+	*moved = append(*moved, movedNode{node: n, pageId: page.PageID})
+	return page.PageID, nil
+}
+
+// load rebuilds the in-memory tree from the last checkpoint
+func (db *DB) load() error {
+	sm := &db.storeManager
+
+	if err := sm.Open(db.opts.Keys); err != nil {
+		return err
+	}
+
+	if err := db.opts.checkHeader(sm.header); err != nil {
+		return err
+	}
+
+	db.pageSize, db.pageStart = sm.pageSize(), sm.header.pageStart()
+
+	// pages keep the codec they were written with, only new ones switch
+	if db.opts.Compression != "" {
+		sm.header.Codec = db.opts.codec()
+	}
+
+	if sm.header.MaxDegree < 3 {
+		return fmt.Errorf("%w: datafile records a degree of %v, the minimum is 3", ErrCorrupt, sm.header.MaxDegree)
+	}
+
+	db.tree = NewBTree(int(sm.header.MaxDegree))
+	db.tree.order = COMPARATORS[sm.header.comparator()]
+
+	if sm.header.RootPage == 0 {
+		return nil
+	}
+
+	var leaves []*node
+	root, err := db.loadNode(sm.header.RootPage, nil, &leaves)
+	if err != nil {
+		return err
+	}
+
+	// sibling pointers aren't persisted, the leaves are read in key order
+	for i := 1; i < len(leaves); i++ {
+		leaves[i-1].next, leaves[i].previous = leaves[i], leaves[i-1]
+	}
+
+	root.kind = ROOT_NODE
+	if root.isLeaf() {
+		// a root leaf mirrors it's data into it's keys
+		root.keys = slices.Clone(root.data)
+	}
+
+	db.tree.root = root
+	db.tree.nodeCount = root.size
+
+	return nil
+}
+
+func (db *DB) loadNode(pageId uint32, parent *node, leaves *[]*node) (*node, error) {
+	page, err := db.FetchPage(int(pageId))
+	if err != nil {
+		return nil, err
+	}
+
+	n := &node{kind: page.PageType, parent: parent, pageId: int64(pageId)}
+
+	if page.CellLayout == KEY_CELL {
+		n.keys = page.Keys()
+
+		for i := 0; i <= int(page.NumSlots); i++ {
+			child, err := db.loadNode(page.Child(i), n, leaves)
+			if err != nil {
+				return nil, err
+			}
+
+			n.children = append(n.children, child)
+		}
+	} else {
+		// quarantined pages come back as empty leaves
+		n.kind, n.data = LEAF_NODE, page.Keys()
+
+		for i := range n.data {
+			n.values = append(n.values, slices.Clone(page.Value(i)))
+		}
+		*leaves = append(*leaves, n)
+	}
+
+	n.recount()
+	return n, nil
+}
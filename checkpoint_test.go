@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpointAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+
+	db, err := OpenDB(path, 8)
+	assert.NoError(t, err)
+
+	keys := rand.New(rand.NewSource(3)).Perm(2_000)
+	for _, k := range keys {
+		_ = db.tree.Upsert(k, k*10)
+	}
+
+	assert.NoError(t, db.Checkpoint())
+
+	// writes after the checkpoint go out on close
+	_ = db.tree.Upsert(5_000, 0)
+	assert.NoError(t, db.Close())
+
+	db, err = OpenDB(path, 3)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 8, db.tree.maxDegree)
+	assert.Equal(t, 2_001, db.tree.Len())
+	assert.True(t, keyExists(db.tree, 5_000))
+	checkTree(t, db.tree)
+
+	for k := 0; k < 2_000; k++ {
+		value, err := db.tree.Lookup(k)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(k*10), string(value))
+	}
+
+	// the tree keeps working after a reload
+	for k := 0; k < 1_000; k++ {
+		assert.NoError(t, db.tree.Delete(k))
+	}
+	checkTree(t, db.tree)
+	db.Close()
+}
+
+func TestCheckpointRecyclesPages(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "db"), 16)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	for k := 0; k < 1_000; k++ {
+		_ = db.tree.Upsert(k, k)
+	}
+
+	// it takes a few checkpoints before there are enough pages to recycle
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, db.Checkpoint())
+	}
+	size := db.storeManager.header.PageCount
+
+	// steady state: every checkpoint reuses the pages freed by the one before
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, db.Checkpoint())
+	}
+
+	assert.Equal(t, size, db.storeManager.header.PageCount)
+	assert.Equal(t, uint64(7), db.storeManager.header.Generation)
+}
+
+func TestOpenRejectsForeignFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, _ := OpenDB(path, 4)
+	_, _ = db.datafile.WriteAt([]byte("not a db"), 0)
+	db.Close()
+
+	_, err := OpenDB(path, 4)
+	assert.ErrorIs(t, err, errNotADatafile)
+}
+
+// pages written in parallel land exactly where the serial writer puts them
+func TestCheckpointWritersAgree(t *testing.T) {
+	var files [][]byte
+
+	for _, writers := range []int{1, 16} {
+		path := filepath.Join(t.TempDir(), "db")
+		db, err := Open(path, &Options{MaxDegree: 8, CreateIfMissing: true, CheckpointWriters: writers})
+		assert.NoError(t, err)
+
+		r := rand.New(rand.NewSource(1))
+		for round := 0; round < 5; round++ {
+			for i := 0; i < 500; i++ {
+				assert.NoError(t, db.Insert(r.Intn(5000), []byte(fmt.Sprint("v", i))))
+			}
+			assert.NoError(t, db.Checkpoint())
+		}
+		db.Close()
+
+		contents, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		files = append(files, contents)
+	}
+
+	assert.Equal(t, files[0], files[1])
+}
+
+// a checkpoint that fails without poisoning the db leaves the header and the
+// nodes on the pages of the last one, so does a failed rekey
+func TestFailedCheckpointKeepsPages(t *testing.T) {
+	path := checkpointedDB(t, 500)
+
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	header, pages := db.storeManager.header, db.tree.root.pageIds(nil)
+
+	// a value no page takes in the last leaf written, the limit is only checked on the way in
+	leaf := db.tree.root.rightmost()
+	value := leaf.values[0]
+	leaf.values[0] = make([]byte, PAGE_SIZE)
+
+	assert.ErrorIs(t, db.Checkpoint(), errPageFull)
+	assert.ErrorIs(t, db.Rekey(testKey), errPageFull)
+	assert.NoError(t, db.Poisoned())
+	assert.Equal(t, header, db.storeManager.header)
+	assert.Equal(t, pages, db.tree.root.pageIds(nil))
+
+	leaf.values[0] = value
+	assert.NoError(t, db.Insert(500, value))
+	assert.NoError(t, db.Close())
+
+	report, err := CheckFile(path, false, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Empty(t, report.Warnings)
+	assert.Equal(t, 501, report.Keys)
+}
+
+// the pages of nodes merged away, down to the old roots of a collapsing tree,
+// are on the freelist of the next checkpoint
+func TestMergesFreeTheirPages(t *testing.T) {
+	path := checkpointedDB(t, 500)
+
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+
+	for k := 1; k < 500; k++ {
+		assert.NoError(t, db.Delete(k))
+	}
+	assert.True(t, db.tree.root.isLeaf())
+	assert.NoError(t, db.Checkpoint())
+
+	report, err := db.Check()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Empty(t, report.Warnings)
+	assert.Empty(t, db.tree.dropped)
+	db.Close()
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+)
+
+// CompactProgress is what Compact reports after each of it's steps
+type CompactProgress struct {
+	Step int
+	// pages in the datafile after the step
+	Pages uint32
+	// pages the tree and the freelist take up
+	Live int
+	// pages truncated off the end of the datafile since the compaction started
+	Reclaimed int
+}
+
+// COMPACT_STEP_PAGES caps the pages a step of Compact moves, the parents on the
+// way to the root included
+const COMPACT_STEP_PAGES = 64
+
+// Compact shrinks the datafile. the first step puts every page the last checkpoint
+// doesn't use back on the freelist (files from before merged nodes gave their pages
+// back to the next checkpoint leaked them) and truncates
+// the free end of the file. pages are never updated in place, so the steps after
+// copy the last pages of the tree (up to COMPACT_STEP_PAGES with their parents) into
+// the lowest free pages then do the same, until no page of the tree can move lower.
+// progress, if not nil, is called after every step.
+// a step only copies pages the last checkpoint wrote, it holds the tree's read
+// lock so readers carry on and writers wait for the step, not the whole compaction.
+// run it in a goroutine to compact in the background.
+func (db *DB) Compact(progress func(CompactProgress)) (err error) {
+	if err = db.writable(); err != nil {
+		return err
+	}
+
+	defer db.recoverInvariant(&err)
+
+	var start, pages uint32
+
+	for step := 1; ; step++ {
+		p, more, err := db.compactStep(step > 1)
+		if errors.Is(err, ErrIO) {
+			db.poison(err)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if step == 1 {
+			start = p.Pages + uint32(p.Reclaimed)
+		}
+
+		p.Step, p.Reclaimed = step, int(start)-int(p.Pages)
+		if progress != nil {
+			progress(p)
+		}
+
+		// a step that didn't shrink the file won't be followed by one that does
+		if !more || step > 1 && p.Pages >= pages {
+			return nil
+		}
+		pages = p.Pages
+	}
+}
+
+// compactStep truncates the free end of the file, with move set it moves the last
+// pages of the tree lower first. more is whether another step would move a page
+func (db *DB) compactStep(move bool) (p CompactProgress, more bool, err error) {
+	t := db.tree
+	sm := &db.storeManager
+
+	db.storeMu.Lock()
+	defer db.storeMu.Unlock()
+
+	// writers may change the tree under the step's feet but no checkpoint of theirs
+	// gets in before storeMu is released, the pages the header points at stay put
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	before := sm.header.PageCount
+
+	// a failed step leaves the freelist and the header as they were
+	header, free, freelistPages := sm.header, sm.free, sm.freelistPages
+	defer func() {
+		if err != nil {
+			sm.header, sm.free, sm.freelistPages = header, free, freelistPages
+		}
+	}()
+
+	parents := map[uint32]uint32{}
+	tree, err := db.checkpointedPages(sm.header.RootPage, nil, parents)
+	if err != nil {
+		return p, false, err
+	}
+
+	var moved map[uint32]uint32
+	if move {
+		if moved, err = db.movePages(tree, parents); err != nil {
+			return p, false, err
+		}
+
+		if len(moved) > 0 {
+			tree, parents = remapPages(tree, parents, moved)
+			sm.header.RootPage = tree[0]
+			sm.header.Generation++
+		}
+	}
+
+	// the pages that were moved are on the tree of the header on disk until the
+	// first write of the freelist, each write releases the chain before it. either
+	// may hold the last page
+	var pending []uint32
+	for id := range moved {
+		pending = append(pending, id)
+	}
+
+	for {
+		released := append(slices.Clone(sm.freelistPages), pending...)
+
+		if err = sm.reclaim(tree, pending); err != nil {
+			return p, false, err
+		}
+
+		// with the moved pages still taken the chain may have grown the file
+		grew := len(pending) > 0 && slices.Contains(sm.freelistPages, sm.header.PageCount)
+		pending = nil
+
+		if !grew && !slices.Contains(released, sm.header.PageCount) {
+			break
+		}
+	}
+
+	// the header points at the copies now, the nodes follow. only storeMu
+	// holders look at the page of a node
+	t.root.movePages(moved)
+	for i, id := range t.dropped {
+		if to, ok := moved[id]; ok {
+			t.dropped[i] = to
+		}
+	}
+
+	// the pages past the end are only gone once the header that dropped them is
+	if err = sm.syncHeader(); err != nil {
+		return p, false, err
+	}
+
+	// a page of the pool from the end may be a view of the mapping, reading it would fault
+	sm.pool.dropPast(sm.header.PageCount)
+	if err = db.mmap.truncate(db.datafile, sm.header.end()); err != nil {
+		return p, false, ioError(err, "truncating the datafile to %v pages", sm.header.PageCount)
+	}
+
+	if err = db.datafile.Sync(); err != nil {
+		return p, false, ioError(err, "fsync of the truncated datafile")
+	}
+
+	more = len(pagesToMove(tree, parents, sm.free)) > 0
+
+	p = CompactProgress{Pages: sm.header.PageCount, Live: len(tree) + len(sm.freelistPages), Reclaimed: int(before) - int(sm.header.PageCount)}
+	return p, more, nil
+}
+
+// pagesToMove picks the last pages of the tree and the parents that point at them,
+// as many as the lowest free pages can take with every copy landing below every
+// page it picked, so the last page of the tree drops. children come before parents
+func pagesToMove(tree []uint32, parents map[uint32]uint32, free []uint32) map[uint32]bool {
+	picked := map[uint32]bool{}
+	last := slices.Clone(tree)
+	slices.Sort(last)
+
+	for i := len(last) - 1; i >= 0; i-- {
+		id := last[i]
+
+		var chain []uint32
+		for p := id; p != 0 && !picked[p]; p = parents[p] {
+			chain = append(chain, p)
+		}
+
+		if len(chain) == 0 {
+			continue
+		}
+
+		n := len(picked) + len(chain)
+		if n > COMPACT_STEP_PAGES || n > len(free) || free[n-1] >= id {
+			break
+		}
+
+		for _, p := range chain {
+			picked[p] = true
+		}
+	}
+
+	return picked
+}
+
+// movePages copies the pages pagesToMove picks into the lowest free pages, children
+// first so their parents are written with the new ids, and maps the old ids to
+// the copies. the old pages stay on the tree the header points at until reclaim
+// writes the one that drops them
+func (db *DB) movePages(tree []uint32, parents map[uint32]uint32) (map[uint32]uint32, error) {
+	sm := &db.storeManager
+
+	// the pages the last header freed may still be on the tree of the one on disk
+	if err := sm.syncHeader(); err != nil {
+		return nil, err
+	}
+
+	picked := pagesToMove(tree, parents, sm.free)
+	moved := map[uint32]uint32{}
+	var pages []*Page
+
+	// tree lists parents before their children, backwards it's children first
+	for i := len(tree) - 1; i >= 0; i-- {
+		id := tree[i]
+		if !picked[id] {
+			continue
+		}
+
+		old, err := db.FetchPage(int(id))
+		if err != nil {
+			return nil, err
+		}
+
+		page, err := sm.NewPage()
+		if err != nil {
+			return nil, err
+		}
+
+		keys := old.Keys()
+		if old.CellLayout == KEY_CELL {
+			children := make([]uint32, len(keys)+1)
+			for c := range children {
+				children[c] = old.Child(c)
+				if to, ok := moved[children[c]]; ok {
+					children[c] = to
+				}
+			}
+
+			err = page.writeCells(keys, nil, children)
+		} else {
+			values := make([][]byte, len(keys))
+			for v := range values {
+				values[v] = old.Value(v)
+			}
+
+			err = page.writeCells(keys, values, nil)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("copying page %v to %v: %w", id, page.PageID, err)
+		}
+
+		page.PageType = old.PageType
+		moved[id] = page.PageID
+		pages = append(pages, page)
+	}
+
+	// the copies must be on disk before anything points at them
+	if err := sm.flushPages(pages); err != nil {
+		return nil, err
+	}
+
+	return moved, nil
+}
+
+// remapPages is tree and parents with the moved pages swapped for their copies
+func remapPages(tree []uint32, parents map[uint32]uint32, moved map[uint32]uint32) ([]uint32, map[uint32]uint32) {
+	remap := func(id uint32) uint32 {
+		if to, ok := moved[id]; ok {
+			return to
+		}
+		return id
+	}
+
+	ids := make([]uint32, len(tree))
+	to := make(map[uint32]uint32, len(parents))
+
+	for i, id := range tree {
+		ids[i] = remap(id)
+	}
+
+	for child, parent := range parents {
+		to[remap(child)] = remap(parent)
+	}
+
+	return ids, to
+}
+
+// reclaim lists every page up to the last one of the tree, the freelist chain or
+// pending as free but those, the pages past it are dropped. pending pages are
+// still on the tree of the last header so they're only listed
+func (s *StoreManager) reclaim(tree []uint32, pending []uint32) error {
+	if err := s.syncHeader(); err != nil {
+		return err
+	}
+
+	live := make([]bool, s.header.PageCount+1)
+	last := uint32(0)
+
+	for _, id := range append(append(slices.Clone(tree), s.freelistPages...), pending...) {
+		live[id] = true
+		last = max(last, id)
+	}
+
+	var free []uint32
+	for id := uint32(1); id <= last; id++ {
+		if !live[id] {
+			free = append(free, id)
+		}
+	}
+
+	// the chain the header points at is only released by the new one
+	s.free, s.header.PageCount = free, last
+	if err := s.writeFreelist(append(slices.Clone(s.freelistPages), pending...)); err != nil {
+		return err
+	}
+
+	return s.WriteHeader()
+}
+
+// checkpointedPages appends the pages of the tree under pageId as the datafile has
+// it, parents before their children, and maps every page to it's parent in parents
+func (db *DB) checkpointedPages(pageId uint32, ids []uint32, parents map[uint32]uint32) ([]uint32, error) {
+	if pageId == 0 {
+		return ids, nil
+	}
+
+	page, err := db.FetchPage(int(pageId))
+	if err != nil {
+		return nil, err
+	}
+
+	ids = append(ids, pageId)
+	if page.CellLayout != KEY_CELL {
+		return ids, nil
+	}
+
+	for i := 0; i <= int(page.NumSlots); i++ {
+		parents[page.Child(i)] = pageId
+
+		if ids, err = db.checkpointedPages(page.Child(i), ids, parents); err != nil {
+			return nil, err
+		}
+	}
+
+	return ids, nil
+}
+
+// pageIds appends the pages of the subtree under n as of the last checkpoint
+func (n *node) pageIds(ids []uint32) []uint32 {
+	ids = append(ids, uint32(n.pageId))
+
+	for _, child := range n.children {
+		ids = child.pageIds(ids)
+	}
+
+	return ids
+}
+
+// movePages points the nodes of the subtree under n that were on a moved page at it's copy
+func (n *node) movePages(moved map[uint32]uint32) {
+	if to, ok := moved[uint32(n.pageId)]; ok {
+		n.pageId = int64(to)
+	}
+
+	for _, child := range n.children {
+		child.movePages(moved)
+	}
+}
+
+// bubblegum compact [--key-file path] <datafile>
+func runCompact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	keyFile := flags.String("key-file", "", "file holding the key of an encrypted datafile hex encoded")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: bubblegum compact [--key-file path] <datafile>")
+	}
+
+	keys, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := Open(flags.Arg(0), &Options{Keys: keys})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	before, err := db.datafile.Size()
+	if err != nil {
+		return err
+	}
+
+	err = db.Compact(func(p CompactProgress) {
+		fmt.Printf("step %v: %v pages, %v live, %v reclaimed\n", p.Step, p.Pages, p.Live, p.Reclaimed)
+	})
+	if err != nil {
+		return err
+	}
+
+	after, err := db.datafile.Size()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%v went from %v to %v bytes\n", flags.Arg(0), before, after)
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// shrunkDB checkpoints many keys then deletes most of them, the merges free pages
+// all over the file and the tree ends up spread over a larger one
+func shrunkDB(t *testing.T, opts *Options) (*DB, string) {
+	path := filepath.Join(t.TempDir(), "db")
+	opts.MaxDegree, opts.CreateIfMissing = 6, true
+
+	db, err := Open(path, opts)
+	assert.NoError(t, err)
+
+	for k := 0; k < 3000; k++ {
+		assert.NoError(t, db.Insert(k, []byte(fmt.Sprintf("value %v", k))))
+	}
+	assert.NoError(t, db.Checkpoint())
+
+	for k := 0; k < 3000; k++ {
+		if k%10 != 0 {
+			assert.NoError(t, db.Delete(k))
+		}
+	}
+	assert.NoError(t, db.Checkpoint())
+
+	return db, path
+}
+
+func TestCompact(t *testing.T) {
+	for _, opts := range []Options{{}, {Compression: "lz4"}, {Keys: testKey}, {MmapSize: 1 << 24}} {
+		db, path := shrunkDB(t, &opts)
+
+		report, err := db.Check()
+		assert.NoError(t, err)
+		assert.Empty(t, report.Warnings, "merged nodes give their pages back")
+		before := report.Pages
+
+		var steps []CompactProgress
+		assert.NoError(t, db.Compact(func(p CompactProgress) {
+			steps = append(steps, p)
+		}))
+
+		assert.NotEmpty(t, steps)
+		last := steps[len(steps)-1]
+		assert.Equal(t, len(steps), last.Step)
+		assert.Equal(t, before-int(last.Pages), last.Reclaimed)
+		assert.Less(t, int(last.Pages), before/2)
+
+		for i := 1; i < len(steps); i++ {
+			assert.Less(t, steps[i].Pages, steps[i-1].Pages, "every step shrinks the file")
+		}
+
+		info, _ := os.Stat(path)
+		assert.Equal(t, db.pageStart+int64(last.Pages)*int64(db.pageSize), info.Size())
+
+		report, err = db.Check()
+		assert.NoError(t, err)
+		assert.Empty(t, report.Errors)
+		assert.Empty(t, report.Warnings)
+
+		// the tree keeps working after and the file grows back from the end
+		value, err := db.Get(2990)
+		assert.NoError(t, err)
+		assert.Equal(t, "value 2990", string(value))
+
+		for k := 3000; k < 4000; k++ {
+			assert.NoError(t, db.Insert(k, []byte("after")))
+		}
+		assert.NoError(t, db.Checkpoint())
+		db.Close()
+
+		report, err = CheckFile(path, false, opts.Keys)
+		assert.NoError(t, err)
+		assert.Empty(t, report.Errors)
+		assert.Equal(t, 1300, report.Keys)
+
+		db, err = Open(path, &opts)
+		assert.NoError(t, err)
+		assert.Equal(t, 1300, db.tree.Len())
+		db.Close()
+	}
+}
+
+// a compacted file has nothing to reclaim and no free pages to move the tree into
+func TestCompactTwice(t *testing.T) {
+	db, _ := shrunkDB(t, &Options{})
+	defer db.Close()
+
+	assert.NoError(t, db.Compact(nil))
+	pages := db.storeManager.header.PageCount
+
+	var steps []CompactProgress
+	assert.NoError(t, db.Compact(func(p CompactProgress) {
+		steps = append(steps, p)
+	}))
+
+	assert.Len(t, steps, 1)
+	assert.Equal(t, pages, steps[0].Pages)
+	assert.Zero(t, steps[0].Reclaimed)
+}
+
+// readers and writers run while a compaction shrinks the file underneath them
+func TestCompactInBackground(t *testing.T) {
+	db, path := shrunkDB(t, &Options{})
+
+	var wg sync.WaitGroup
+	done := make(chan error)
+
+	go func() {
+		done <- db.Compact(nil)
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+
+		go func(r int) {
+			defer wg.Done()
+
+			for i := 0; i < 200; i++ {
+				value, err := db.Get(10 * (i % 300))
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("value %v", 10*(i%300)), string(value))
+			}
+		}(r)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for k := 5000; k < 5200; k++ {
+			assert.NoError(t, db.Insert(k, []byte("concurrent")))
+		}
+	}()
+
+	wg.Wait()
+	assert.NoError(t, <-done)
+	assert.NoError(t, db.Checkpoint())
+	db.Close()
+
+	report, err := CheckFile(path, false, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, 500, report.Keys)
+}
+
+// scans and stats run through every step, see: go test -race -run TestCompactAlongsideReaders
+func TestCompactAlongsideReaders(t *testing.T) {
+	db, _ := shrunkDB(t, &Options{})
+	defer db.Close()
+
+	sh := &shell{db: db, out: io.Discard}
+	done := make(chan error)
+
+	go func() {
+		done <- db.Compact(nil)
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+			return
+		default:
+		}
+
+		keys := 0
+		db.tree.Scan(0, 3000, func(key int, value []byte) {
+			assert.Equal(t, fmt.Sprintf("value %v", key), string(value))
+			keys++
+		})
+		assert.Equal(t, 300, keys)
+
+		sh.stats()
+		sh.printTree()
+	}
+}
+
+// a reader holding the tree's read lock doesn't hold a compaction up, reads
+// go through in the middle of it
+func TestCompactDoesntBlockReaders(t *testing.T) {
+	db, _ := shrunkDB(t, &Options{})
+	defer db.Close()
+
+	db.tree.mu.RLock()
+	done := make(chan error)
+	reads := 0
+
+	go func() {
+		done <- db.Compact(func(p CompactProgress) {
+			value, err := db.Get(2990)
+			assert.NoError(t, err)
+			assert.Equal(t, "value 2990", string(value))
+			reads++
+		})
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		db.tree.mu.RUnlock()
+		t.Fatal("the compaction waits for the reader")
+	}
+	db.tree.mu.RUnlock()
+
+	assert.Greater(t, reads, 1)
+}
+
+func TestCompactCommand(t *testing.T) {
+	db, path := shrunkDB(t, &Options{})
+	db.Close()
+
+	before, _ := os.Stat(path)
+	assert.NoError(t, runCompact([]string{path}))
+
+	after, _ := os.Stat(path)
+	assert.Less(t, after.Size(), before.Size())
+
+	report, err := CheckFile(path, false, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Warnings)
+	assert.Equal(t, 300, report.Keys)
+
+	db, _ = Open(path, &Options{ReadOnly: true})
+	defer db.Close()
+	assert.ErrorIs(t, db.Compact(nil), ErrReadOnly)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Codec compresses leaf pages, the codec of a page is recorded in it's header
+// so a datafile can hold pages of several codecs after switching between them
+type Codec uint8
+
+const (
+	CODEC_NONE Codec = iota
+	// the lz4 block format, see: lz4.go
+	CODEC_LZ4
+)
+
+var codecNames = []string{"none", "lz4"}
+
+func (c Codec) String() string {
+	if int(c) < len(codecNames) {
+		return codecNames[c]
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+func parseCodec(name string) (Codec, error) {
+	if i := slices.Index(codecNames, name); i >= 0 {
+		return Codec(i), nil
+	}
+
+	return 0, fmt.Errorf("unknown compression %q, one of %v", name, codecNames)
+}
+
+// compress appends the compressed src to dst
+func (c Codec) compress(dst, src []byte) []byte {
+	switch c {
+	case CODEC_LZ4:
+		return lz4Compress(dst, src)
+	}
+
+	return append(dst, src...)
+}
+
+// decompress fills dst from src, src must decompress to exactly len(dst) bytes
+func (c Codec) decompress(dst, src []byte) error {
+	switch c {
+	case CODEC_NONE:
+		if len(src) != len(dst) {
+			return fmt.Errorf("%w: %v bytes stored for %v", ErrCorrupt, len(src), len(dst))
+		}
+
+		copy(dst, src)
+		return nil
+	case CODEC_LZ4:
+		return lz4Decompress(dst, src)
+	}
+
+	return fmt.Errorf("%w: unknown codec %v", ErrCorrupt, c)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+)
+
+// Cursor walks the leaves in key order by following the sibling pointers,
+// it never climbs back up through the internal nodes once positioned.
+// a cursor is a snapshot of leaf positions, writes to the tree invalidate it.
+type Cursor struct {
+	tree *BTree
+	leaf *node
+	idx  int
+
+	// exclusive upper bound, only honoured when bounded
+	end     int
+	bounded bool
+}
+
+// Seek positions a cursor at the first key greater than or equal to key.
+func (t *BTree) Seek(key int) *Cursor {
+	return t.seek(t.order.key(key))
+}
+
+// seek positions a cursor at a stored key
+func (t *BTree) seek(key int) *Cursor {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	leaf, idx, _ := t.root.search(key)
+	c := &Cursor{tree: t, leaf: leaf, idx: idx}
+	c.settle()
+
+	return c
+}
+
+// SeekRange positions a cursor at start that stops before end.
+func (t *BTree) SeekRange(start, end int) *Cursor {
+	c := t.Seek(start)
+	c.end, c.bounded = t.order.key(end), true
+
+	return c
+}
+
+// SeekPrefix positions a cursor at the first key whose encoded form starts
+// with prefix, it becomes invalid at the first key past the prefix.
+func (t *BTree) SeekPrefix(prefix []byte) *Cursor {
+	start, end, bounded, ok := prefixBounds(t.order.prefix(prefix))
+
+	if !ok {
+		return &Cursor{tree: t}
+	}
+
+	c := t.seek(start)
+	c.end, c.bounded = end, bounded
+
+	return c
+}
+
+func (c *Cursor) Valid() bool {
+	if c.leaf == nil || c.idx >= len(c.leaf.data) {
+		return false
+	}
+
+	return !c.bounded || c.leaf.data[c.idx] < c.end
+}
+
+func (c *Cursor) Key() int {
+	_assert(c.Valid(), "read from an exhausted cursor")
+	return c.tree.order.key(c.leaf.data[c.idx])
+}
+
+func (c *Cursor) Value() []byte {
+	_assert(c.Valid(), "read from an exhausted cursor")
+	return c.leaf.values[c.idx]
+}
+
+func (c *Cursor) Next() {
+	if c.leaf == nil {
+		return
+	}
+
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+
+	c.idx++
+	c.settle()
+}
+
+// settle hops over to the next leaf once the current one is exhausted
+func (c *Cursor) settle() {
+	for c.leaf != nil && c.idx >= len(c.leaf.data) && c.leaf.next != nil {
+		c.leaf, c.idx = c.leaf.next, 0
+	}
+}
+
+// Scan visits up to limit keys from start under a single read lock, unlike
+// a cursor it's safe to use while other goroutines write to the tree.
+func (t *BTree) Scan(start, limit int, visit func(key int, value []byte)) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	leaf, idx, _ := t.root.search(t.order.key(start))
+
+	for ; leaf != nil && limit > 0; leaf, idx = leaf.next, 0 {
+		for ; idx < len(leaf.data) && limit > 0; idx, limit = idx+1, limit-1 {
+			visit(t.order.key(leaf.data[idx]), leaf.values[idx])
+		}
+	}
+}
+
+// Range collects the keys within [start, end).
+func (t *BTree) Range(start, end int) []int {
+	return t.collect(t.order.key(start), t.order.key(end), true)
+}
+
+// ScanPrefix collects every key whose encoded form starts with prefix.
+func (t *BTree) ScanPrefix(prefix []byte) []int {
+	start, end, bounded, ok := prefixBounds(t.order.prefix(prefix))
+	if !ok {
+		return nil
+	}
+
+	return t.collect(start, end, bounded)
+}
+
+// collect gathers the keys from the stored start up to end (or the last key when
+// it's not bounded) under a single read lock like Scan, so writers can run alongside
+func (t *BTree) collect(start, end int, bounded bool) []int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var keys []int
+	leaf, idx, _ := t.root.search(start)
+
+	for ; leaf != nil; leaf, idx = leaf.next, 0 {
+		for ; idx < len(leaf.data); idx++ {
+			if bounded && leaf.data[idx] >= end {
+				return keys
+			}
+
+			keys = append(keys, t.order.key(leaf.data[idx]))
+		}
+	}
+
+	return keys
+}
+
+// keys are compared as signed integers, flipping the sign bit of the
+// big endian form gives a byte string that sorts the same way.
+// e.g tenant 42 owns every key starting with 0x80 0x00 0x00 0x2a
+func encodeKey(key int) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(key)^(1<<63))
+
+	return buf
+}
+
+func decodeKey(buf []byte) int {
+	return int(binary.BigEndian.Uint64(buf) ^ (1 << 63))
+}
+
+// prefixBounds turns a key prefix into the half open interval [start, end)
+// of keys sharing it. the upper bound is the prefix successor: the last byte
+// that isn't 0xFF is incremented and the rest dropped, a prefix made up only
+// of 0xFF bytes has no successor and runs to the end of the keyspace.
+func prefixBounds(prefix []byte) (start, end int, bounded, ok bool) {
+	if len(prefix) > 8 {
+		return 0, 0, false, false
+	}
+
+	lo := make([]byte, 8)
+	copy(lo, prefix)
+	start = decodeKey(lo)
+
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != math.MaxUint8 {
+			hi := make([]byte, 8)
+			copy(hi, prefix[:i])
+			hi[i] = prefix[i] + 1
+
+			return start, decodeKey(hi), true, true
+		}
+	}
+
+	return start, 0, false, true
+}
+
+// keyOrder is the mask of a comparator, a key is stored xor'ed with it so the
+// stored keys sort as signed integers in the order of the comparator. xor undoes
+// itself, the same mask turns a stored key back into the key
+type keyOrder int
+
+func (o keyOrder) key(key int) int {
+	return key ^ int(o)
+}
+
+func (o keyOrder) keys(keys []int) []int {
+	if o == 0 {
+		return keys
+	}
+
+	stored := make([]int, len(keys))
+	for i, key := range keys {
+		stored[i] = o.key(key)
+	}
+
+	return stored
+}
+
+// found maps the key of a ceiling or floor lookup back
+func (o keyOrder) found(key int, ok bool) (int, bool) {
+	return o.key(key), ok
+}
+
+// prefix maps the prefix of an encoded key onto the encoded stored keys, the
+// encoding is big endian so the mask lines up byte for byte
+func (o keyOrder) prefix(prefix []byte) []byte {
+	if o == 0 {
+		return prefix
+	}
+
+	mask := binary.BigEndian.AppendUint64(nil, uint64(o))
+	stored := slices.Clone(prefix)
+
+	for i := range stored[:min(len(stored), len(mask))] {
+		stored[i] ^= mask[i]
+	}
+
+	return stored
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyEncodingPreservesOrder(t *testing.T) {
+	keys := []int{math.MinInt, -1 << 40, -2, -1, 0, 1, 2, 1 << 40, math.MaxInt}
+
+	for i := 1; i < len(keys); i++ {
+		if slices.Compare(encodeKey(keys[i-1]), encodeKey(keys[i])) >= 0 {
+			t.Errorf("encoding of %v does not sort before %v", keys[i-1], keys[i])
+		}
+
+		assert.Equal(t, keys[i], decodeKey(encodeKey(keys[i])))
+	}
+}
+
+func TestCursorRange(t *testing.T) {
+	tree := NewBTree(3)
+
+	for k := 0; k < 100; k++ {
+		_ = tree.Upsert(k*2, k)
+	}
+
+	assert.Equal(t, []int{10, 12, 14, 16, 18}, tree.Range(9, 20))
+	assert.Nil(t, tree.Range(300, 400))
+	assert.Len(t, tree.Range(math.MinInt, math.MaxInt), 100)
+
+	c := tree.Seek(197)
+	assert.True(t, c.Valid())
+	assert.Equal(t, 198, c.Key())
+
+	c.Next()
+	assert.False(t, c.Valid())
+}
+
+// Range and ScanPrefix hold the read lock for the whole walk, see: go test -race -run TestRangeAlongsideWriters
+func TestRangeAlongsideWriters(t *testing.T) {
+	tree := NewBTree(3)
+	for k := 0; k < 200; k += 2 {
+		_ = tree.Upsert(k, k)
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// the odd keys come and go, splitting and merging the leaves under the walks
+		for round := 0; ; round++ {
+			for k := 1; k < 200; k += 2 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				if round%2 == 0 {
+					assert.NoError(t, tree.Upsert(k, k))
+				} else {
+					assert.NoError(t, tree.Delete(k))
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < 500; i++ {
+		keys := tree.Range(0, 200)
+		assert.True(t, slices.IsSorted(keys))
+		assert.GreaterOrEqual(t, len(keys), 100)
+
+		assert.GreaterOrEqual(t, len(tree.ScanPrefix(encodeKey(0)[:7])), 100)
+	}
+
+	close(stop)
+	<-done
+}
+
+func TestScanPrefix(t *testing.T) {
+	tree := NewBTree(4)
+	tenant := func(id, suffix int) int { return id<<32 | suffix }
+
+	for id := 40; id < 45; id++ {
+		for suffix := 0; suffix < 20; suffix++ {
+			_ = tree.Upsert(tenant(id, suffix), suffix)
+		}
+	}
+
+	prefix := encodeKey(tenant(42, 0))[:4]
+	keys := tree.ScanPrefix(prefix)
+
+	assert.Len(t, keys, 20)
+	assert.Equal(t, tenant(42, 0), keys[0])
+	assert.Equal(t, tenant(42, 19), keys[19])
+
+	assert.Len(t, tree.ScanPrefix(nil), 100)
+	assert.Nil(t, tree.ScanPrefix(encodeKey(tenant(50, 0))[:4]))
+	assert.Nil(t, tree.ScanPrefix(make([]byte, 9)))
+
+	// the cursor stops at the first key past the prefix
+	c := tree.SeekPrefix(prefix)
+	for i := 0; i < 20; i++ {
+		assert.True(t, c.Valid())
+		c.Next()
+	}
+	assert.False(t, c.Valid())
+}
+
+func TestScanPrefixAllOnes(t *testing.T) {
+	tree := NewBTree(3)
+	keys := []int{math.MaxInt - 2, math.MaxInt - 1, math.MaxInt, 0, -1}
+
+	for _, k := range keys {
+		_ = tree.Upsert(k, k)
+	}
+
+	// 0x7f 0xff .. is the top of the keyspace once the sign bit is flipped
+	all := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	assert.Equal(t, []int{math.MaxInt - 2, math.MaxInt - 1, math.MaxInt}, tree.ScanPrefix(all))
+	assert.Equal(t, []int{math.MaxInt}, tree.ScanPrefix(append(all, 0xff)))
+	assert.Equal(t, []int{math.MaxInt - 1}, tree.ScanPrefix(append(all, 0xfe)))
+
+	_, end, bounded, _ := prefixBounds([]byte{0x80, 0xff})
+	assert.True(t, bounded)
+	assert.Equal(t, decodeKey([]byte{0x81, 0, 0, 0, 0, 0, 0, 0}), end)
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
 	"os"
+	"slices"
+	"sync"
 	"syscall"
+	"time"
 )
 
 // The storage engine high level api
@@ -22,52 +26,529 @@ type Store interface {
 // "real" persistent B+ trees would use the open/read/write/seek syscalls more sophisticatedly.
 // see also alernatively: https://www.sqlite.org/mmap.html
 type DB struct {
-	datafile     *os.File
+	datafile File
+	// held exclusively by the one writer, nil for a read only open, see: lockPath
+	lockfile     File
 	store        Store
 	storeManager StoreManager
+
+	// the index, it lives in memory and is checkpointed into pages
+	tree *BTree
+
+	// pages set aside by QUARANTINE_CORRUPTION, guarded by mu
+	quarantined []uint32
+
+	opts Options
+	// of the datafile, Options.PageSize may leave it to the header
+	pageSize int
+	// offset of page 1, see: fileHeader.PageStart
+	pageStart int64
+	// nil unless Options.MmapSize is set
+	mmap *mmapReader
+	// guards the header and the freelist of the store manager, checkpoints, compaction
+	// steps and Check take it before the tree's lock. a compaction step holds it while
+	// it lets readers and writers back into the tree, no checkpoint gets in between
+	storeMu sync.Mutex
+
+	// stops the background fsync of SYNC_INTERVAL
+	stop   chan struct{}
+	syncer sync.WaitGroup
+
+	// guards closed, poisoned and quarantined
+	mu     sync.RWMutex
+	closed bool
+	// the failure that turned the db read only, see: poison
+	poisoned error
 }
 
+var errDBClosed = fmt.Errorf("db %w", ErrClosed)
+
+type CorruptionPolicy uint8
+
+const (
+	// surface ErrCorruptPage to the caller, the default
+	FAIL_ON_CORRUPTION CorruptionPolicy = iota
+	// set the page aside and serve it as an empty page
+	QUARANTINE_CORRUPTION
+)
+
+// InitDB creates an empty datafile at dbname, truncating whatever was there.
+// the truncate waits for the lock so it can't pull a file from under another process.
 func InitDB(store Store, dbname string) (*DB, error) {
-	// init the datafile
-	init, err := os.Create(dbname)
+	db, err := open(dbname, Options{CreateIfMissing: true}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	db.store = store
+	return db, nil
+}
+
+// OpenDB opens the datafile at dbname creating it if it doesn't exist, an existing
+// file is never truncated and it's tree is loaded from the last checkpoint.
+// maxDegree only applies to new files, existing files keep the degree they were created with.
+func OpenDB(dbname string, maxDegree int) (*DB, error) {
+	return openDB(dbname, maxDegree, nil)
+}
+
+// openDB is OpenDB for a datafile that may be encrypted
+func openDB(dbname string, maxDegree int, keys KeyProvider) (*DB, error) {
+	opts := DefaultOptions()
+	opts.MaxDegree, opts.Keys = maxDegree, keys
+
+	if info, err := os.Stat(dbname); err == nil && info.Size() > 0 {
+		opts.MaxDegree = 0
+	}
+
+	return Open(dbname, opts)
+}
+
+// Open opens the datafile at path as configured by opts, nil means DefaultOptions
+func Open(path string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+
+	return open(path, *opts, false)
+}
+
+func open(path string, opts Options, truncate bool) (*DB, error) {
+	o := opts.withDefaults()
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	flag := os.O_RDWR
+	switch {
+	case o.ReadOnly:
+		flag = os.O_RDONLY
+	case o.CreateIfMissing && o.ErrorIfExists:
+		flag |= os.O_CREATE | os.O_EXCL
+	case o.CreateIfMissing:
+		flag |= os.O_CREATE
+	}
+
+	if o.DirectIO {
+		flag |= O_DIRECT
+	} else if o.SyncMode == SYNC_ALWAYS && !o.ReadOnly {
+		flag |= syscall.O_DSYNC
+	}
+
+	datafile, err := o.FS.OpenFile(path, flag, o.FileMode)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrExist) {
+		return nil, err
+	} else if err != nil {
+		return nil, ioError(err, "opening %v", path)
+	}
+
+	if o.DirectIO {
+		direct, err := newDirectFile(datafile)
+		if err != nil {
+			datafile.Close()
+			return nil, ioError(err, "reading the size of %v", path)
+		}
+
+		datafile = direct
+	}
+
+	// one writer at a time, it's lock is held on a file of it's own so readers still get in
+	var lockfile File
+	if !o.ReadOnly {
+		if lockfile, err = o.FS.OpenFile(lockPath(path), os.O_CREATE|os.O_RDWR, o.FileMode); err != nil {
+			datafile.Close()
+			return nil, ioError(err, "opening %v", lockPath(path))
+		}
+
+		if err = lockFile(lockfile, true, o.LockTimeout); err != nil {
+			lockfile.Close()
+			datafile.Close()
+			return nil, fmt.Errorf("locking %v: %w", path, err)
+		}
+	}
 
+	release := func() {
+		datafile.Close()
+		if lockfile != nil {
+			lockfile.Close()
+		}
+	}
+
+	// readers and the writer share the datafile, only a truncate takes it for itself
+	if err = lockFile(datafile, truncate, o.LockTimeout); err != nil {
+		release()
+		return nil, fmt.Errorf("locking %v: %w", path, err)
+	}
+
+	if truncate {
+		if err = datafile.Truncate(0); err != nil {
+			release()
+			return nil, ioError(err, "truncating %v", path)
+		}
+
+		if err = datafile.Lock(false); err != nil {
+			release()
+			return nil, fmt.Errorf("locking %v: %w", path, err)
+		}
+	}
+
+	size, err := datafile.Size()
 	if err != nil {
-		log.Fatal(err)
+		release()
+		return nil, ioError(err, "reading the size of %v", path)
 	}
 
-	defer init.Close()
+	db := &DB{datafile: datafile, lockfile: lockfile, opts: o}
+	db.storeManager = StoreManager{datafile: db.datafile, writers: o.CheckpointWriters, lazyHeader: o.SyncMode != SYNC_ALWAYS}
+	if o.BufferPoolSize > 0 {
+		db.storeManager.pool = newBufferPool(o.BufferPoolSize)
+	}
+
+	if o.MmapSize > 0 {
+		if db.mmap, err = newMmapReader(datafile, o.MmapSize); err != nil {
+			release()
+			return nil, err
+		}
+	}
+
+	switch {
+	case size == 0 && o.ReadOnly:
+		err = fmt.Errorf("%v is empty, there's nothing to open read only", path)
+	case size == 0:
+		// a new file, or one that crashed before it's header was written
+		degree := o.MaxDegree
+		if degree == 0 {
+			degree = DEFAULT_DEGREE
+		}
+
+		pageSize := o.PageSize
+		if pageSize == 0 {
+			pageSize = PAGE_SIZE
+		}
+
+		if db.storeManager.cipher, err = cipherOf(o.Keys, 0); err == nil {
+			err = validDegree(degree, pageSize, db.storeManager.cipher.reserve())
+		}
+
+		if err == nil {
+			err = db.storeManager.InitHeader(degree, pageSize, o.codec(), o.comparator())
+		}
+
+		db.tree = NewBTree(degree)
+		db.tree.order = COMPARATORS[o.comparator()]
+		db.pageSize, db.pageStart = pageSize, db.storeManager.header.pageStart()
+	default:
+		err = db.mmap.guard(db.load)
+
+		// a writer sharing the file reuses the pages of a checkpoint once it's two behind
+		// and a compaction of it's cuts the end of the file off, a load that saw the
+		// header move may have read some of them so it starts over
+		for retry := 0; o.ReadOnly && retry < READ_ONLY_RELOADS && headerMoved(datafile, db.storeManager.header); retry++ {
+			db.quarantined = nil
+			if o.BufferPoolSize > 0 {
+				db.storeManager.pool = newBufferPool(o.BufferPoolSize)
+			}
+
+			err = db.mmap.guard(db.load)
+		}
+
+		if err == nil {
+			err = validDegree(db.tree.maxDegree, db.pageSize, db.storeManager.cipher.reserve())
+		}
+	}
 
-	file, err := syscall.Open(dbname, syscall.O_CREAT|syscall.O_RDWR|syscall.O_DSYNC|syscall.O_TRUNC, 0)
 	if err != nil {
-		log.Fatal(err)
+		db.mmap.close()
+		release()
+		return nil, err
 	}
 
-	datafile := os.NewFile(uintptr(file), "db")
-	manager := StoreManager{datafile: datafile}
+	db.tree.db = db
 
-	if dbname != "test_db" {
-		manager.InitHeader()
+	if o.SyncMode == SYNC_INTERVAL && !o.ReadOnly {
+		db.stop = make(chan struct{})
+		db.syncer.Add(1)
+		go db.syncEvery(datafile, o.SyncInterval)
 	}
 
-	return &DB{datafile: datafile, store: store, storeManager: manager}, nil
+	return db, nil
+}
+
+// syncEvery is the background fsync of SYNC_INTERVAL, a failure poisons the db
+// like a failed checkpoint would
+func (db *DB) syncEvery(datafile File, interval time.Duration) {
+	defer db.syncer.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			if err := datafile.Sync(); err != nil {
+				db.poison(ioError(err, "background fsync"))
+				return
+			}
+		}
+	}
 }
 
 /*** Access Methods ***/
 
-func (db *DB) Insert(key int, value []byte) error {
-	return db.store.Insert(key, value)
+// without a store the access methods go straight to the db's own tree,
+// writes are durable once the next checkpoint completes
+
+func (db *DB) Insert(key int, value []byte) (err error) {
+	if err = db.writable(); err != nil {
+		return err
+	}
+
+	defer db.recoverInvariant(&err)
+
+	if db.store != nil {
+		return db.store.Insert(key, value)
+	}
+
+	return db.tree.Put(key, value)
 }
 
-func (db *DB) Get(key int) ([]byte, error) {
+func (db *DB) Get(key int) (_ []byte, err error) {
+	if err = db.readable(); err != nil {
+		return nil, err
+	}
+
+	defer db.recoverInvariant(&err)
 	s := db.store
 
 	if s != nil {
 		return db.store.Get(key)
 	}
 
+	if db.tree != nil {
+		return db.tree.Lookup(key)
+	}
+
 	return nil, nil
 }
 
-func (db *DB) Close() {
-	db.datafile.Close()
+func (db *DB) Delete(key int) (err error) {
+	if err = db.writable(); err != nil {
+		return err
+	}
+
+	defer db.recoverInvariant(&err)
+
+	if db.store != nil {
+		return db.store.Delete(key)
+	}
+
+	return db.tree.Delete(key)
+}
+
+// FetchPage reads a page from the datafile verifying it's checksum, a corrupt
+// page is handled according to the db's CorruptionPolicy. with MmapSize set the
+// page is a read only view of the mapping, it changes with the file once a later
+// checkpoint or compaction reuses it's id and can't be read after Close, copy
+// what has to outlive that
+func (db *DB) FetchPage(pageId int) (Page, error) {
+	pool := db.storeManager.pool
+	if page, ok := pool.get(uint32(pageId)); ok {
+		return page, nil
+	}
+
+	page, err := db.fetchPage(pageId)
+	if err == nil {
+		pool.put(page)
+	}
+
+	var corrupt *ErrCorruptPage
+	if errors.As(err, &corrupt) && db.opts.OnCorruption == QUARANTINE_CORRUPTION {
+		db.opts.Logger.Printf("quarantining page: %v", err)
+
+		db.mu.Lock()
+		if !slices.Contains(db.quarantined, corrupt.PageID) {
+			db.quarantined = append(db.quarantined, corrupt.PageID)
+		}
+		db.mu.Unlock()
+
+		empty := Page{}
+		empty.PageID = corrupt.PageID
+		return empty, empty.allocate(db.pageSize)
+	}
+
+	return page, err
+}
+
+// fetchPage reads through the mapping when there is one
+func (db *DB) fetchPage(pageId int) (Page, error) {
+	offset, err := pageOffset(uint32(pageId), db.pageSize, db.pageStart)
+	if err != nil {
+		return Page{}, err
+	}
+
+	buf, ok := db.mmap.page(offset, db.pageSize)
+	if !ok {
+		return openPage(pageId, db.pageSize, db.pageStart, db.storeManager.cipher, db.datafile)
+	}
+
+	var page Page
+	err = db.mmap.guard(func() (err error) {
+		if page, err = decodePage(buf); err != nil {
+			return err
+		}
+		page.start = db.pageStart
+
+		if err = verifyPage(page, pageId); err != nil {
+			return err
+		}
+
+		// an encrypted or compressed page is decoded into a buffer of it's own
+		return page.unseal(db.storeManager.cipher)
+	})
+
+	// the end of the file is gone, the syscall says so
+	if errors.Is(err, errMapFault) {
+		return openPage(pageId, db.pageSize, db.pageStart, db.storeManager.cipher, db.datafile)
+	}
+
+	if err != nil {
+		return Page{}, err
+	}
+
+	return page, nil
+}
+
+// maxValueSize is the largest value a full leaf of the datafile's degree takes
+func (db *DB) maxValueSize() int {
+	return overflowThreshold(db.pageSize, db.storeManager.cipher.reserve(), db.tree.maxDegree)
+}
+
+// Quarantined lists the pages set aside after failing their checksum
+func (db *DB) Quarantined() []uint32 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return slices.Clone(db.quarantined)
+}
+
+// Close checkpoints the writes the last checkpoint missed and releases the
+// datafile, every later call fails with ErrClosed. a failed checkpoint still
+// closes the db, the error says the writes since the last one are lost
+func (db *DB) Close() error {
+	var unwritten error
+	if db.writable() == nil && db.tree.unwritten() {
+		unwritten = db.Checkpoint()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return errDBClosed
+	}
+
+	db.closed = true
+	// the next writer only gets in once nothing more is written
+	if db.lockfile != nil {
+		defer db.lockfile.Close()
+	}
+
+	if db.stop != nil {
+		close(db.stop)
+		db.syncer.Wait()
+	}
+
+	// the last interval of SYNC_INTERVAL goes out on close
+	if db.opts.SyncMode == SYNC_INTERVAL && !db.opts.ReadOnly && db.poisoned == nil {
+		if err := db.datafile.Sync(); err != nil {
+			db.datafile.Close()
+			return ioError(err, "fsync on close")
+		}
+	}
+
+	if err := db.mmap.close(); err != nil {
+		db.datafile.Close()
+		return err
+	}
+
+	if err := db.datafile.Close(); err != nil {
+		return ioError(err, "closing the datafile")
+	}
+
+	if unwritten != nil {
+		return fmt.Errorf("writes since the last checkpoint are lost, checkpoint on close: %w", unwritten)
+	}
+
+	return nil
+}
+
+/*** Failure handling ***/
+
+// poison turns the db read only after a checkpoint fails to write or fsync.
+// once an fsync fails the kernel may have dropped the dirty pages, a retry
+// can then succeed without them ever reaching the disk. nothing written from
+// here on could be trusted so reads are served from memory and writes refused,
+// reopening the datafile recovers the last checkpoint.
+// see: https://wiki.postgresql.org/wiki/Fsync_Errors
+func (db *DB) poison(err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.poisoned == nil {
+		db.poisoned = err
+	}
+}
+
+// Poisoned returns the failure that turned the db read only, or nil
+func (db *DB) Poisoned() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.poisoned
+}
+
+func (db *DB) readable() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return errDBClosed
+	}
+
+	return nil
+}
+
+func (db *DB) writable() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return errDBClosed
+	}
+
+	if db.opts.ReadOnly {
+		return fmt.Errorf("%w: opened read only", ErrReadOnly)
+	}
+
+	if db.poisoned != nil {
+		return fmt.Errorf("%w: %w", ErrReadOnly, db.poisoned)
+	}
+
+	return nil
+}
+
+// recoverInvariant turns an _assert panic into an ErrCorrupt and poisons the db,
+// the tree in memory broke an invariant so it must not be checkpointed.
+// any other panic is not ours to handle.
+func (db *DB) recoverInvariant(err *error) {
+	if p := recover(); p != nil {
+		invariant, ok := p.(*invariantError)
+		if !ok {
+			panic(p)
+		}
+
+		*err = invariant
+		db.poison(invariant)
+	}
 }
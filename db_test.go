@@ -1,13 +1,244 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 var key = 1
 var value = []byte(fmt.Sprint("msg_", key))
 var testValueSize = cap(value)
 
+func TestCorruptionPolicy(t *testing.T) {
+	db, err := InitDB(nil, filepath.Join(t.TempDir(), "db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	page, _ := db.storeManager.NewPage()
+	assert.NoError(t, page.writeCells([]int{7, 8, 9}, nil, nil))
+	assert.NoError(t, page.Flush(db.datafile))
+
+	offset, _ := page.MapToOffset()
+	_, _ = db.datafile.WriteAt([]byte{0xff}, offset+PAGE_SIZE-1)
+
+	_, err = db.FetchPage(1)
+	var corrupt *ErrCorruptPage
+	assert.True(t, errors.As(err, &corrupt))
+	assert.Empty(t, db.Quarantined())
+
+	db.opts.OnCorruption = QUARANTINE_CORRUPTION
+	quarantined, err := db.FetchPage(1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0), quarantined.NumSlots)
+	assert.Equal(t, []uint32{1}, db.Quarantined())
+}
+
+// the policy applies to the pages Open loads the tree from
+func TestOpenQuarantinesCorruptLeaf(t *testing.T) {
+	path := checkpointedDB(t, 500)
+
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	leaf := db.tree.root
+	for !leaf.isLeaf() {
+		leaf = leaf.children[1]
+	}
+	id, lost := leaf.pageId, len(leaf.data)
+	offset, _ := pageOffset(uint32(id), PAGE_SIZE, db.pageStart)
+	db.Close()
+
+	datafile, _ := OSFS.OpenFile(path, os.O_RDWR, 0)
+	_, _ = datafile.WriteAt([]byte{0xff}, offset+PAGE_SIZE-1)
+	datafile.Close()
+
+	_, err = Open(path, nil)
+	var corrupt *ErrCorruptPage
+	assert.True(t, errors.As(err, &corrupt))
+
+	db, err = Open(path, &Options{OnCorruption: QUARANTINE_CORRUPTION})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, []uint32{uint32(id)}, db.Quarantined())
+	assert.Equal(t, 500-lost, db.tree.Len())
+
+	_, err = db.Get(0)
+	assert.NoError(t, err)
+
+	// the next checkpoint writes the empty leaf in place of the corrupt one
+	assert.NoError(t, db.Insert(1000, value))
+	assert.NoError(t, db.Checkpoint())
+
+	report, err := db.Check()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, 501-lost, report.Keys)
+}
+
+func TestDBErrors(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "db"), 4)
+	assert.NoError(t, err)
+
+	_, err = db.Get(1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, db.Delete(1), ErrNotFound)
+
+	tx := db.Begin()
+	assert.NoError(t, db.Insert(1, value))
+	assert.ErrorIs(t, tx.Commit(), ErrTxConflict)
+	assert.ErrorIs(t, tx.Commit(), ErrClosed)
+
+	_, err = OpenDB(filepath.Join(t.TempDir(), "db"), 2)
+	assert.Error(t, err)
+
+	assert.NoError(t, db.Close())
+	assert.ErrorIs(t, db.Close(), ErrClosed)
+	assert.ErrorIs(t, db.Insert(2, value), ErrClosed)
+	assert.ErrorIs(t, db.Checkpoint(), ErrClosed)
+
+	_, err = db.Get(1)
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+// writes only reach the tree in memory, close checkpoints whatever the last checkpoint missed
+func TestCloseCheckpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+
+	for k := 0; k < 100; k++ {
+		assert.NoError(t, db.Insert(k, value))
+	}
+	assert.NoError(t, db.Delete(0))
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 99, db.tree.Len())
+
+	got, err := db.Get(99)
+	assert.NoError(t, err)
+	assert.Equal(t, value, got)
+
+	// a checkpoint that fails on close says the writes are lost
+	assert.NoError(t, db.Insert(100, value))
+	db.datafile = failingSync{db.datafile}
+	db.storeManager.datafile = db.datafile
+
+	err = db.Close()
+	assert.ErrorIs(t, err, ErrIO)
+	assert.ErrorContains(t, err, "lost")
+	assert.ErrorIs(t, db.Close(), ErrClosed)
+
+	db, err = Open(path, &Options{ReadOnly: true})
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, 99, db.tree.Len())
+}
+
+// failingSync is a datafile whose fsync always fails
+type failingSync struct {
+	File
+}
+
+func (f failingSync) Sync() error {
+	return syscall.EIO
+}
+
+func TestDBPoisonedAfterFsyncFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := OpenDB(path, 4)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Insert(1, value))
+	assert.NoError(t, db.Checkpoint())
+
+	db.datafile = failingSync{db.datafile}
+	db.storeManager.datafile = db.datafile
+
+	assert.NoError(t, db.Insert(2, value))
+	err = db.Checkpoint()
+	assert.ErrorIs(t, err, ErrIO)
+	assert.ErrorIs(t, err, syscall.EIO)
+
+	var ioErr *IOError
+	assert.True(t, errors.As(err, &ioErr))
+	assert.Equal(t, err, db.Poisoned())
+
+	// writes are refused from now on, reads are still served
+	assert.ErrorIs(t, db.Insert(3, value), ErrReadOnly)
+	assert.ErrorIs(t, db.Delete(1), ErrReadOnly)
+	assert.ErrorIs(t, db.Checkpoint(), ErrReadOnly)
+
+	tx := db.Begin()
+	assert.NoError(t, tx.Put(4, value))
+	assert.ErrorIs(t, tx.Commit(), ErrReadOnly)
+
+	got, err := db.Get(1)
+	assert.NoError(t, err)
+	assert.Equal(t, value, got)
+	db.Close()
+
+	// reopening recovers the last checkpoint that made it
+	db, err = OpenDB(path, 4)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.Nil(t, db.Poisoned())
+	assert.Equal(t, 1, db.tree.Len())
+}
+
+func TestDBRecoversInvariantFailures(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "db"), 4)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	broken := func() (err error) {
+		defer db.recoverInvariant(&err)
+		_assert(false, "broken on purpose")
+
+		return nil
+	}
+
+	assert.ErrorIs(t, broken(), ErrCorrupt)
+	assert.ErrorIs(t, db.Insert(1, value), ErrReadOnly)
+
+	// panics that aren't invariant failures are not swallowed
+	assert.Panics(t, func() {
+		defer db.recoverInvariant(&err)
+		panic("not ours")
+	})
+}
+
+func TestCorruptionErrors(t *testing.T) {
+	db, err := InitDB(nil, filepath.Join(t.TempDir(), "db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	page, _ := db.storeManager.NewPage()
+	assert.NoError(t, page.writeCells([]int{7, 8, 9}, nil, nil))
+	assert.NoError(t, page.Flush(db.datafile))
+
+	offset, _ := page.MapToOffset()
+	_, _ = db.datafile.WriteAt([]byte{0xff}, offset+PAGE_SIZE-1)
+
+	_, err = db.FetchPage(1)
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	// past the end of the file
+	_, err = db.FetchPage(2)
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.NotErrorIs(t, err, ErrIO)
+
+	assert.ErrorIs(t, page.writeCells([]int{1}, nil, []uint32{1}), ErrCorrupt)
+}
+
 /*
 func TestInsertRoot(t *testing.T) {
 	tree := NewBTree(2)
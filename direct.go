@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"sync"
+)
+
+// direct I/O reads and writes whole blocks from aligned buffers at aligned offsets
+const DIRECT_BLOCK_SIZE = PAGE_ALIGNMENT
+
+// writes to the same block are serialized by one of these many locks
+const DIRECT_STRIPES = 64
+
+// directFile is the datafile opened with O_DIRECT, reads and writes skip the
+// page cache so the buffer pool is the only copy of a page in memory.
+// pages of a new datafile start on a block (see: fileHeader.PageStart) so their
+// reads and writes are whole blocks. anything else, the header, a compressed page
+// or a file from before PageStart where pages follow the 100 byte header, is
+// widened to the blocks it touches and a write reads them first to keep the bytes
+// around it. two pages can share a block, the stripe locks keep their writes from
+// undoing each other.
+// a write past the end of the file pads it to a whole block, the padding is
+// trimmed before the next fdatasync so the file ends at it's last page.
+type directFile struct {
+	File
+	stripes [DIRECT_STRIPES]sync.Mutex
+
+	// guards size and padded
+	mu     sync.Mutex
+	size   int64 // the end of the last byte written
+	padded bool  // the file is longer than size
+}
+
+func newDirectFile(f File) (*directFile, error) {
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	return &directFile{File: f, size: size}, nil
+}
+
+// blocks returns the block aligned range holding [off, off+n)
+func blocks(off int64, n int) (start, end int64) {
+	start = off - off%DIRECT_BLOCK_SIZE
+	end = off + int64(n)
+
+	if rem := end % DIRECT_BLOCK_SIZE; rem != 0 {
+		end += DIRECT_BLOCK_SIZE - rem
+	}
+
+	return start, end
+}
+
+// readBlocks reads [start, end) into an aligned buffer, a short read is the end
+// of the file (direct reads don't stop short anywhere else) and it's zeroed
+func (f *directFile) readBlocks(start, end int64) ([]byte, int, error) {
+	buf := alignedBuffer(int(end - start))
+
+	n, err := f.File.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+
+	return buf, n, nil
+}
+
+func (f *directFile) ReadAt(p []byte, off int64) (int, error) {
+	start, end := blocks(off, len(p))
+
+	buf, n, err := f.readBlocks(start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	n = copy(p, buf[off-start:max(n, int(off-start))])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *directFile) WriteAt(p []byte, off int64) (int, error) {
+	start, end := blocks(off, len(p))
+
+	unlock := f.lock(start, end)
+	defer unlock()
+
+	buf := alignedBuffer(int(end - start))
+	if off != start || off+int64(len(p)) != end {
+		var err error
+		if buf, _, err = f.readBlocks(start, end); err != nil {
+			return 0, err
+		}
+	}
+
+	copy(buf[off-start:], p)
+
+	// the size moves first so a trim running alongside can't cut this write
+	f.mu.Lock()
+	f.size = max(f.size, off+int64(len(p)))
+	f.mu.Unlock()
+
+	if _, err := f.File.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	if end > f.size {
+		f.padded = true
+	}
+	f.mu.Unlock()
+
+	return len(p), nil
+}
+
+// lock takes the stripes of the blocks in [start, end) in order
+func (f *directFile) lock(start, end int64) (unlock func()) {
+	var stripes []int
+	for block := start / DIRECT_BLOCK_SIZE; block < end/DIRECT_BLOCK_SIZE && len(stripes) < DIRECT_STRIPES; block++ {
+		stripes = append(stripes, int(block%DIRECT_STRIPES))
+	}
+
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+
+	for _, i := range stripes {
+		f.stripes[i].Lock()
+	}
+
+	return func() {
+		for _, i := range stripes {
+			f.stripes[i].Unlock()
+		}
+	}
+}
+
+// trim cuts the padding of the last block
+func (f *directFile) trim() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.padded {
+		return nil
+	}
+
+	f.padded = false
+	return f.File.Truncate(f.size)
+}
+
+func (f *directFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.size, f.padded = size, false
+	return f.File.Truncate(size)
+}
+
+// Sync is fdatasync(2), it flushes the data and the file size but not the
+// timestamps, which the datafile doesn't need
+func (f *directFile) Sync() error {
+	if err := f.trim(); err != nil {
+		return err
+	}
+
+	if file, ok := f.File.(fdFile); ok {
+		return fdatasync(file.Fd())
+	}
+
+	return f.File.Sync()
+}
+
+func (f *directFile) Close() error {
+	if err := f.trim(); err != nil {
+		f.File.Close()
+		return err
+	}
+
+	return f.File.Close()
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+const DIRECT_IO_SUPPORTED = true
+
+// open(2) flag that bypasses the page cache
+const O_DIRECT = syscall.O_DIRECT
+
+func fdatasync(fd uintptr) error {
+	return syscall.Fdatasync(int(fd))
+}
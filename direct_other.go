@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+// O_DIRECT is linux only (darwin has F_NOCACHE), Options.DirectIO is rejected elsewhere
+const DIRECT_IO_SUPPORTED = false
+
+const O_DIRECT = 0
+
+func fdatasync(fd uintptr) error {
+	return errDirectIOUnsupported
+}
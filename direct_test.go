@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectBlocks(t *testing.T) {
+	cases := []struct {
+		off        int64
+		n          int
+		start, end int64
+	}{
+		{0, FILE_HEADER_SIZE, 0, DIRECT_BLOCK_SIZE},
+		{0, DIRECT_BLOCK_SIZE, 0, DIRECT_BLOCK_SIZE},
+		{FILE_HEADER_SIZE, PAGE_SIZE, 0, 2 * DIRECT_BLOCK_SIZE},
+		{FILE_HEADER_SIZE + 2*PAGE_SIZE, PAGE_SIZE, 2 * DIRECT_BLOCK_SIZE, 4 * DIRECT_BLOCK_SIZE},
+		{DIRECT_BLOCK_SIZE - 1, 1, 0, DIRECT_BLOCK_SIZE},
+	}
+
+	for _, c := range cases {
+		start, end := blocks(c.off, c.n)
+		assert.Equal(t, c.start, start, "%+v", c)
+		assert.Equal(t, c.end, end, "%+v", c)
+	}
+}
+
+// a directFile reads back exactly what a plain file does for any mix of
+// unaligned writes, and ends where the last write did once synced
+func TestDirectFileMatchesPlainFile(t *testing.T) {
+	fs := NewMemFS(1, Faults{})
+	plain, _ := fs.OpenFile("plain", os.O_CREATE|os.O_RDWR, 0644)
+	backing, _ := fs.OpenFile("direct", os.O_CREATE|os.O_RDWR, 0644)
+
+	direct, err := newDirectFile(backing)
+	assert.NoError(t, err)
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		off := int64(r.Intn(6 * DIRECT_BLOCK_SIZE))
+		p := make([]byte, 1+r.Intn(2*DIRECT_BLOCK_SIZE))
+		r.Read(p)
+
+		_, _ = plain.WriteAt(p, off)
+		n, err := direct.WriteAt(p, off)
+		assert.NoError(t, err)
+		assert.Equal(t, len(p), n)
+	}
+
+	assert.NoError(t, direct.Sync())
+
+	want, _ := plain.Size()
+	got, _ := direct.Size()
+	assert.Equal(t, want, got)
+
+	expected, actual := make([]byte, want), make([]byte, want)
+	_, _ = plain.ReadAt(expected, 0)
+	_, err = direct.ReadAt(actual, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	// reads past the end stop there
+	n, err := direct.ReadAt(make([]byte, 10), want-4)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+// pages next to each other share a block, writing them at once must keep both
+func TestDirectFileConcurrentPages(t *testing.T) {
+	// the writes only overlap on more than one thread
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	backing, err := OSFS.OpenFile(filepath.Join(t.TempDir(), "db"), os.O_CREATE|os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	defer backing.Close()
+
+	direct, _ := newDirectFile(backing)
+
+	const PAGES = 32
+
+	for round := 0; round < 20; round++ {
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+
+		for id := 1; id <= PAGES; id++ {
+			wg.Add(1)
+
+			go func(id int) {
+				defer wg.Done()
+				<-start
+
+				page := Page{}
+				page.PageID = uint32(id)
+				_ = page.Allocate()
+				_ = page.writeCells([]int{id}, [][]byte{{byte(round)}}, nil)
+				assert.NoError(t, page.write(direct))
+			}(id)
+		}
+		close(start)
+		wg.Wait()
+
+		for id := 1; id <= PAGES; id++ {
+			page, err := FetchPage(id, PAGE_SIZE, direct)
+			if assert.NoError(t, err) {
+				assert.Equal(t, []byte{byte(round)}, page.Value(0), "page %v", id)
+			}
+		}
+	}
+
+	assert.NoError(t, direct.Sync())
+	size, _ := direct.Size()
+	assert.Equal(t, int64(FILE_HEADER_SIZE+PAGES*PAGE_SIZE), size)
+}
+
+func TestOpenDirectIO(t *testing.T) {
+	if !DIRECT_IO_SUPPORTED {
+		_, err := Open(filepath.Join(t.TempDir(), "db"), &Options{CreateIfMissing: true, DirectIO: true})
+		assert.ErrorIs(t, err, errDirectIOUnsupported)
+		t.Skip("direct I/O is linux only")
+	}
+
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, &Options{MaxDegree: 8, CreateIfMissing: true, DirectIO: true})
+	if errors.Is(err, syscall.EINVAL) {
+		t.Skip("the filesystem of the temp dir doesn't support O_DIRECT")
+	}
+	assert.NoError(t, err)
+
+	for round := 0; round < 3; round++ {
+		for k := 0; k < 1000; k++ {
+			assert.NoError(t, db.Insert(k, []byte(fmt.Sprint(round, k))))
+		}
+		assert.NoError(t, db.Checkpoint())
+	}
+	assert.NoError(t, db.Close())
+
+	report, err := CheckFile(path, false, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Empty(t, report.Warnings)
+
+	// the file is the same whichever way it's opened
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	for k := 0; k < 1000; k++ {
+		value, err := db.Get(k)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(2, k), string(value))
+	}
+
+	_, err = Open(path, &Options{DirectIO: true, MmapSize: 1 << 20})
+	assert.ErrorContains(t, err, "MmapSize")
+}
+
+// countingReads is a datafile that counts the reads made of it
+type countingReads struct {
+	File
+	reads atomic.Int64
+}
+
+func (f *countingReads) ReadAt(p []byte, off int64) (int, error) {
+	f.reads.Add(1)
+	return f.File.ReadAt(p, off)
+}
+
+// pages of a new datafile start on a block so writing one reads nothing, the
+// layout from before fileHeader.PageStart reads the two blocks each page straddles
+func TestDirectPageStart(t *testing.T) {
+	for _, start := range []int64{PAGE_ALIGNMENT, FILE_HEADER_SIZE} {
+		backing, _ := NewMemFS(1, Faults{}).OpenFile("db", os.O_CREATE|os.O_RDWR, 0644)
+		counted := &countingReads{File: backing}
+		direct, _ := newDirectFile(counted)
+
+		for id := 1; id <= 8; id++ {
+			page := Page{start: start}
+			page.PageID = uint32(id)
+			_ = page.Allocate()
+			_ = page.writeCells([]int{id}, [][]byte{{byte(id)}}, nil)
+			assert.NoError(t, page.write(direct))
+		}
+
+		if start == PAGE_ALIGNMENT {
+			assert.Zero(t, counted.reads.Load())
+		} else {
+			assert.Equal(t, int64(8), counted.reads.Load())
+		}
+
+		for id := 1; id <= 8; id++ {
+			page, err := openPage(id, PAGE_SIZE, start, nil, direct)
+			if assert.NoError(t, err) {
+				assert.Equal(t, []byte{byte(id)}, page.Value(0))
+			}
+		}
+	}
+}
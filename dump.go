@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type headerDump struct {
+	Magic      string `json:"magic"`
+	Version    uint16 `json:"version"`
+	PageSize   uint32 `json:"page_size"`
+	MaxDegree  uint32 `json:"max_degree"`
+	RootPage   uint32 `json:"root_page"`
+	PageCount  uint32 `json:"page_count"`
+	FreeList   uint32 `json:"freelist"`
+	KeyCount   uint64 `json:"key_count"`
+	Generation uint64 `json:"generation"`
+	Checksum   uint32 `json:"checksum"`
+	Comparator string `json:"comparator"`
+	Codec      string `json:"codec"`
+	Encrypted  bool   `json:"encrypted"`
+	// of the key the pages are encrypted with
+	KeyGeneration uint32 `json:"key_generation"`
+	// offset of page 1
+	PageStart int64 `json:"page_start"`
+}
+
+type pageDump struct {
+	PageID           uint32     `json:"page_id"`
+	Checksum         uint32     `json:"checksum"`
+	Corrupt          string     `json:"corrupt,omitempty"`
+	FreeSlots        uint16     `json:"free_slots"`
+	PLower           uint16     `json:"plower"`
+	PHigh            int        `json:"phigh"`
+	NumSlots         uint16     `json:"num_slots"`
+	PageType         string     `json:"page_type"`
+	CellLayout       byte       `json:"cell_layout"`
+	Codec            string     `json:"codec"`
+	StoredSize       int        `json:"stored_size"`
+	Encrypted        bool       `json:"encrypted"`
+	Prefix           string     `json:"prefix"`
+	CompressionRatio float64    `json:"compression_ratio"`
+	RightChild       uint32     `json:"right_child,omitempty"`
+	Slots            []int      `json:"slots"`
+	Cells            []cellDump `json:"cells,omitempty"`
+	Malformed        string     `json:"malformed,omitempty"`
+}
+
+type cellDump struct {
+	Slot   int    `json:"slot"`
+	Offset int    `json:"offset"`
+	Key    int    `json:"key"`
+	Suffix string `json:"suffix"`
+	Value  string `json:"value,omitempty"`
+	Child  uint32 `json:"child,omitempty"`
+}
+
+type treeNodeDump struct {
+	PageID uint32 `json:"page_id"`
+	Keys   []int  `json:"keys"`
+	Leaf   bool   `json:"leaf"`
+}
+
+func dumpHeader(h fileHeader) headerDump {
+	return headerDump{
+		Magic: string(h.Magic[:]), Version: h.Version, PageSize: h.PageSize, MaxDegree: h.MaxDegree,
+		RootPage: h.RootPage, PageCount: h.PageCount, FreeList: h.FreeList, KeyCount: h.KeyCount,
+		Generation: h.Generation, Checksum: h.Checksum, Comparator: h.comparator(), Codec: h.Codec.String(),
+		Encrypted: h.KeyCheck != [8]byte{}, KeyGeneration: h.KeyGeneration, PageStart: h.pageStart(),
+	}
+}
+
+// dumpPage decodes a page as is, a page failing it's checksum is still
+// decoded as far as it's layout allows. an encrypted page is only decoded
+// with it's cipher
+func dumpPage(pageId int, h fileHeader, c *pageCipher, datafile File) (pageDump, error) {
+	page, err := readPage(pageId, int(h.PageSize), h.pageStart(), datafile)
+	if err != nil {
+		return pageDump{}, err
+	}
+
+	d := pageDump{
+		PageID: page.PageID, Checksum: page.Checksum, FreeSlots: page.FreeSlots,
+		PLower: page.PLower, PHigh: page.high(), NumSlots: page.NumSlots,
+		PageType: page.PageType.String(), CellLayout: page.CellLayout,
+		Codec: page.Codec.String(), StoredSize: page.storedSize(), Encrypted: page.Reserve != 0,
+		CompressionRatio: page.CompressionRatio(), RightChild: page.RightChild,
+	}
+
+	if _, err := openPage(pageId, int(h.PageSize), h.pageStart(), c, datafile); err != nil {
+		d.Corrupt = err.Error()
+	}
+
+	if err := page.unseal(c); err != nil {
+		d.Malformed = err.Error()
+		return d, nil
+	}
+
+	if problem := verifyLayout(&page); problem != "" {
+		d.Malformed = problem
+		return d, nil
+	}
+
+	d.Prefix = hex.EncodeToString(page.prefix())
+
+	for i := 0; i < int(page.NumSlots); i++ {
+		d.Slots = append(d.Slots, page.cellOffset(i))
+
+		c := page.cell(i)
+		cd := cellDump{Slot: i, Offset: page.cellOffset(i), Key: page.Key(i), Suffix: hex.EncodeToString(c.keys)}
+
+		if page.CellLayout == KEY_CELL {
+			cd.Child = page.Child(i)
+		} else {
+			cd.Value = hex.EncodeToString(c.data)
+		}
+
+		d.Cells = append(d.Cells, cd)
+	}
+
+	return d, nil
+}
+
+// dumpTree reads the tree breadth first from the root page, one slice per level
+func dumpTree(h fileHeader, c *pageCipher, datafile File) ([][]treeNodeDump, error) {
+	var levels [][]treeNodeDump
+
+	level := []uint32{h.RootPage}
+	if h.RootPage == 0 {
+		return levels, nil
+	}
+
+	for len(level) > 0 {
+		var nodes []treeNodeDump
+		var next []uint32
+
+		for _, id := range level {
+			page, err := openPage(int(id), int(h.PageSize), h.pageStart(), c, datafile)
+			if err != nil {
+				return levels, err
+			}
+
+			leaf := page.CellLayout != KEY_CELL
+			nodes = append(nodes, treeNodeDump{PageID: id, Keys: page.Keys(), Leaf: leaf})
+
+			if !leaf {
+				for i := 0; i <= int(page.NumSlots); i++ {
+					next = append(next, page.Child(i))
+				}
+			}
+		}
+
+		levels, level = append(levels, nodes), next
+	}
+
+	return levels, nil
+}
+
+func printHeader(w io.Writer, h headerDump) {
+	fmt.Fprintf(w, "magic %q version %v page size %v degree %v comparator %v codec %v\n", h.Magic, h.Version, h.PageSize, h.MaxDegree, h.Comparator, h.Codec)
+	fmt.Fprintf(w, "root page %v, %v pages from byte %v, freelist at %v\n", h.RootPage, h.PageCount, h.PageStart, h.FreeList)
+	fmt.Fprintf(w, "%v keys, generation %v, checksum %#08x\n", h.KeyCount, h.Generation, h.Checksum)
+
+	if h.Encrypted {
+		fmt.Fprintf(w, "encrypted at key generation %v\n", h.KeyGeneration)
+	}
+}
+
+func printPage(w io.Writer, d pageDump) {
+	fmt.Fprintf(w, "page %v: %v, cell layout %v, checksum %#08x\n", d.PageID, d.PageType, d.CellLayout, d.Checksum)
+	fmt.Fprintf(w, "  slots %v, PLower %v, PHigh %v, free %v bytes\n", d.NumSlots, d.PLower, d.PHigh, d.FreeSlots)
+	fmt.Fprintf(w, "  codec %v, %v bytes stored, encrypted %v\n", d.Codec, d.StoredSize, d.Encrypted)
+	fmt.Fprintf(w, "  prefix %q (%v bytes), compression ratio %.2f\n", d.Prefix, len(d.Prefix)/2, d.CompressionRatio)
+
+	if d.Corrupt != "" {
+		fmt.Fprintf(w, "  %v\n", d.Corrupt)
+	}
+
+	if d.Malformed != "" {
+		fmt.Fprintf(w, "  malformed: %v\n", d.Malformed)
+		return
+	}
+
+	fmt.Fprintf(w, "  slot array %v\n", d.Slots)
+
+	for _, c := range d.Cells {
+		if c.Child != 0 {
+			fmt.Fprintf(w, "  [%v] @%v key %v (suffix %v) -> page %v\n", c.Slot, c.Offset, c.Key, c.Suffix, c.Child)
+		} else {
+			fmt.Fprintf(w, "  [%v] @%v key %v (suffix %v) value %q\n", c.Slot, c.Offset, c.Key, c.Suffix, c.Value)
+		}
+	}
+
+	if d.RightChild != 0 {
+		fmt.Fprintf(w, "  right child -> page %v\n", d.RightChild)
+	}
+}
+
+func printTree(w io.Writer, levels [][]treeNodeDump) {
+	for depth, nodes := range levels {
+		parts := make([]string, len(nodes))
+
+		for i, n := range nodes {
+			if n.Leaf && len(n.Keys) > 0 {
+				parts[i] = fmt.Sprintf("#%v(%v keys %v..%v)", n.PageID, len(n.Keys), n.Keys[0], n.Keys[len(n.Keys)-1])
+			} else if n.Leaf {
+				parts[i] = fmt.Sprintf("#%v(empty)", n.PageID)
+			} else {
+				parts[i] = fmt.Sprintf("#%v%v", n.PageID, n.Keys)
+			}
+		}
+
+		fmt.Fprintf(w, "level %v: %v\n", depth, strings.Join(parts, " "))
+	}
+}
+
+// bubblegum dump [--json] [--page id] [--tree] [--key-file path] <datafile>
+func runDump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of text")
+	pageId := flags.Int("page", 0, "decode the header, slot array and cells of this page")
+	tree := flags.Bool("tree", false, "print the tree level by level")
+	keyFile := flags.String("key-file", "", "file holding the key of an encrypted datafile hex encoded, the header is readable without it")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: bubblegum dump [--json] [--page id] [--tree] [--key-file path] <datafile>")
+	}
+
+	keys, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	datafile, err := OSFS.OpenFile(flags.Arg(0), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer datafile.Close()
+
+	if err = datafile.Lock(false); err != nil {
+		return fmt.Errorf("locking %v: %w", flags.Arg(0), err)
+	}
+
+	h, err := ReadHeader(datafile)
+	if err != nil {
+		return err
+	}
+
+	var cipher *pageCipher
+	if keys != nil {
+		if cipher, err = headerCipher(h, keys); err != nil {
+			return err
+		}
+	}
+
+	out := struct {
+		Header headerDump       `json:"header"`
+		Page   *pageDump        `json:"page,omitempty"`
+		Tree   [][]treeNodeDump `json:"tree,omitempty"`
+	}{Header: dumpHeader(h)}
+
+	if *pageId != 0 {
+		if *pageId < 0 || uint32(*pageId) > h.PageCount {
+			return fmt.Errorf("page %v outside of the file, it has %v pages", *pageId, h.PageCount)
+		}
+
+		page, err := dumpPage(*pageId, h, cipher, datafile)
+		if err != nil {
+			return err
+		}
+
+		out.Page = &page
+	}
+
+	if *tree {
+		if out.Tree, err = dumpTree(h, cipher, datafile); err != nil {
+			return err
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(out)
+	}
+
+	printHeader(os.Stdout, out.Header)
+
+	if out.Page != nil {
+		printPage(os.Stdout, *out.Page)
+	}
+
+	if out.Tree != nil {
+		printTree(os.Stdout, out.Tree)
+	}
+
+	return nil
+}
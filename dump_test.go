@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpPageAndTree(t *testing.T) {
+	path := checkpointedDB(t, 100)
+
+	datafile, err := OSFS.OpenFile(path, os.O_RDONLY, 0)
+	assert.NoError(t, err)
+	defer datafile.Close()
+
+	h, _ := ReadHeader(datafile)
+	assert.Equal(t, "bubblegm", dumpHeader(h).Magic)
+
+	levels, err := dumpTree(h, nil, datafile)
+	assert.NoError(t, err)
+	assert.Len(t, levels[0], 1)
+	assert.Equal(t, h.RootPage, levels[0][0].PageID)
+
+	keys := 0
+	for _, n := range levels[len(levels)-1] {
+		assert.True(t, n.Leaf)
+		keys += len(n.Keys)
+	}
+	assert.Equal(t, 100, keys)
+
+	leaf := levels[len(levels)-1][0]
+	d, err := dumpPage(int(leaf.PageID), h, nil, datafile)
+	assert.NoError(t, err)
+	assert.Empty(t, d.Corrupt)
+	assert.Equal(t, "leaf", d.PageType)
+	assert.Len(t, d.Slots, int(d.NumSlots))
+	assert.Equal(t, leaf.Keys[0], d.Cells[0].Key)
+
+	root, err := dumpPage(int(h.RootPage), h, nil, datafile)
+	assert.NoError(t, err)
+	assert.Equal(t, "root", root.PageType)
+	assert.NotZero(t, root.RightChild)
+	assert.NotZero(t, root.Cells[0].Child)
+}
+
+func TestDumpCorruptPage(t *testing.T) {
+	path := checkpointedDB(t, 100)
+
+	datafile, err := OSFS.OpenFile(path, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	defer datafile.Close()
+
+	h, _ := ReadHeader(datafile)
+	_, _ = datafile.WriteAt([]byte{0xff, 0xff}, h.pageStart()+int64(h.RootPage-1)*PAGE_SIZE+int64(PAGE_HEADER_SIZE))
+
+	d, err := dumpPage(int(h.RootPage), h, nil, datafile)
+	assert.NoError(t, err)
+	assert.Contains(t, d.Corrupt, "corrupt page")
+}
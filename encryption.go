@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// pages are encrypted with AES-GCM: the body past the page header is encrypted and
+// the header is authenticated along with it, so a page can't be moved to another
+// id or have it's header edited. a nonce must never repeat under a key, it's the
+// page id and 8 random bytes. the id alone repeats since checkpoints rewrite free
+// page ids, and so does the checkpoint generation: a checkpoint that crashes
+// before it's header write leaves it as it was for the next one.
+// the tag and the random half of the nonce go in the reserve at the end of the page.
+// see: https://www.zetetic.net/sqlcipher/design/
+const (
+	GCM_TAG_SIZE       = 16
+	NONCE_RANDOM_SIZE  = 8
+	ENCRYPTION_RESERVE = GCM_TAG_SIZE + NONCE_RANDOM_SIZE
+)
+
+// authenticated by the key check value, it's nonce is that of page id 0 which no page has
+var keyCheckData = []byte("bubblegum key check")
+
+// KeyProvider hands out the keys a datafile is encrypted with by their rotation
+// generation, the file header records the generation of it's pages and DB.Rekey
+// moves it on. a key of 16, 24 or 32 bytes picks AES-128, AES-192 or AES-256
+type KeyProvider interface {
+	Key(generation uint32) ([]byte, error)
+}
+
+// StaticKey is the same key for every generation
+type StaticKey []byte
+
+func (k StaticKey) Key(uint32) ([]byte, error) {
+	return k, nil
+}
+
+type pageCipher struct {
+	aead cipher.AEAD
+}
+
+func newPageCipher(key []byte) (*pageCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrEncryptionKey, err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pageCipher{aead: aead}, nil
+}
+
+// cipherOf takes the key of a generation from keys, nil keys is no encryption
+func cipherOf(keys KeyProvider, generation uint32) (*pageCipher, error) {
+	if keys == nil {
+		return nil, nil
+	}
+
+	key, err := keys.Key(generation)
+	if err != nil {
+		return nil, fmt.Errorf("key of generation %v: %w", generation, err)
+	}
+
+	return newPageCipher(key)
+}
+
+// headerCipher resolves the key of the header's generation and checks it against
+// the recorded check value, a wrong key is told apart from corruption before any
+// page is read
+func headerCipher(h fileHeader, keys KeyProvider) (*pageCipher, error) {
+	encrypted := h.KeyCheck != [8]byte{}
+
+	switch {
+	case !encrypted && keys == nil:
+		return nil, nil
+	case !encrypted:
+		return nil, fmt.Errorf("%w: datafile isn't encrypted, see: DB.Rekey", ErrEncryptionKey)
+	case keys == nil:
+		return nil, fmt.Errorf("%w: datafile is encrypted, see: Options.Keys", ErrEncryptionKey)
+	}
+
+	c, err := cipherOf(keys, h.KeyGeneration)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.checkValue() != h.KeyCheck {
+		return nil, fmt.Errorf("%w: the key doesn't match the check value of generation %v", ErrEncryptionKey, h.KeyGeneration)
+	}
+
+	return c, nil
+}
+
+// reserve is how many bytes the cipher sets aside at the end of a page
+func (c *pageCipher) reserve() int {
+	if c == nil {
+		return 0
+	}
+
+	return ENCRYPTION_RESERVE
+}
+
+// checkValue identifies the key without giving it away, zero without a cipher
+func (c *pageCipher) checkValue() (value [8]byte) {
+	if c != nil {
+		nonce := make([]byte, c.aead.NonceSize())
+		copy(value[:], c.aead.Seal(nil, nonce, nil, keyCheckData))
+	}
+
+	return value
+}
+
+func pageNonce(pageId uint32, random []byte) []byte {
+	nonce := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+NONCE_RANDOM_SIZE), pageId)
+	return append(nonce, random...)
+}
+
+// seal encrypts the body of a stored page in place, the header is encoded with
+// a zero checksum at this point and that's what is authenticated
+func (c *pageCipher) seal(stored []byte, pageId uint32, bodyEnd int) error {
+	_assert(c != nil, "page %v has a reserve but no cipher", pageId)
+
+	random := stored[bodyEnd+GCM_TAG_SIZE : bodyEnd+ENCRYPTION_RESERVE]
+	if _, err := rand.Read(random); err != nil {
+		return fmt.Errorf("drawing the nonce of page %v: %w", pageId, err)
+	}
+
+	c.aead.Seal(stored[PAGE_HEADER_SIZE:PAGE_HEADER_SIZE], pageNonce(pageId, random), stored[PAGE_HEADER_SIZE:bodyEnd], stored[:PAGE_HEADER_SIZE])
+	return nil
+}
+
+// open decrypts a page into a buffer of it's own, the one it was read into may be
+// a read only mapping. the page passed it's checksum so failing authentication
+// means it was written under another key or tampered with
+func (c *pageCipher) open(p *Page) error {
+	if c == nil {
+		return fmt.Errorf("%w: page %v is encrypted", ErrEncryptionKey, p.PageID)
+	}
+
+	if p.Reserve != ENCRYPTION_RESERVE {
+		return fmt.Errorf("%w: page %v reserves %v bytes, encryption takes %v", ErrCorrupt, p.PageID, p.Reserve, ENCRYPTION_RESERVE)
+	}
+
+	end := p.bodyEnd()
+	header := slices.Clone(p.buf[:PAGE_HEADER_SIZE])
+	binary.LittleEndian.PutUint32(header[4:8], 0)
+
+	buf := alignedBuffer(p.size())
+	copy(buf, p.buf[:PAGE_HEADER_SIZE])
+
+	random := p.buf[end+GCM_TAG_SIZE : end+ENCRYPTION_RESERVE]
+	if _, err := c.aead.Open(buf[PAGE_HEADER_SIZE:PAGE_HEADER_SIZE], pageNonce(p.PageID, random), p.buf[PAGE_HEADER_SIZE:end+GCM_TAG_SIZE], header); err != nil {
+		return fmt.Errorf("%w: page %v fails authentication, it was written under another key or tampered with", ErrCorrupt, p.PageID)
+	}
+
+	p.buf = buf
+	return nil
+}
+
+// Rekey re-encrypts the datafile under the key keys hands out for the next
+// generation, nil keys decrypts it. a checkpoint rewrites every page the tree
+// reaches under the new key before the header moves on to it's check value, a
+// crash before then leaves the datafile under the old one. the free pages still
+// hold the old encryption so they're zeroed after. readers and writers wait
+// for it as they would for a checkpoint, reopen with keys afterwards.
+func (db *DB) Rekey(keys KeyProvider) (err error) {
+	if err = db.writable(); err != nil {
+		return err
+	}
+
+	defer db.recoverInvariant(&err)
+
+	if err = db.rekey(keys); errors.Is(err, ErrIO) {
+		db.poison(err)
+	}
+
+	return err
+}
+
+func (db *DB) rekey(keys KeyProvider) error {
+	sm := &db.storeManager
+
+	db.storeMu.Lock()
+	defer db.storeMu.Unlock()
+
+	t := db.tree
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	generation := sm.header.KeyGeneration + 1
+	c, err := cipherOf(keys, generation)
+	if err != nil {
+		return err
+	}
+
+	previous, check := sm.cipher, sm.header.KeyCheck
+	sm.cipher, sm.header.KeyCheck, sm.header.KeyGeneration = c, c.checkValue(), generation
+
+	if err = db.writeCheckpoint(); err != nil {
+		sm.cipher, sm.header.KeyCheck, sm.header.KeyGeneration = previous, check, generation-1
+		return err
+	}
+
+	db.opts.Keys = keys
+	return sm.scrubFree()
+}
+
+// scrubFree zeroes the free pages, they hold whatever they were last written with
+func (s *StoreManager) scrubFree() error {
+	zero := alignedBuffer(s.pageSize())
+
+	if err := s.syncHeader(); err != nil {
+		return err
+	}
+
+	for _, id := range s.free {
+		offset, err := pageOffset(id, s.pageSize(), s.header.pageStart())
+		if err != nil {
+			return err
+		}
+
+		if _, err = s.datafile.WriteAt(zero, offset); err != nil {
+			return ioError(err, "zeroing free page %v", id)
+		}
+	}
+
+	if err := s.datafile.Sync(); err != nil {
+		return ioError(err, "fsync of %v zeroed pages", len(s.free))
+	}
+
+	return nil
+}
+
+// readKeyFile reads a hex encoded key, an empty path is no key
+func readKeyFile(path string) (KeyProvider, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%v should hold the key hex encoded: %w", path, err)
+	}
+
+	return StaticKey(key), nil
+}
+
+// bubblegum rekey [--key-file path] [--new-key-file path] <datafile>
+func runRekey(args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	keyFile := flags.String("key-file", "", "file holding the current key hex encoded, unset if the datafile isn't encrypted")
+	newKeyFile := flags.String("new-key-file", "", "file holding the new key hex encoded, unset to decrypt the datafile")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: bubblegum rekey [--key-file path] [--new-key-file path] <datafile>")
+	}
+
+	keys, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	newKeys, err := readKeyFile(*newKeyFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := Open(flags.Arg(0), &Options{Keys: keys})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err = db.Rekey(newKeys); err != nil {
+		return err
+	}
+
+	h := db.storeManager.header
+	fmt.Printf("rewrote %v pages at key generation %v, zeroed %v free pages\n", int(h.PageCount)-len(db.storeManager.free), h.KeyGeneration, len(db.storeManager.free))
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testKey      = StaticKey(bytes.Repeat([]byte{1}, 32))
+	otherTestKey = StaticKey(bytes.Repeat([]byte{2}, 32))
+)
+
+// generationKeys hands out a different key for every generation
+type generationKeys map[uint32][]byte
+
+func (k generationKeys) Key(generation uint32) ([]byte, error) {
+	if key, ok := k[generation]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("no key for generation %v", generation)
+}
+
+func TestEncryptedPage(t *testing.T) {
+	datafile, _ := NewMemFS(1, Faults{}).OpenFile("db", os.O_CREATE|os.O_RDWR, 0644)
+	c, _ := newPageCipher(testKey)
+	other, _ := newPageCipher(otherTestKey)
+
+	keys, values := make([]int, 50), make([][]byte, 50)
+	for i := range keys {
+		keys[i], values[i] = i, []byte(fmt.Sprintf("secret %v", i))
+	}
+
+	write := func(id uint32, codec Codec) []byte {
+		page := Page{codec: codec, cipher: c}
+		page.PageID, page.Reserve = id, ENCRYPTION_RESERVE
+		_ = page.allocate(PAGE_SIZE)
+		assert.NoError(t, page.writeCells(keys, values, nil))
+		page.PageType = LEAF_NODE
+		assert.NoError(t, page.Flush(datafile))
+
+		stored := make([]byte, PAGE_SIZE)
+		_, _ = datafile.ReadAt(stored, FILE_HEADER_SIZE+int64(id-1)*PAGE_SIZE)
+		return stored
+	}
+
+	for _, codec := range []Codec{CODEC_NONE, CODEC_LZ4} {
+		stored := write(1, codec)
+		assert.NotContains(t, string(stored), "secret", codec)
+		assert.NotEqual(t, stored, write(1, codec), "a rewrite draws a new nonce")
+
+		page, err := openPage(1, PAGE_SIZE, FILE_HEADER_SIZE, c, datafile)
+		assert.NoError(t, err)
+		assert.Equal(t, codec, page.Codec)
+		assert.Empty(t, verifyLayout(&page))
+		assert.Equal(t, keys, page.Keys())
+		assert.Equal(t, values[49], page.Value(49))
+
+		_, err = FetchPage(1, PAGE_SIZE, datafile)
+		assert.ErrorIs(t, err, ErrEncryptionKey)
+
+		_, err = openPage(1, PAGE_SIZE, FILE_HEADER_SIZE, other, datafile)
+		assert.ErrorIs(t, err, ErrCorrupt)
+	}
+
+	// a page copied to another id with it's id and checksum fixed up passes the
+	// checksum but not authentication
+	stored := write(1, CODEC_NONE)
+	binary.LittleEndian.PutUint32(stored[0:4], 2)
+	binary.LittleEndian.PutUint32(stored[4:8], 0)
+	binary.LittleEndian.PutUint32(stored[4:8], pageChecksum(stored))
+	_, _ = datafile.WriteAt(stored, FILE_HEADER_SIZE+PAGE_SIZE)
+
+	_, err := openPage(2, PAGE_SIZE, FILE_HEADER_SIZE, c, datafile)
+	var corrupt *ErrCorruptPage
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.False(t, errors.As(err, &corrupt))
+	assert.Contains(t, err.Error(), "fails authentication")
+}
+
+func TestOpenEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+
+	_, err := Open(path, &Options{CreateIfMissing: true, Keys: StaticKey("too short")})
+	assert.ErrorIs(t, err, ErrEncryptionKey)
+
+	db, err := Open(path, &Options{MaxDegree: 8, CreateIfMissing: true, Keys: testKey})
+	assert.NoError(t, err)
+
+	for k := 0; k < 1000; k++ {
+		assert.NoError(t, db.Insert(k, []byte(fmt.Sprintf("customer %v", k))))
+	}
+	assert.NoError(t, db.Checkpoint())
+	assert.NoError(t, db.Checkpoint())
+	db.Close()
+
+	raw, _ := os.ReadFile(path)
+	assert.NotContains(t, string(raw), "customer")
+
+	for _, keys := range []KeyProvider{nil, otherTestKey} {
+		_, err = Open(path, &Options{Keys: keys})
+		assert.ErrorIs(t, err, ErrEncryptionKey)
+
+		_, err = CheckFile(path, false, keys)
+		assert.ErrorIs(t, err, ErrEncryptionKey)
+	}
+
+	report, err := CheckFile(path, false, testKey)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Empty(t, report.Warnings)
+	assert.Equal(t, 1000, report.Keys)
+
+	for _, opts := range []Options{{Keys: testKey}, {Keys: testKey, MmapSize: 1 << 20}} {
+		db, err = Open(path, &opts)
+		assert.NoError(t, err)
+
+		value, err := db.Get(999)
+		assert.NoError(t, err)
+		assert.Equal(t, "customer 999", string(value))
+
+		page, err := db.FetchPage(int(db.storeManager.header.RootPage))
+		assert.NoError(t, err)
+		assert.Empty(t, verifyLayout(&page))
+		db.Close()
+	}
+
+	// the header is readable without the key, the pages aren't
+	datafile, _ := OSFS.OpenFile(path, os.O_RDONLY, 0)
+	defer datafile.Close()
+
+	h, _ := ReadHeader(datafile)
+	assert.True(t, dumpHeader(h).Encrypted)
+
+	d, err := dumpPage(int(h.RootPage), h, nil, datafile)
+	assert.NoError(t, err)
+	assert.True(t, d.Encrypted)
+	assert.Contains(t, d.Malformed, "encrypted")
+
+	plain := checkpointedDB(t, 10)
+	_, err = Open(plain, &Options{Keys: testKey})
+	assert.ErrorIs(t, err, ErrEncryptionKey)
+}
+
+// the reserve comes out of the largest value, a full leaf still fits the smallest pages
+func TestEncryptedPageSizes(t *testing.T) {
+	for _, size := range []int{MIN_PAGE_SIZE, PAGE_SIZE, MAX_PAGE_SIZE} {
+		path := filepath.Join(t.TempDir(), "db")
+		db, err := Open(path, &Options{PageSize: size, CreateIfMissing: true, Keys: testKey})
+		assert.NoError(t, err)
+
+		limit := db.maxValueSize()
+		assert.Equal(t, overflowThreshold(size, ENCRYPTION_RESERVE, DEFAULT_DEGREE), limit)
+		assert.ErrorContains(t, db.Insert(0, make([]byte, limit+1)), "cell limit")
+
+		for k := 0; k < 4*DEFAULT_DEGREE; k++ {
+			assert.NoError(t, db.Insert(k, bytes.Repeat([]byte{'v'}, limit)))
+		}
+		assert.NoError(t, db.Checkpoint(), size)
+		db.Close()
+
+		report, err := CheckFile(path, false, testKey)
+		assert.NoError(t, err)
+		assert.Empty(t, report.Errors, size)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	path := checkpointedDB(t, 500)
+	rotating := generationKeys{1: testKey, 2: otherTestKey}
+
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+
+	// encrypt, rotate and decrypt again while the db stays open
+	for generation, keys := range []KeyProvider{rotating, rotating, nil} {
+		assert.NoError(t, db.Rekey(keys))
+		assert.Equal(t, uint32(generation+1), db.storeManager.header.KeyGeneration)
+
+		// the free pages are zeroed, the previous key (or none) can't read anything
+		previous, _ := cipherOf(rotating, uint32(generation))
+		for id := 1; id <= int(db.storeManager.header.PageCount); id++ {
+			if _, err := openPage(id, PAGE_SIZE, db.pageStart, previous, db.datafile); err == nil && keys != nil {
+				t.Errorf("page %v reads with the key of generation %v", id, generation)
+			}
+		}
+
+		assert.NoError(t, db.Insert(1000+generation, []byte("written after the rekey")))
+		assert.NoError(t, db.Checkpoint())
+
+		report, err := db.Check()
+		assert.NoError(t, err)
+		assert.Empty(t, report.Errors)
+	}
+
+	db.Close()
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 503, db.tree.Len())
+	db.Close()
+
+	// a rekey that fails leaves the datafile under the old key
+	db, _ = Open(path, nil)
+	assert.ErrorContains(t, db.Rekey(generationKeys{}), "no key for generation 4")
+	assert.Equal(t, uint32(3), db.storeManager.header.KeyGeneration)
+	assert.NoError(t, db.Checkpoint())
+	db.Close()
+
+	_, err = Open(path, nil)
+	assert.NoError(t, err)
+}
+
+func TestRekeyCommand(t *testing.T) {
+	path := checkpointedDB(t, 100)
+	dir := t.TempDir()
+
+	keyFile, newKeyFile := filepath.Join(dir, "key"), filepath.Join(dir, "new")
+	_ = os.WriteFile(keyFile, []byte(hex.EncodeToString(testKey)+"\n"), 0600)
+	_ = os.WriteFile(newKeyFile, []byte(hex.EncodeToString(otherTestKey)), 0600)
+
+	assert.NoError(t, runRekey([]string{"--new-key-file", keyFile, path}))
+	assert.ErrorIs(t, runRekey([]string{"--new-key-file", keyFile, path}), ErrEncryptionKey)
+	assert.NoError(t, runRekey([]string{"--key-file", keyFile, "--new-key-file", newKeyFile, path}))
+
+	keys, err := readKeyFile(newKeyFile)
+	assert.NoError(t, err)
+
+	report, err := CheckFile(path, false, keys)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, 100, report.Keys)
+	assert.Equal(t, uint32(2), report.Header.KeyGeneration)
+
+	_ = os.WriteFile(keyFile, []byte("not hex"), 0600)
+	_, err = readKeyFile(keyFile)
+	assert.ErrorContains(t, err, "hex encoded")
+}
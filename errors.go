@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errors returned by the engine, they come wrapped with context so match
+// them with errors.Is, the cause of an ErrIO stays reachable too
+var (
+	ErrIO         = errors.New("i/o error")
+	ErrCorrupt    = errors.New("corrupt data")
+	ErrNotFound   = errors.New("key not found")
+	ErrClosed     = errors.New("closed")
+	ErrReadOnly   = errors.New("database is read only")
+	ErrTxConflict = errors.New("transaction conflict: the tree was written to since the transaction began")
+	ErrLocked     = errors.New("datafile is locked by another process")
+	// the key is wrong, or missing for an encrypted datafile see: Options.Keys
+	ErrEncryptionKey = errors.New("wrong or missing encryption key")
+)
+
+// IOError is a failed read, write, seek or fsync of the datafile
+type IOError struct {
+	Op  string // e.g "writing page 3"
+	Err error
+}
+
+func (e *IOError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Op, e.Err)
+}
+
+func (e *IOError) Unwrap() []error {
+	return []error{ErrIO, e.Err}
+}
+
+func ioError(err error, format string, v ...any) error {
+	return &IOError{Op: fmt.Sprintf(format, v...), Err: err}
+}
+
+// readError tells a read that ran off the end of the file, the file is too
+// short for what the header says it holds, apart from an I/O failure
+func readError(err error, format string, v ...any) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v: truncated datafile", ErrCorrupt, fmt.Sprintf(format, v...))
+	}
+
+	return ioError(err, format, v...)
+}
+
+// invariantError is what _assert panics with, the DB recovers it into an
+// ErrCorrupt since the tree in memory can no longer be trusted
+type invariantError struct {
+	msg string
+}
+
+func (e *invariantError) Error() string {
+	return "runtime invariant failure: " + e.msg
+}
+
+func (e *invariantError) Unwrap() error {
+	return ErrCorrupt
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// linearizability checking: many goroutines hit one tree and every call is
+// recorded with the logical time it was invoked and returned. the history is
+// linearizable if each op can be given a point between the two at which it
+// takes effect, and that order is a valid run of a sequential key value store.
+// the search is the Wing & Gong algorithm with Lowe's memoisation, as in
+// porcupine, over one key at a time since keys are independent.
+// see: https://www.anishathalye.com/2017/06/04/testing-distributed-systems-for-linearizability/
+
+var linRounds = flag.Int("lin.rounds", 20, "rounds of TestBTreeLinearizable, each on a tree of random degree")
+
+type linOpKind int
+
+const (
+	LIN_GET linOpKind = iota
+	LIN_PUT
+	LIN_DELETE
+	LIN_CAS
+)
+
+type linOp struct {
+	client int
+	kind   linOpKind
+	key    int
+	value  string // put, cas new value
+	old    string // cas expected value
+	ok     bool   // get found, delete found, cas swapped
+	got    string // get
+	call   int64
+	ret    int64
+}
+
+func (op linOp) String() string {
+	var desc string
+
+	switch op.kind {
+	case LIN_GET:
+		desc = fmt.Sprintf("get(%v) = %q, %v", op.key, op.got, op.ok)
+	case LIN_PUT:
+		desc = fmt.Sprintf("put(%v, %q)", op.key, op.value)
+	case LIN_DELETE:
+		desc = fmt.Sprintf("delete(%v) = %v", op.key, op.ok)
+	default:
+		desc = fmt.Sprintf("cas(%v, %q, %q) = %v", op.key, op.old, op.value, op.ok)
+	}
+
+	return fmt.Sprintf("client %v [%v, %v] %v", op.client, op.call, op.ret, desc)
+}
+
+// kvState is the sequential model of a single key
+type kvState struct {
+	present bool
+	value   string
+}
+
+// step applies op to the model, it reports whether the op's result is what the
+// model returns in that state
+func (s kvState) step(op *linOp) (bool, kvState) {
+	switch op.kind {
+	case LIN_GET:
+		return op.ok == s.present && op.got == s.value, s
+	case LIN_PUT:
+		return true, kvState{true, op.value}
+	case LIN_DELETE:
+		return op.ok == s.present, kvState{}
+	default:
+		swapped := s.present && s.value == op.old
+		if swapped {
+			return op.ok, kvState{true, op.value}
+		}
+
+		return !op.ok, s
+	}
+}
+
+// linRecorder hands out timestamps from a logical clock shared by all clients
+type linRecorder struct {
+	clock   atomic.Int64
+	mu      sync.Mutex
+	history []linOp
+}
+
+// record times run, which performs op and fills in it's result
+func (r *linRecorder) record(op linOp, run func(op *linOp)) {
+	op.call = r.clock.Add(1)
+	run(&op)
+	op.ret = r.clock.Add(1)
+
+	r.mu.Lock()
+	r.history = append(r.history, op)
+	r.mu.Unlock()
+}
+
+// linEntry is a call or return event in a doubly linked list ordered by time
+type linEntry struct {
+	op         *linOp
+	id         int
+	call       bool
+	match      *linEntry // the return of a call
+	prev, next *linEntry
+}
+
+// lift takes a call and it's return out of the list once the call is linearized
+func (e *linEntry) lift() {
+	e.prev.next, e.next.prev = e.next, e.prev
+
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+func (e *linEntry) unlift() {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+
+	e.prev.next, e.next.prev = e, e
+}
+
+// checkLinearizable reports the key of the first partition of history that has no
+// linearization, and it's ops in call order
+func checkLinearizable(history []linOp) (int, []linOp, bool) {
+	partitions := map[int][]linOp{}
+	for _, op := range history {
+		partitions[op.key] = append(partitions[op.key], op)
+	}
+
+	keys := make([]int, 0, len(partitions))
+	for key := range partitions {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		ops := partitions[key]
+		if !linearizable(ops) {
+			slices.SortFunc(ops, func(a, b linOp) int { return int(a.call - b.call) })
+			return key, ops, false
+		}
+	}
+
+	return 0, nil, true
+}
+
+// linearizable searches for an order of ops, all on one key, that the
+// sequential model accepts. it tries calls in list order, a return reached
+// before it's call was linearized means backtracking. states already seen with
+// the same set of linearized ops are pruned.
+func linearizable(ops []linOp) bool {
+	events := make([]*linEntry, 0, 2*len(ops))
+	for i := range ops {
+		call := &linEntry{op: &ops[i], id: i, call: true}
+		call.match = &linEntry{op: &ops[i], id: i}
+		events = append(events, call, call.match)
+	}
+
+	slices.SortFunc(events, func(a, b *linEntry) int {
+		return int(a.time() - b.time())
+	})
+
+	head := &linEntry{}
+	prev := head
+	for _, e := range events {
+		prev.next, e.prev = e, prev
+		prev = e
+	}
+
+	type frame struct {
+		entry *linEntry
+		state kvState
+	}
+
+	var (
+		stack      []frame
+		state      kvState
+		linearized = make([]byte, (len(ops)+7)/8)
+		seen       = map[string]struct{}{}
+		entry      = head.next
+	)
+
+	for head.next != nil {
+		if !entry.call {
+			if len(stack) == 0 {
+				return false
+			}
+
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			linearized[top.entry.id/8] &^= 1 << (top.entry.id % 8)
+			state = top.state
+			top.entry.unlift()
+			entry = top.entry.next
+			continue
+		}
+
+		if ok, next := state.step(entry.op); ok {
+			linearized[entry.id/8] |= 1 << (entry.id % 8)
+			key := fmt.Sprintf("%s|%v|%s", linearized, next.present, next.value)
+
+			if _, found := seen[key]; !found {
+				seen[key] = struct{}{}
+				stack = append(stack, frame{entry, state})
+				state = next
+				entry.lift()
+				entry = head.next
+				continue
+			}
+
+			linearized[entry.id/8] &^= 1 << (entry.id % 8)
+		}
+
+		entry = entry.next
+	}
+
+	return true
+}
+
+func (e *linEntry) time() int64 {
+	if e.call {
+		return e.op.call
+	}
+
+	return e.op.ret
+}
+
+func formatHistory(ops []linOp) string {
+	var b strings.Builder
+	for _, op := range ops {
+		fmt.Fprintf(&b, "\t%v\n", op)
+	}
+
+	return b.String()
+}
+
+func TestLinearizableHistories(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []linOp
+		want    bool
+	}{
+		{"empty", nil, true},
+		{"read overlaps the write it sees", []linOp{
+			{client: 1, kind: LIN_PUT, key: 1, value: "a", call: 1, ret: 4},
+			{client: 2, kind: LIN_GET, key: 1, got: "a", ok: true, call: 2, ret: 3},
+		}, true},
+		{"read overlaps the write it misses", []linOp{
+			{client: 1, kind: LIN_PUT, key: 1, value: "a", call: 1, ret: 4},
+			{client: 2, kind: LIN_GET, key: 1, call: 2, ret: 3},
+		}, true},
+		{"stale read after a completed write", []linOp{
+			{client: 1, kind: LIN_PUT, key: 1, value: "a", call: 1, ret: 2},
+			{client: 1, kind: LIN_PUT, key: 1, value: "b", call: 3, ret: 4},
+			{client: 2, kind: LIN_GET, key: 1, got: "a", ok: true, call: 5, ret: 6},
+		}, false},
+		{"read of a value never written", []linOp{
+			{client: 1, kind: LIN_GET, key: 1, got: "a", ok: true, call: 1, ret: 2},
+		}, false},
+		{"two reads see the writes in different orders", []linOp{
+			{client: 1, kind: LIN_PUT, key: 1, value: "a", call: 1, ret: 10},
+			{client: 2, kind: LIN_PUT, key: 1, value: "b", call: 2, ret: 11},
+			{client: 3, kind: LIN_GET, key: 1, got: "a", ok: true, call: 3, ret: 4},
+			{client: 3, kind: LIN_GET, key: 1, got: "b", ok: true, call: 5, ret: 6},
+			{client: 4, kind: LIN_GET, key: 1, got: "b", ok: true, call: 3, ret: 4},
+			{client: 4, kind: LIN_GET, key: 1, got: "a", ok: true, call: 5, ret: 6},
+		}, false},
+		{"both concurrent swaps succeed", []linOp{
+			{client: 1, kind: LIN_PUT, key: 1, value: "a", call: 1, ret: 2},
+			{client: 2, kind: LIN_CAS, key: 1, old: "a", value: "b", ok: true, call: 3, ret: 6},
+			{client: 3, kind: LIN_CAS, key: 1, old: "a", value: "c", ok: true, call: 4, ret: 5},
+		}, false},
+		{"one concurrent swap wins", []linOp{
+			{client: 1, kind: LIN_PUT, key: 1, value: "a", call: 1, ret: 2},
+			{client: 2, kind: LIN_CAS, key: 1, old: "a", value: "b", call: 3, ret: 6},
+			{client: 3, kind: LIN_CAS, key: 1, old: "a", value: "c", ok: true, call: 4, ret: 5},
+			{client: 2, kind: LIN_GET, key: 1, got: "c", ok: true, call: 7, ret: 8},
+		}, true},
+		{"deleted twice", []linOp{
+			{client: 1, kind: LIN_PUT, key: 1, value: "a", call: 1, ret: 2},
+			{client: 2, kind: LIN_DELETE, key: 1, ok: true, call: 3, ret: 5},
+			{client: 3, kind: LIN_DELETE, key: 1, ok: true, call: 4, ret: 6},
+		}, false},
+		{"keys are checked apart", []linOp{
+			{client: 1, kind: LIN_PUT, key: 1, value: "a", call: 1, ret: 2},
+			{client: 1, kind: LIN_GET, key: 2, call: 3, ret: 4},
+			{client: 2, kind: LIN_GET, key: 1, got: "a", ok: true, call: 5, ret: 6},
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ops, ok := checkLinearizable(tt.history)
+			if ok != tt.want {
+				t.Fatalf("linearizable = %v want %v, key %v:\n%v", ok, tt.want, key, formatHistory(ops))
+			}
+		})
+	}
+}
+
+// TestBTreeLinearizable runs concurrent Get/Put/Delete/CAS against a tree of random
+// degree and checks the recorded history, more rounds with: go test -run
+// TestBTreeLinearizable -lin.rounds=1000
+func TestBTreeLinearizable(t *testing.T) {
+	rounds := *linRounds
+	if testing.Short() {
+		rounds = min(rounds, 5)
+	}
+
+	const (
+		CLIENTS  = 8
+		OPS      = 200
+		KEYSPACE = 8
+	)
+
+	for round := 0; round < rounds; round++ {
+		seed := rand.Int63()
+		degree := rand.New(rand.NewSource(seed)).Intn(14) + 3
+		tree := NewBTree(degree)
+		rec := &linRecorder{}
+
+		var wg sync.WaitGroup
+		for client := 0; client < CLIENTS; client++ {
+			wg.Add(1)
+
+			go func(client int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed + int64(client)))
+
+				for i := 0; i < OPS; i++ {
+					op := linOp{client: client, key: r.Intn(KEYSPACE), value: fmt.Sprintf("%v.%v", client, i)}
+
+					switch p := r.Intn(100); {
+					case p < 40:
+						op.kind = LIN_GET
+					case p < 70:
+						op.kind = LIN_PUT
+					case p < 85:
+						op.kind = LIN_DELETE
+					default:
+						// guess at a value some client put, or the initial one
+						op.kind, op.old = LIN_CAS, fmt.Sprintf("%v.%v", r.Intn(CLIENTS), r.Intn(max(i, 1)))
+					}
+
+					rec.record(op, func(op *linOp) {
+						switch op.kind {
+						case LIN_GET:
+							value, err := tree.Lookup(op.key)
+							op.ok, op.got = err == nil, string(value)
+						case LIN_PUT:
+							_ = tree.Put(op.key, []byte(op.value))
+						case LIN_DELETE:
+							op.ok = tree.Delete(op.key) == nil
+						case LIN_CAS:
+							op.ok, _ = tree.CompareAndSwap(op.key, []byte(op.old), []byte(op.value))
+						}
+					})
+				}
+			}(client)
+		}
+
+		wg.Wait()
+		checkTree(t, tree)
+
+		if key, ops, ok := checkLinearizable(rec.history); !ok {
+			t.Fatalf("round %v, seed %v, degree %v: history of key %v is not linearizable:\n%v",
+				round, seed, degree, key, formatHistory(ops))
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// lineEditor is a tiny readline: history, cursor movement and tab completion.
+// when the input isn't a terminal it falls back to reading plain lines.
+type lineEditor struct {
+	in     io.Reader
+	out    io.Writer
+	reader *bufio.Reader
+	raw    bool
+
+	history     []string
+	historyFile string
+	complete    func(prefix string) []string
+}
+
+func newLineEditor(in *os.File, out io.Writer, historyFile string, complete func(string) []string) *lineEditor {
+	e := &lineEditor{in: in, out: out, reader: bufio.NewReader(in), historyFile: historyFile, complete: complete}
+
+	if data, err := os.ReadFile(historyFile); err == nil {
+		e.history = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	}
+
+	return e
+}
+
+// enableRaw switches the terminal to raw mode, the returned func restores it
+func enableRaw(f *os.File) (func(), error) {
+	var original syscall.Termios
+	if err := ioctlTermios(f.Fd(), ioctlGetTermios, &original); err != nil {
+		return nil, err
+	}
+
+	raw := original
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO | syscall.ISIG | syscall.IEXTEN
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+
+	if err := ioctlTermios(f.Fd(), ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+
+	return func() { ioctlTermios(f.Fd(), ioctlSetTermios, &original) }, nil
+}
+
+func (e *lineEditor) remember(line string) {
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+
+	e.history = append(e.history, line)
+
+	if e.historyFile == "" {
+		return
+	}
+
+	if f, err := os.OpenFile(e.historyFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err == nil {
+		fmt.Fprintln(f, line)
+		f.Close()
+	}
+}
+
+// readLine returns the next line without it's newline, io.EOF on ctrl-d or end of input
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if !e.raw {
+		fmt.Fprint(e.out, prompt)
+
+		line, err := e.reader.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		e.remember(line)
+
+		return line, nil
+	}
+
+	var line []rune
+	pos, browsing := 0, len(e.history)
+
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%v%v\x1b[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+
+	redraw()
+
+	for {
+		r, _, err := e.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			e.remember(string(line))
+
+			return string(line), nil
+
+		case 3: // ctrl-c drops the line
+			fmt.Fprint(e.out, "^C\r\n")
+			line, pos = nil, 0
+
+		case 4: // ctrl-d
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+
+		case 1: // ctrl-a
+			pos = 0
+
+		case 5: // ctrl-e
+			pos = len(line)
+
+		case 127, 8: // backspace
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+
+		case '\t':
+			line, pos = e.completeLine(line, pos, prompt)
+
+		case 27: // escape sequences for the arrow keys
+			if next, _, _ := e.reader.ReadRune(); next != '[' {
+				continue
+			}
+
+			code, _, _ := e.reader.ReadRune()
+
+			switch code {
+			case 'A':
+				if browsing > 0 {
+					browsing--
+					line = []rune(e.history[browsing])
+					pos = len(line)
+				}
+			case 'B':
+				if browsing < len(e.history) {
+					browsing++
+					line = nil
+					if browsing < len(e.history) {
+						line = []rune(e.history[browsing])
+					}
+					pos = len(line)
+				}
+			case 'C':
+				pos = min(pos+1, len(line))
+			case 'D':
+				pos = max(pos-1, 0)
+			}
+
+		default:
+			if r >= ' ' {
+				line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+				pos++
+			}
+		}
+
+		redraw()
+	}
+}
+
+// completeLine completes the word under the cursor, with several candidates
+// it extends to their common prefix and lists them
+func (e *lineEditor) completeLine(line []rune, pos int, prompt string) ([]rune, int) {
+	if e.complete == nil {
+		return line, pos
+	}
+
+	candidates := e.complete(string(line[:pos]))
+	if len(candidates) == 0 {
+		return line, pos
+	}
+
+	common := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, common) {
+			common = common[:len(common)-1]
+		}
+	}
+
+	if len(candidates) == 1 {
+		common += " "
+	} else {
+		fmt.Fprintf(e.out, "\r\n%v\r\n", strings.Join(candidates, "  "))
+	}
+
+	completed := []rune(common)
+	return append(completed, line[pos:]...), len(completed)
+}
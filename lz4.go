@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// an LZ4 block (no frame), the format is a run of sequences each made of a token,
+// literals copied as is and a match copied from up to 64KiB back:
+// [token: literal length<<4 | match length-4] [literal length, 255 a byte if >= 15]
+// [literals] [offset uint16] [match length, 255 a byte if >= 15]
+// the last sequence is only literals.
+// see: https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+const (
+	LZ4_MIN_MATCH = 4
+	// the last 5 bytes are always literals and no match starts in the last 12
+	LZ4_LAST_LITERALS = 5
+	LZ4_MF_LIMIT      = 12
+	LZ4_MAX_OFFSET    = 1<<16 - 1
+
+	// 4096 entries of the positions last seen for a 4 byte sequence
+	LZ4_HASH_LOG = 12
+)
+
+var errLZ4Malformed = fmt.Errorf("%w: malformed lz4 block", ErrCorrupt)
+
+func lz4Hash(seq uint32) uint32 {
+	return seq * 2654435761 >> (32 - LZ4_HASH_LOG)
+}
+
+// lz4Compress appends the compressed src to dst. the matches are found greedily
+// through a hash table of the last position of each 4 byte sequence, as the
+// reference's fast mode does, but without it's acceleration on incompressible runs
+func lz4Compress(dst, src []byte) []byte {
+	var table [1 << LZ4_HASH_LOG]int32 // position + 1, 0 is empty
+	anchor := 0
+
+	for i := 0; i < len(src)-LZ4_MF_LIMIT; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := lz4Hash(seq)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if ref < 0 || i-ref > LZ4_MAX_OFFSET || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+
+		// the match may start earlier than where it was found
+		for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+			i, ref = i-1, ref-1
+		}
+
+		length := LZ4_MIN_MATCH
+		for i+length < len(src)-LZ4_LAST_LITERALS && src[i+length] == src[ref+length] {
+			length++
+		}
+
+		dst = lz4Sequence(dst, src[anchor:i], i-ref, length)
+		i += length
+		anchor = i
+	}
+
+	return lz4Sequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4Sequence appends a sequence, a zero match length is the last one
+func lz4Sequence(dst, literals []byte, offset, length int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if length > 0 {
+		token |= byte(min(length-LZ4_MIN_MATCH, 15))
+	}
+
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4Length(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+
+	if length == 0 {
+		return dst
+	}
+
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(offset))
+	if length-LZ4_MIN_MATCH >= 15 {
+		dst = lz4Length(dst, length-LZ4_MIN_MATCH-15)
+	}
+
+	return dst
+}
+
+func lz4Length(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+
+	return append(dst, byte(n))
+}
+
+// lz4Decompress fills dst from the block in src, which must decompress to exactly
+// len(dst) bytes. a malformed block is an error, it never reads or writes out of bounds
+func lz4Decompress(dst, src []byte) error {
+	d, s := 0, 0
+
+	// length reads the extra bytes of a length of 15
+	length := func(n int) (int, bool) {
+		if n != 15 {
+			return n, true
+		}
+
+		for s < len(src) {
+			b := src[s]
+			s++
+			n += int(b)
+
+			if b != 255 {
+				return n, true
+			}
+		}
+
+		return 0, false
+	}
+
+	for s < len(src) {
+		token := src[s]
+		s++
+
+		literals, ok := length(int(token >> 4))
+		if !ok || literals > len(src)-s || literals > len(dst)-d {
+			return errLZ4Malformed
+		}
+
+		d += copy(dst[d:], src[s:s+literals])
+		s += literals
+
+		if s == len(src) {
+			break
+		}
+
+		if len(src)-s < 2 {
+			return errLZ4Malformed
+		}
+
+		offset := int(binary.LittleEndian.Uint16(src[s:]))
+		s += 2
+
+		match, ok := length(int(token & 15))
+		match += LZ4_MIN_MATCH
+
+		if !ok || offset == 0 || offset > d || match > len(dst)-d {
+			return errLZ4Malformed
+		}
+
+		// the match can overlap what it's copying, e.g an offset of 1 repeats a byte
+		if offset >= match {
+			copy(dst[d:d+match], dst[d-offset:])
+		} else {
+			for i := 0; i < match; i++ {
+				dst[d+i] = dst[d-offset+i]
+			}
+		}
+
+		d += match
+	}
+
+	if d != len(dst) {
+		return errLZ4Malformed
+	}
+
+	return nil
+}
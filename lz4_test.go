@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// inputs around the edges of the format: too short for a match, literal and
+// match lengths past 15 and 255, overlapping matches and offsets near the limit
+func lz4Inputs() map[string][]byte {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		buf := make([]byte, n)
+		r.Read(buf)
+		return buf
+	}
+
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 100)
+	far := random(LZ4_MAX_OFFSET + 10)
+	far = append(far, far[:100]...)
+
+	return map[string][]byte{
+		"empty":      {},
+		"one byte":   {7},
+		"mf limit":   random(LZ4_MF_LIMIT),
+		"short":      bytes.Repeat([]byte{1, 2, 3}, 5),
+		"random":     random(4096),
+		"text":       text,
+		"run":        bytes.Repeat([]byte{'a'}, 70_000),
+		"literals":   append(random(600), bytes.Repeat([]byte{0}, 600)...),
+		"far match":  far,
+		"zeros page": make([]byte, PAGE_SIZE),
+	}
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	for name, src := range lz4Inputs() {
+		block := lz4Compress(nil, src)
+
+		dst := make([]byte, len(src))
+		assert.NoError(t, lz4Decompress(dst, block), name)
+		assert.Equal(t, src, dst, name)
+	}
+
+	text := lz4Inputs()["text"]
+	assert.Less(t, len(lz4Compress(nil, text)), len(text)/10)
+}
+
+// a damaged block is an error, never a panic or a write out of bounds
+func TestLZ4Malformed(t *testing.T) {
+	src := lz4Inputs()["text"]
+	block := lz4Compress(nil, src)
+	dst := make([]byte, len(src))
+
+	for n := 0; n < len(block); n++ {
+		assert.Error(t, lz4Decompress(dst, block[:n]), "truncated to %v bytes", n)
+	}
+
+	assert.ErrorIs(t, lz4Decompress(dst[:len(dst)-1], block), ErrCorrupt)
+	assert.ErrorIs(t, lz4Decompress(make([]byte, 10), []byte{0x0f, 1, 0, 0}), ErrCorrupt, "offset past the start")
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		damaged := bytes.Clone(block)
+		damaged[r.Intn(len(damaged))] ^= byte(1 + r.Intn(255))
+
+		_ = lz4Decompress(dst, damaged)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	src := lz4Inputs()["text"]
+
+	for _, name := range codecNames {
+		codec, err := parseCodec(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, codec.String())
+
+		dst := make([]byte, len(src))
+		assert.NoError(t, codec.decompress(dst, codec.compress(nil, src)))
+		assert.Equal(t, src, dst)
+	}
+
+	_, err := parseCodec("zstd")
+	assert.ErrorContains(t, err, "unknown compression")
+	assert.ErrorIs(t, Codec(42).decompress(nil, nil), ErrCorrupt)
+}
+
+func FuzzLZ4(f *testing.F) {
+	for _, src := range lz4Inputs() {
+		f.Add(src)
+	}
+
+	f.Fuzz(func(t *testing.T, src []byte) {
+		dst := make([]byte, len(src))
+		if err := lz4Decompress(dst, lz4Compress(nil, src)); err != nil || !bytes.Equal(src, dst) {
+			t.Errorf("round trip of %v bytes: %v", len(src), err)
+		}
+
+		// anything at all decompresses or fails cleanly
+		_ = lz4Decompress(make([]byte, 2*len(src)), src)
+	})
+}
+
+func BenchmarkLZ4(b *testing.B) {
+	src := lz4Inputs()["text"][:PAGE_SIZE]
+	block := lz4Compress(nil, src)
+	dst := make([]byte, len(src))
+
+	b.Run("compress", func(b *testing.B) {
+		out := make([]byte, 0, len(block))
+		b.SetBytes(int64(len(src)))
+
+		for i := 0; i < b.N; i++ {
+			out = lz4Compress(out[:0], src)
+		}
+	})
+
+	b.Run("decompress", func(b *testing.B) {
+		b.SetBytes(int64(len(src)))
+
+		for i := 0; i < b.N; i++ {
+			_ = lz4Decompress(dst, block)
+		}
+	})
+}
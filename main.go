@@ -20,9 +20,61 @@ pseudocode: http://staff.ustc.edu.cn/~csli/graduate/algorithms/book6/chap19.htm
 
 import (
 	"fmt"
+	"os"
 )
 
+const usage = `usage: bubblegum <command> [arguments]
+
+commands:
+  check [--repair] <datafile>                  audit a datafile offline
+  dump [--json] [--page id] [--tree] <datafile> inspect the header, a page or the tree
+  shell [--create [--degree n]] [--read-only] <datafile>
+                                               open a datafile in an interactive shell
+  rekey [--key-file path] [--new-key-file path] <datafile>
+                                               encrypt, decrypt or rotate the key of a datafile
+  compact <datafile>                            move the pages down and truncate the free end of a datafile
+  export [--format csv|jsonl] [--encoding base64|hex|text] [--start k] [--end k] [--out file] <datafile>
+  import [--format csv|jsonl] [--encoding base64|hex|text] [--start k] [--end k] [--batch n] [--in file] <datafile>
+  bench [--workload a-f|seq-insert|rand-insert|read|scan] [--distribution uniform|zipfian] ...
+
+an encrypted datafile takes --key-file path with every command, the file holds the key hex encoded`
+
 func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+
+	switch os.Args[1] {
+	case "check":
+		err = runCheck(os.Args[2:])
+	case "dump":
+		err = runDump(os.Args[2:])
+	case "shell":
+		err = runShell(os.Args[2:])
+	case "rekey":
+		err = runRekey(os.Args[2:])
+	case "compact":
+		err = runCompact(os.Args[2:])
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	case "bench":
+		err = runBench(os.Args[2:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// example usage:
 	// := NewBTree(100)
 	/*
 		db, err := InitDB(tree, "db")
@@ -56,8 +108,9 @@ func main() {
 }
 
 // why? see: https://github.com/tigerbeetle/tigerbeetle/blob/main/docs/TIGER_STYLE.md#safety
+// the DB recovers these into an ErrCorrupt, see: DB.recoverInvariant
 func _assert(cond bool, errMsg string, v ...any) {
 	if !cond {
-		panic(fmt.Sprintf("runtime invariant failure: "+errMsg, v...))
+		panic(&invariantError{fmt.Sprintf(errMsg, v...)})
 	}
 }
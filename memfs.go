@@ -0,0 +1,507 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// MemFS is an in-memory VFS that misbehaves like a real disk, every fault is
+// drawn from a seeded source so a failing run replays exactly from it's seed.
+//
+// a file keeps what is durable apart from the writes since it's last sync.
+// a crash (CrashAfter, Crash) stops every operation until Restart, which
+// rebuilds each file from it's durable contents and a random fate for every
+// unsynced write: kept, lost or torn at a sector boundary.
+type MemFS struct {
+	mu     sync.Mutex
+	rng    *rand.Rand
+	faults Faults
+	fired  FaultCounts
+	files  map[string]*memInode
+
+	ops     int // writes, truncates and syncs so far
+	crashAt int // the op that loses power, 0 to never crash
+	crashed bool
+	epoch   int // bumped by Restart, files opened before it are stale
+}
+
+// Faults are probabilities in [0, 1] of a fault per operation
+type Faults struct {
+	// Read returns fewer bytes than asked for, ReadAt fails with io.ErrUnexpectedEOF
+	ShortRead float64
+	// Sync fails with EIO and like linux drops the unsynced writes, reads
+	// still see them until the next crash
+	SyncEIO float64
+	// a write that grows a file fails with ENOSPC
+	ENOSPC float64
+
+	// the fate of every unsynced write on a crash, the rest are kept
+	TornWrite float64
+	LostWrite float64
+}
+
+// FaultCounts is how often each of the Faults was injected
+type FaultCounts struct {
+	ShortRead, SyncEIO, ENOSPC, TornWrite, LostWrite int
+}
+
+// writes within a sector are atomic, torn writes are cut at a sector boundary
+const MEM_SECTOR_SIZE = 512
+
+var errCrashed = errors.New("memfs: simulated crash, restart the filesystem")
+
+type memInode struct {
+	durable  []byte
+	data     []byte // durable plus the unsynced writes
+	unsynced []memWrite
+
+	// handles holding a shared lock, or the one holding it exclusively
+	shared    int
+	exclusive *memFile
+}
+
+// memWrite is an unsynced write, or a truncate to off when data is nil
+type memWrite struct {
+	off  int64
+	data []byte
+}
+
+type memFile struct {
+	fs     *MemFS
+	inode  *memInode
+	offset int64
+	flag   int
+	epoch  int
+	lock   memLock
+}
+
+type memLock uint8
+
+const (
+	MEM_UNLOCKED memLock = iota
+	MEM_SHARED
+	MEM_EXCLUSIVE
+)
+
+func NewMemFS(seed int64, faults Faults) *MemFS {
+	return &MemFS{rng: rand.New(rand.NewSource(seed)), faults: faults, files: map[string]*memInode{}}
+}
+
+// CrashAfter loses power during the n'th write, truncate or sync from now,
+// a write in flight is torn.
+func (m *MemFS) CrashAfter(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.crashAt = m.ops + n
+}
+
+// Crash loses power right away
+func (m *MemFS) Crash() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.crashed = true
+}
+
+func (m *MemFS) Crashed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.crashed
+}
+
+// Restart brings the filesystem back after a crash with only what made it to disk,
+// files opened before it keep failing.
+func (m *MemFS) Restart() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, inode := range m.files {
+		image := slices.Clone(inode.durable)
+
+		for _, w := range inode.unsynced {
+			switch p := m.rng.Float64(); {
+			case p < m.faults.LostWrite:
+				m.fired.LostWrite++
+				continue
+			case p < m.faults.LostWrite+m.faults.TornWrite:
+				m.fired.TornWrite++
+				w = m.tear(w)
+			}
+
+			image = w.apply(image)
+		}
+
+		inode.durable, inode.data, inode.unsynced = image, slices.Clone(image), nil
+		// the processes holding locks died with the power
+		inode.shared, inode.exclusive = 0, nil
+	}
+
+	m.crashed, m.crashAt = false, 0
+	m.epoch++
+}
+
+// tear keeps the sectors of a write up to a random sector boundary within it
+func (m *MemFS) tear(w memWrite) memWrite {
+	if w.data == nil {
+		return w
+	}
+
+	var cuts []int
+	for b := (w.off/MEM_SECTOR_SIZE + 1) * MEM_SECTOR_SIZE; b < w.off+int64(len(w.data)); b += MEM_SECTOR_SIZE {
+		cuts = append(cuts, int(b-w.off))
+	}
+
+	cut := 0
+	if len(cuts) > 0 {
+		cut = cuts[m.rng.Intn(len(cuts))]
+	}
+
+	return memWrite{off: w.off, data: w.data[:cut]}
+}
+
+func (w memWrite) apply(buf []byte) []byte {
+	if w.data == nil {
+		if w.off < int64(len(buf)) {
+			return buf[:w.off]
+		}
+
+		return append(buf, make([]byte, w.off-int64(len(buf)))...)
+	}
+
+	if end := w.off + int64(len(w.data)); end > int64(len(buf)) {
+		buf = append(buf, make([]byte, end-int64(len(buf)))...)
+	}
+
+	copy(buf[w.off:], w.data)
+	return buf
+}
+
+// check fails every op on a crashed filesystem or a handle from before a restart
+func (f *memFile) check() error {
+	if f.fs.crashed || f.epoch != f.fs.epoch {
+		return errCrashed
+	}
+
+	return nil
+}
+
+// tick counts a mutating op, it reports whether the power goes out during it
+func (f *memFile) tick() (crash bool, err error) {
+	m := f.fs
+
+	if err := f.check(); err != nil {
+		return false, err
+	}
+
+	m.ops++
+
+	if m.crashAt != 0 && m.ops >= m.crashAt {
+		m.crashed = true
+		return true, errCrashed
+	}
+
+	return false, nil
+}
+
+// fault draws a fault of probability p, counting it when it fires
+func (m *MemFS) fault(p float64, fired *int) bool {
+	if p > 0 && m.rng.Float64() < p {
+		*fired++
+		return true
+	}
+
+	return false
+}
+
+// Fired is how often each fault was injected so far
+func (m *MemFS) Fired() FaultCounts {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.fired
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.crashed {
+		return nil, errCrashed
+	}
+
+	inode, ok := m.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+
+		inode = &memInode{}
+		m.files[name] = inode
+	} else if flag&os.O_EXCL != 0 && flag&os.O_CREATE != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+
+	f := &memFile{fs: m, inode: inode, flag: flag, epoch: m.epoch}
+
+	if flag&os.O_TRUNC != 0 {
+		f.write(memWrite{off: 0})
+	}
+
+	return f, nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+
+	delete(m.files, name)
+	return nil
+}
+
+// write applies w to the file, O_DSYNC files make it durable at once
+func (f *memFile) write(w memWrite) {
+	f.inode.data = w.apply(f.inode.data)
+
+	if f.flag&syscall.O_DSYNC != 0 || f.flag&os.O_SYNC != 0 {
+		f.inode.durable = w.apply(f.inode.durable)
+	} else {
+		f.inode.unsynced = append(f.inode.unsynced, w)
+	}
+}
+
+// Read is the only call that returns short reads, like read(2) it may
+// return fewer bytes than asked for without an error
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	if n > 1 && f.fs.fault(f.fs.faults.ShortRead, &f.fs.fired.ShortRead) {
+		n = 1 + f.fs.rng.Intn(n-1)
+	}
+
+	if n > 0 {
+		err = nil
+	}
+
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt promises a full read, a short read surfaces as io.ErrUnexpectedEOF
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	n, err := f.readAt(p, off)
+	if err == nil && n > 1 && f.fs.fault(f.fs.faults.ShortRead, &f.fs.fired.ShortRead) {
+		return 1 + f.fs.rng.Intn(n-1), io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+
+	if off >= int64(len(f.inode.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.inode.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+
+	f.fs.mu.Lock()
+	f.offset += int64(n)
+	f.fs.mu.Unlock()
+
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &fs.PathError{Op: "write", Err: syscall.EBADF}
+	}
+
+	w := memWrite{off: off, data: slices.Clone(p)}
+
+	crash, err := f.tick()
+	if crash {
+		// the power went out part way through, only some sectors may have made it
+		f.inode.unsynced = append(f.inode.unsynced, f.fs.tear(w))
+		return 0, err
+	} else if err != nil {
+		return 0, err
+	}
+
+	if off+int64(len(p)) > int64(len(f.inode.data)) && f.fs.fault(f.fs.faults.ENOSPC, &f.fs.fired.ENOSPC) {
+		return 0, &fs.PathError{Op: "write", Err: syscall.ENOSPC}
+	}
+
+	f.write(w)
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.inode.data))
+	}
+
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Err: syscall.EINVAL}
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if _, err := f.tick(); err != nil {
+		return err
+	}
+
+	if len(f.inode.unsynced) > 0 && f.fs.fault(f.fs.faults.SyncEIO, &f.fs.fired.SyncEIO) {
+		// the dirty pages are marked clean anyway, see: fsyncgate
+		f.inode.unsynced = nil
+		return &fs.PathError{Op: "sync", Err: syscall.EIO}
+	}
+
+	for _, w := range f.inode.unsynced {
+		f.inode.durable = w.apply(f.inode.durable)
+	}
+	f.inode.unsynced = nil
+
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if _, err := f.tick(); err != nil {
+		return err
+	}
+
+	f.write(memWrite{off: size})
+	return nil
+}
+
+// PunchHole zeroes the range within the file like fallocate(2) would, it's
+// a write of zeros so an unsynced hole meets the same fate as any other write
+func (f *memFile) PunchHole(offset, length int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if _, err := f.tick(); err != nil {
+		return err
+	}
+
+	length = min(length, int64(len(f.inode.data))-offset)
+	if length > 0 {
+		f.write(memWrite{off: offset, data: make([]byte, length)})
+	}
+
+	return nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+
+	return int64(len(f.inode.data)), nil
+}
+
+func (f *memFile) Close() error {
+	return f.Unlock()
+}
+
+func (f *memFile) Lock(exclusive bool) error {
+	m := f.fs
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+
+	f.unlock()
+	inode := f.inode
+
+	switch {
+	case inode.exclusive != nil, exclusive && inode.shared > 0:
+		return ErrLocked
+	case exclusive:
+		inode.exclusive, f.lock = f, MEM_EXCLUSIVE
+	default:
+		inode.shared, f.lock = inode.shared+1, MEM_SHARED
+	}
+
+	return nil
+}
+
+func (f *memFile) Unlock() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	f.unlock()
+	return nil
+}
+
+func (f *memFile) unlock() {
+	// locks from before a restart are already gone
+	if f.epoch != f.fs.epoch {
+		return
+	}
+
+	switch f.lock {
+	case MEM_SHARED:
+		f.inode.shared--
+	case MEM_EXCLUSIVE:
+		f.inode.exclusive = nil
+	}
+
+	f.lock = MEM_UNLOCKED
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFSLostUnsyncedWrites(t *testing.T) {
+	fs := NewMemFS(1, Faults{LostWrite: 1})
+
+	f, err := fs.OpenFile("db", os.O_CREATE|os.O_RDWR, 0644)
+	assert.NoError(t, err)
+
+	_, _ = f.Write([]byte("synced"))
+	assert.NoError(t, f.Sync())
+	_, _ = f.Write([]byte(" and lost"))
+
+	size, _ := f.Size()
+	assert.Equal(t, int64(15), size)
+
+	fs.Crash()
+	_, err = f.Write([]byte("!"))
+	assert.Equal(t, errCrashed, err)
+
+	fs.Restart()
+
+	// handles from before the crash stay dead
+	_, err = f.Size()
+	assert.Equal(t, errCrashed, err)
+
+	f, _ = fs.OpenFile("db", os.O_RDWR, 0644)
+	buf, _ := io.ReadAll(f)
+	assert.Equal(t, "synced", string(buf))
+}
+
+func TestMemFSDSyncWritesAreDurable(t *testing.T) {
+	fs := NewMemFS(1, Faults{LostWrite: 1})
+
+	f, _ := fs.OpenFile("db", os.O_CREATE|os.O_RDWR|syscall.O_DSYNC, 0644)
+	_, _ = f.Write([]byte("durable"))
+
+	fs.Crash()
+	fs.Restart()
+
+	f, _ = fs.OpenFile("db", os.O_RDWR, 0644)
+	buf, _ := io.ReadAll(f)
+	assert.Equal(t, "durable", string(buf))
+}
+
+func TestMemFSTornWriteAtCrash(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		fs := NewMemFS(seed, Faults{})
+
+		f, _ := fs.OpenFile("db", os.O_CREATE|os.O_RDWR|syscall.O_DSYNC, 0644)
+		_, _ = f.WriteAt(make([]byte, 4*MEM_SECTOR_SIZE), 0)
+
+		fs.CrashAfter(1)
+		page := make([]byte, 4*MEM_SECTOR_SIZE)
+		for i := range page {
+			page[i] = 0xff
+		}
+
+		_, err := f.WriteAt(page, 0)
+		assert.Equal(t, errCrashed, err)
+		fs.Restart()
+
+		f, _ = fs.OpenFile("db", os.O_RDONLY, 0)
+		buf := make([]byte, 4*MEM_SECTOR_SIZE)
+		_, _ = f.ReadAt(buf, 0)
+
+		// a prefix of whole sectors made it, the rest is the old contents
+		torn := 0
+		for torn < len(buf) && buf[torn] == 0xff {
+			torn++
+		}
+
+		assert.Zero(t, torn%MEM_SECTOR_SIZE, "seed %v", seed)
+		assert.Less(t, torn, len(buf), "seed %v", seed)
+		assert.Equal(t, make([]byte, len(buf)-torn), buf[torn:], "seed %v", seed)
+	}
+}
+
+func TestMemFSSyncEIODropsWrites(t *testing.T) {
+	fs := NewMemFS(1, Faults{SyncEIO: 1})
+
+	f, _ := fs.OpenFile("db", os.O_CREATE|os.O_RDWR, 0644)
+	_, _ = f.Write([]byte("gone"))
+
+	err := f.Sync()
+	assert.True(t, errors.Is(err, syscall.EIO))
+
+	// the page cache still has the write, the disk never will
+	buf := make([]byte, 4)
+	_, _ = f.ReadAt(buf, 0)
+	assert.Equal(t, "gone", string(buf))
+
+	fs.Crash()
+	fs.Restart()
+
+	f, _ = fs.OpenFile("db", os.O_RDONLY, 0)
+	size, _ := f.Size()
+	assert.Zero(t, size)
+	assert.Equal(t, FaultCounts{SyncEIO: 1}, fs.Fired())
+}
+
+func TestMemFSShortReadsAndENOSPC(t *testing.T) {
+	fs := NewMemFS(1, Faults{ShortRead: 1})
+
+	f, _ := fs.OpenFile("db", os.O_CREATE|os.O_RDWR, 0644)
+	_, _ = f.Write(make([]byte, 100))
+	_, _ = f.Seek(0, io.SeekStart)
+
+	n, err := f.Read(make([]byte, 100))
+	assert.NoError(t, err)
+	assert.Less(t, n, 100)
+
+	_, _ = f.Seek(0, io.SeekStart)
+	_, err = io.ReadFull(f, make([]byte, 100))
+	assert.NoError(t, err)
+
+	_, err = f.ReadAt(make([]byte, 100), 0)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	fs = NewMemFS(1, Faults{ENOSPC: 1})
+	f, _ = fs.OpenFile("db", os.O_CREATE|os.O_RDWR, 0644)
+
+	_, err = f.Write([]byte("grow"))
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+}
+
+func TestMemFSReplaysFromSeed(t *testing.T) {
+	run := func() []byte {
+		fs := NewMemFS(42, Faults{TornWrite: 0.5, LostWrite: 0.3})
+		f, _ := fs.OpenFile("db", os.O_CREATE|os.O_RDWR, 0644)
+
+		for i := 0; i < 20; i++ {
+			_, _ = f.WriteAt(make([]byte, MEM_SECTOR_SIZE*3), int64(i*MEM_SECTOR_SIZE))
+			_, _ = f.WriteAt([]byte{byte(i)}, int64(i*700))
+		}
+
+		fs.Crash()
+		fs.Restart()
+
+		f, _ = fs.OpenFile("db", os.O_RDONLY, 0)
+		buf, _ := io.ReadAll(f)
+		return buf
+	}
+
+	assert.Equal(t, run(), run())
+}
+
+func TestMemFSLocks(t *testing.T) {
+	fs := NewMemFS(1, Faults{})
+
+	a, _ := fs.OpenFile("db", os.O_CREATE|os.O_RDWR, 0644)
+	b, _ := fs.OpenFile("db", os.O_RDWR, 0644)
+
+	assert.NoError(t, a.Lock(false))
+	assert.NoError(t, b.Lock(false))
+	assert.Equal(t, ErrLocked, b.Lock(true), "a still shares it")
+
+	assert.NoError(t, a.Close())
+	assert.NoError(t, b.Lock(true))
+	assert.Equal(t, ErrLocked, a.Lock(false))
+
+	// a crash takes the holder down with it
+	fs.Crash()
+	fs.Restart()
+
+	a, _ = fs.OpenFile("db", os.O_RDWR, 0644)
+	assert.NoError(t, a.Lock(true))
+
+	// unlocking a handle from before the restart can't free a's lock
+	assert.NoError(t, b.Unlock())
+	c, _ := fs.OpenFile("db", os.O_RDWR, 0644)
+	assert.Equal(t, ErrLocked, c.Lock(false))
+}
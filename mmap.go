@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"syscall"
+)
+
+// errMapFault is a read of the mapping past the end of a file another process cut short
+var errMapFault = errors.New("the datafile was truncated under the memory map")
+
+// mmapReader serves pages as slices of a read only, shared mapping of the datafile.
+// writes still go through the file, the page cache keeps the two in step. the
+// mapping covers the file up to MmapSize and is replaced by a bigger one as the
+// file grows, the old one stays mapped until Close so pages that point into it
+// stay readable. a truncate only lowers the end pages are served up to, what's
+// cut off is free pages nobody reads.
+// see: https://www.sqlite.org/mmap.html
+type mmapReader struct {
+	// held for reading while a page is sliced out, remapping takes it exclusively
+	mu    sync.RWMutex
+	fd    int
+	limit int64 // MmapSize
+	// the current mapping, it may reach past the end of the file
+	data []byte
+	// bytes of data the file was last seen to cover
+	size int64
+	// mappings data replaced, unmapped by close
+	retired [][]byte
+}
+
+// fdFile is a file with a descriptor that can be mapped, *os.File is one
+type fdFile interface {
+	Fd() uintptr
+}
+
+func newMmapReader(datafile File, limit int64) (*mmapReader, error) {
+	f, ok := datafile.(fdFile)
+	if !ok {
+		return nil, fmt.Errorf("MmapSize needs a file with a descriptor, %T has none", datafile)
+	}
+
+	return &mmapReader{fd: int(f.Fd()), limit: limit}, nil
+}
+
+// page returns the encoded page at offset as a slice of the mapping, false if
+// it's past the mapping. the slice is read only, writing to it faults
+func (m *mmapReader) page(offset int64, pageSize int) ([]byte, bool) {
+	end := offset + int64(pageSize)
+	if m == nil || end > m.limit {
+		return nil, false
+	}
+
+	m.mu.RLock()
+	if end > m.size {
+		// the file may have grown since it was last looked at
+		m.mu.RUnlock()
+		if err := m.grow(end); err != nil {
+			return nil, false
+		}
+		m.mu.RLock()
+	}
+	defer m.mu.RUnlock()
+
+	if end > m.size {
+		return nil, false
+	}
+
+	return m.data[offset:end:end], true
+}
+
+// guard runs f with a fault on the mapping turned into errMapFault. another process
+// may have truncated the file under it (a compaction of the writer a read only open
+// shares it with), reading the cut off end faults instead of returning
+func (m *mmapReader) guard(f func() error) (err error) {
+	if m == nil {
+		return f()
+	}
+
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		// faults panic with a runtime.Error that has the address, anything else isn't ours
+		if _, ok := r.(interface{ Addr() uintptr }); !ok {
+			panic(r)
+		}
+
+		// the file is looked at again before the next page is served
+		m.mu.Lock()
+		m.size = 0
+		m.mu.Unlock()
+
+		err = errMapFault
+	}()
+
+	return f()
+}
+
+// grow looks at the size of the file again, the mapping is replaced by one twice
+// as big (capped at the limit) if the file outgrew it
+func (m *mmapReader) grow(need int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.size >= need {
+		return nil
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(m.fd, &stat); err != nil {
+		return err
+	}
+
+	size := min(stat.Size, m.limit)
+	if size < need {
+		return nil
+	}
+
+	if size > int64(len(m.data)) {
+		length := min(max(size, 2*int64(len(m.data))), m.limit)
+
+		data, err := syscall.Mmap(m.fd, 0, int(length), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return os.NewSyscallError("mmap", err)
+		}
+
+		if m.data != nil {
+			m.retired = append(m.retired, m.data)
+		}
+		m.data = data
+	}
+
+	m.size = min(size, int64(len(m.data)))
+	return nil
+}
+
+// truncate cuts datafile down to size. no page is served from the end that's gone,
+// the mapping stays so the pages served from below it stay readable
+func (m *mmapReader) truncate(datafile File, size int64) error {
+	if m == nil {
+		return datafile.Truncate(size)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.size = min(m.size, size)
+	return datafile.Truncate(size)
+}
+
+// mapped is the length of the current mapping
+func (m *mmapReader) mapped() int {
+	if m == nil {
+		return 0
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.data)
+}
+
+// close unmaps the mapping and the ones it replaced, no page served from them may
+// be read after
+func (m *mmapReader) close() error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	for _, data := range append(m.retired, m.data) {
+		if data == nil {
+			continue
+		}
+
+		if err := syscall.Munmap(data); err != nil {
+			errs = append(errs, os.NewSyscallError("munmap", err))
+		}
+	}
+
+	m.data, m.size, m.retired = nil, 0, nil
+	return errors.Join(errs...)
+}
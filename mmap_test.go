@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMmapReadPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	opts := &Options{MaxDegree: 8, CreateIfMissing: true, BufferPoolSize: -1, MmapSize: 1 << 24}
+
+	db, err := Open(path, opts)
+	assert.NoError(t, err)
+
+	for k := 0; k < 50; k++ {
+		assert.NoError(t, db.Insert(k, encodeKey(k)))
+	}
+	assert.NoError(t, db.Checkpoint())
+
+	root := int(db.storeManager.header.RootPage)
+	page, err := db.FetchPage(root)
+	assert.NoError(t, err)
+
+	// the page is a slice of the mapping, not a copy
+	offset, _ := page.MapToOffset()
+	mapped := db.mmap.data
+	assert.Equal(t, unsafe.Pointer(&mapped[offset]), unsafe.Pointer(&page.buf[0]))
+
+	onDisk, _ := openPage(root, PAGE_SIZE, db.pageStart, nil, db.datafile)
+	assert.Equal(t, onDisk.Keys(), page.Keys())
+
+	// the file grows past the mapping, it's remapped on the next fetch
+	before := db.mmap.mapped()
+	for k := 50; k < 2000; k++ {
+		assert.NoError(t, db.Insert(k, encodeKey(k)))
+	}
+	assert.NoError(t, db.Checkpoint())
+
+	last := int(db.storeManager.header.PageCount)
+	_, err = db.FetchPage(last)
+	assert.NoError(t, err)
+	assert.Greater(t, db.mmap.mapped(), before)
+
+	// pages handed out before the remap stay readable, the old mapping is kept
+	assert.Equal(t, [][]byte{mapped}, db.mmap.retired)
+	assert.Equal(t, onDisk.Keys(), page.Keys())
+	db.Close()
+	assert.Nil(t, db.mmap.retired)
+
+	// the tree loads through the mapping
+	db, err = Open(path, opts)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, 2000, db.tree.Len())
+	value, _ := db.Get(1999)
+	assert.Equal(t, encodeKey(1999), value)
+}
+
+func TestMmapPastTheLimit(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), &Options{MaxDegree: 8, CreateIfMissing: true, BufferPoolSize: -1, MmapSize: PAGE_ALIGNMENT + 2*PAGE_SIZE})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	for k := 0; k < 500; k++ {
+		assert.NoError(t, db.Insert(k, encodeKey(k)))
+	}
+	assert.NoError(t, db.Checkpoint())
+
+	// pages past MmapSize are read with syscalls
+	for id := 1; id <= int(db.storeManager.header.PageCount); id++ {
+		_, err := db.FetchPage(id)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, PAGE_ALIGNMENT+2*PAGE_SIZE, db.mmap.mapped())
+}
+
+func TestMmapNeedsADescriptor(t *testing.T) {
+	_, err := Open("db", &Options{FS: NewMemFS(1, Faults{}), CreateIfMissing: true, MmapSize: 1 << 20})
+	assert.ErrorContains(t, err, "MmapSize")
+}
+
+// a compaction cuts free pages off the end under the mapping, the pool forgets
+// them and the pages below stay readable
+func TestMmapCompact(t *testing.T) {
+	db, _ := shrunkDB(t, &Options{MmapSize: 1 << 24})
+	defer db.Close()
+
+	var pages []Page
+	for id := 1; id <= int(db.storeManager.header.PageCount); id++ {
+		page, err := db.FetchPage(id)
+		assert.NoError(t, err)
+		pages = append(pages, page)
+	}
+
+	assert.NoError(t, db.Compact(nil))
+	last := int(db.storeManager.header.PageCount)
+	assert.Less(t, last, len(pages))
+
+	for id := last + 1; id <= len(pages); id++ {
+		_, ok := db.storeManager.pool.get(uint32(id))
+		assert.False(t, ok, "page %v is cut off", id)
+	}
+
+	for _, page := range pages[:last] {
+		_, err := decodePage(page.buf)
+		assert.NoError(t, err)
+	}
+
+	for id := 1; id <= last; id++ {
+		_, err := db.FetchPage(id)
+		assert.NoError(t, err)
+	}
+}
+
+// another process truncating the file under a mapping, reading the cut off end
+// faults and falls back to a syscall that finds the file truncated
+func TestMmapTruncatedUnderneath(t *testing.T) {
+	db, path := shrunkDB(t, &Options{BufferPoolSize: -1, MmapSize: 1 << 24})
+	defer db.Close()
+
+	last := int(db.storeManager.header.PageCount)
+	_, err := db.FetchPage(last)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.Truncate(path, db.pageStart+PAGE_SIZE))
+
+	_, err = db.FetchPage(last)
+	assert.ErrorContains(t, err, "truncated datafile")
+
+	_, err = db.FetchPage(1)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Options configures a DB, the zero value of a field means it's default.
+// PageSize, MaxDegree and Comparator decide the on-disk format, they are recorded
+// in the file header when the datafile is created and checked on every reopen.
+// the rest only apply to the process that opens the file.
+type Options struct {
+	// bytes per page, a power of two from MIN_PAGE_SIZE to MAX_PAGE_SIZE. larger
+	// pages suit SSDs with 16KiB pages and larger values, the value limit grows with
+	// them see: overflowThreshold. zero takes the one recorded in an existing
+	// datafile or PAGE_SIZE for a new one
+	PageSize int
+	// the degree of the tree, a full node has to fit a page so the value limit
+	// shrinks as it grows. zero takes the one recorded in an existing datafile
+	// or DEFAULT_DEGREE for a new one
+	MaxDegree int
+	// the order of keys, one of COMPARATORS. empty takes the one recorded in an
+	// existing datafile or DEFAULT_COMPARATOR for a new one
+	Comparator string
+	// what leaf pages are compressed with, "none" or "lz4". it's recorded in the
+	// file header, empty takes the one of an existing datafile or none for a new one.
+	// a compressed page keeps it's slot but only takes up it's compressed size, the
+	// rest is punched out of the file (linux). filesystems free whole blocks so it
+	// pays off with pages larger than a block, see: PageSize
+	Compression string
+	// encrypts every page with AES-GCM, nil leaves the datafile in the clear. the
+	// header records the generation of the key and a check value of it, a wrong
+	// key fails Open with ErrEncryptionKey. see: DB.Rekey
+	Keys KeyProvider
+
+	SyncMode SyncMode
+	// how often SYNC_INTERVAL syncs, one second by default
+	SyncInterval time.Duration
+
+	// pages FetchPage keeps cached, DEFAULT_POOL_PAGES by default and none if negative
+	BufferPoolSize int
+	// how many pages a checkpoint writes at once, DEFAULT_CHECKPOINT_WRITERS by
+	// default. 1 writes them in order, which keeps a MemFS run reproducible
+	CheckpointWriters int
+
+	// bytes of the datafile FetchPage reads through a read only memory map, pages
+	// are served as slices of it without a copy. a remap keeps the old mapping until
+	// Close so a page stays readable until then, see: DB.FetchPage. pages past it
+	// are read with syscalls. 0 turns mmap off, the default
+	MmapSize int64
+	// open the datafile with O_DIRECT (linux only) so pages aren't cached twice, in
+	// the page cache and the buffer pool. SYNC_ALWAYS then fdatasyncs at the end of
+	// each checkpoint step instead of opening with O_DSYNC. it can't be combined with
+	// MmapSize, the mapping reads through the page cache
+	DirectIO bool
+
+	// open the datafile for reading only, every write fails with ErrReadOnly.
+	// read only opens run alongside the one read write open, which holds the lock
+	// file next to the datafile (see: lockPath) so a second writer is kept out.
+	// a reader loads the last checkpoint and doesn't see the ones after it
+	ReadOnly bool
+	// how long Open waits for a conflicting lock to go away, by default it
+	// fails with ErrLocked straight away
+	LockTimeout time.Duration
+	// create the datafile if it doesn't exist, otherwise Open fails
+	CreateIfMissing bool
+	// fail if the datafile already exists
+	ErrorIfExists bool
+	// permissions of a new datafile, 0644 by default
+	FileMode os.FileMode
+
+	// what to do when a page fails it's checksum on read, FAIL_ON_CORRUPTION by
+	// default. it applies to Open too: with QUARANTINE_CORRUPTION a corrupt page of
+	// the tree loads as an empty leaf, see: DB.Quarantined
+	OnCorruption CorruptionPolicy
+
+	// where warnings go, e.g a quarantined page. log.Default() by default
+	Logger Logger
+	// the filesystem holding the datafile, OSFS by default
+	FS VFS
+}
+
+// Logger is satisfied by *log.Logger
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+type SyncMode uint8
+
+const (
+	// every write waits for the disk (O_DSYNC), the default. a crash never loses a
+	// checkpoint that returned
+	SYNC_ALWAYS SyncMode = iota
+	// a checkpoint's pages are still synced before it's header is written but the
+	// header is synced in the background every SyncInterval, a crash loses at most
+	// the last interval and never tears a checkpoint
+	SYNC_INTERVAL
+	// leave the header to the OS, the next checkpoint syncs it before reusing the
+	// pages it freed so a crash loses the last checkpoint but never tears one
+	SYNC_NEVER
+)
+
+// DEFAULT_COMPARATOR orders keys as signed 64 bit integers, pages rely on it:
+// the prefix truncation of cells and the separators are computed on encodeKey
+// which sorts the same way. the other orders store their keys so they sort
+// this way too, see: keyOrder
+const DEFAULT_COMPARATOR = "int64"
+
+// COMPARATORS are the key orders a datafile can be created with by name, the
+// name is recorded in the file header so a file is never read in another order
+var COMPARATORS = map[string]keyOrder{
+	DEFAULT_COMPARATOR: 0,
+	// descending signed integers
+	"int64-desc": -1,
+	// unsigned integers, negative keys sort after the positive ones
+	"uint64":      math.MinInt,
+	"uint64-desc": math.MaxInt,
+}
+
+// the largest degree where a leaf full of maximum sized values still fits a page
+const DEFAULT_DEGREE = 16
+
+const DEFAULT_POOL_PAGES = 1024
+
+const DEFAULT_CHECKPOINT_WRITERS = 8
+
+const DEFAULT_SYNC_INTERVAL = time.Second
+
+// how often Open retries a lock within the LockTimeout
+const LOCK_RETRY_INTERVAL = 10 * time.Millisecond
+
+// how many times a read only open loads the tree again when a writer
+// checkpointed while it was being read
+const READ_ONLY_RELOADS = 8
+
+var errDirectIOUnsupported = errors.New("direct I/O is only supported on linux")
+
+// DefaultOptions opens a datafile creating it if it's missing
+func DefaultOptions() *Options {
+	return &Options{CreateIfMissing: true}
+}
+
+// withDefaults fills in the zero fields, PageSize and MaxDegree are left alone
+// since zero means whatever the datafile says
+func (o Options) withDefaults() Options {
+	if o.SyncInterval == 0 {
+		o.SyncInterval = DEFAULT_SYNC_INTERVAL
+	}
+
+	if o.BufferPoolSize == 0 {
+		o.BufferPoolSize = DEFAULT_POOL_PAGES
+	}
+
+	if o.CheckpointWriters == 0 {
+		o.CheckpointWriters = DEFAULT_CHECKPOINT_WRITERS
+	}
+
+	if o.FileMode == 0 {
+		o.FileMode = 0644
+	}
+
+	if o.Logger == nil {
+		o.Logger = log.Default()
+	}
+
+	if o.FS == nil {
+		o.FS = OSFS
+	}
+
+	return o
+}
+
+func (o Options) validate() error {
+	if o.PageSize != 0 {
+		if err := validPageSize(o.PageSize); err != nil {
+			return err
+		}
+	}
+
+	if o.MaxDegree != 0 && o.MaxDegree < 3 {
+		return fmt.Errorf("a degree of %v is below the minimum of 3", o.MaxDegree)
+	}
+
+	if _, ok := COMPARATORS[o.Comparator]; o.Comparator != "" && !ok {
+		return fmt.Errorf("unknown comparator %q", o.Comparator)
+	}
+
+	if o.Compression != "" {
+		if _, err := parseCodec(o.Compression); err != nil {
+			return err
+		}
+	}
+
+	if o.OnCorruption > QUARANTINE_CORRUPTION {
+		return fmt.Errorf("unknown corruption policy %v", o.OnCorruption)
+	}
+
+	if o.SyncMode > SYNC_NEVER {
+		return fmt.Errorf("unknown sync mode %v", o.SyncMode)
+	}
+
+	if o.SyncInterval < 0 || o.LockTimeout < 0 || o.MmapSize < 0 || o.CheckpointWriters < 0 {
+		return errors.New("the sync interval, lock timeout, mmap size and checkpoint writers can't be negative")
+	}
+
+	if o.DirectIO && !DIRECT_IO_SUPPORTED {
+		return errDirectIOUnsupported
+	}
+
+	if o.DirectIO && o.MmapSize > 0 {
+		return errors.New("DirectIO bypasses the page cache the memory map reads from, MmapSize can't be set")
+	}
+
+	if o.ReadOnly && o.ErrorIfExists {
+		return errors.New("a read only open needs an existing datafile, ErrorIfExists can't be set")
+	}
+
+	return nil
+}
+
+// checkHeader compares the format options against a datafile's header
+func (o Options) checkHeader(h fileHeader) error {
+	if o.PageSize != 0 && int(h.PageSize) != o.PageSize {
+		return fmt.Errorf("datafile uses %v byte pages, the options say %v", h.PageSize, o.PageSize)
+	}
+
+	if o.MaxDegree != 0 && int(h.MaxDegree) != o.MaxDegree {
+		return fmt.Errorf("datafile has a degree of %v, the options say %v", h.MaxDegree, o.MaxDegree)
+	}
+
+	comparator := h.comparator()
+	if _, ok := COMPARATORS[comparator]; !ok {
+		return fmt.Errorf("datafile keys are ordered by %q, an unknown comparator", comparator)
+	}
+
+	if o.Comparator != "" && comparator != o.Comparator {
+		return fmt.Errorf("datafile keys are ordered by %q, the options say %q", comparator, o.Comparator)
+	}
+
+	return nil
+}
+
+// comparator is the Comparator of a new datafile
+func (o Options) comparator() string {
+	if o.Comparator == "" {
+		return DEFAULT_COMPARATOR
+	}
+
+	return o.Comparator
+}
+
+// codec is the parsed Compression, none if it's empty
+func (o Options) codec() Codec {
+	codec, _ := parseCodec(o.Compression)
+	return codec
+}
+
+// comparator reads the name recorded in the header, files from before it was
+// recorded use the default
+func (h fileHeader) comparator() string {
+	if name := strings.TrimRight(string(h.Comparator[:]), "\x00"); name != "" {
+		return name
+	}
+
+	return DEFAULT_COMPARATOR
+}
+
+// lockFile retries f.Lock until it succeeds or the timeout runs out
+func lockFile(f File, exclusive bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := f.Lock(exclusive)
+		if !errors.Is(err, ErrLocked) || !time.Now().Before(deadline) {
+			return err
+		}
+
+		time.Sleep(LOCK_RETRY_INTERVAL)
+	}
+}
+
+// lockPath is the file a writer locks, readers only share a lock on the datafile
+// so it can't be the datafile itself
+func lockPath(path string) string {
+	return path + ".lock"
+}
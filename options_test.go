@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+
+	_, err := Open(path, &Options{})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	for _, opts := range []Options{{PageSize: 3000}, {PageSize: MAX_PAGE_SIZE * 2}, {MaxDegree: 2}, {Comparator: "bytes"}, {SyncMode: 7}} {
+		opts.CreateIfMissing = true
+		_, err = Open(path, &opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+
+	db, err := Open(path, &Options{MaxDegree: 5, CreateIfMissing: true, FileMode: 0600})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Insert(1, value))
+	assert.NoError(t, db.Checkpoint())
+	db.Close()
+
+	info, _ := os.Stat(path)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	_, err = Open(path, &Options{CreateIfMissing: true, ErrorIfExists: true})
+	assert.ErrorIs(t, err, os.ErrExist)
+
+	// the format options are checked against the header
+	_, err = Open(path, &Options{MaxDegree: 6})
+	assert.ErrorContains(t, err, "degree of 5")
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, db.tree.maxDegree)
+	db.Close()
+
+	// OpenDB keeps the degree of an existing file
+	db, err = OpenDB(path, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, db.tree.maxDegree)
+	db.Close()
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+
+	_, err := Open(path, &Options{ReadOnly: true})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	db, _ := OpenDB(path, 4)
+	assert.NoError(t, db.Insert(1, value))
+	assert.NoError(t, db.Checkpoint())
+	db.Close()
+
+	db, err = Open(path, &Options{ReadOnly: true})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	got, err := db.Get(1)
+	assert.NoError(t, err)
+	assert.Equal(t, value, got)
+
+	assert.ErrorIs(t, db.Insert(2, value), ErrReadOnly)
+	assert.ErrorIs(t, db.Delete(1), ErrReadOnly)
+	assert.ErrorIs(t, db.Checkpoint(), ErrReadOnly)
+	assert.ErrorIs(t, db.Begin().Commit(), ErrReadOnly)
+	assert.Nil(t, db.Poisoned())
+}
+
+// a header written before the comparator was recorded reads as the default
+func TestHeaderWithoutComparator(t *testing.T) {
+	// the fields added after the checksum
+	h := fileHeader{}
+	later := len(h.Comparator) + binary.Size(h.Codec) + len(h.KeyCheck) + binary.Size(h.KeyGeneration) + binary.Size(h.PageStart)
+	assert.Equal(t, HEADER_CHECKSUM_OFFSET, binary.Size(h)-4-later)
+
+	path := filepath.Join(t.TempDir(), "db")
+	db, _ := OpenDB(path, 4)
+	db.storeManager.header.Comparator = [16]byte{}
+	assert.NoError(t, db.storeManager.WriteHeader())
+	db.Close()
+
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DEFAULT_COMPARATOR, db.storeManager.header.comparator())
+
+	// keys ordered any other way can't be read
+	copy(db.storeManager.header.Comparator[:], "bytes")
+	assert.NoError(t, db.storeManager.WriteHeader())
+	db.Close()
+
+	_, err = Open(path, nil)
+	assert.ErrorContains(t, err, `ordered by "bytes"`)
+}
+
+// a header written before the page area was aligned has it's pages right after it
+func TestHeaderWithoutPageStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, _ := OpenDB(path, 4)
+	assert.Equal(t, int64(PAGE_ALIGNMENT), db.pageStart)
+
+	db.storeManager.header.PageStart = 0
+	assert.NoError(t, db.storeManager.WriteHeader())
+	db.Close()
+
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(FILE_HEADER_SIZE), db.pageStart)
+
+	for k := 0; k < 100; k++ {
+		assert.NoError(t, db.Insert(k, value))
+	}
+	assert.NoError(t, db.Checkpoint())
+	root, pages := db.storeManager.header.RootPage, db.storeManager.header.PageCount
+	db.Close()
+
+	info, _ := os.Stat(path)
+	assert.Equal(t, FILE_HEADER_SIZE+int64(pages)*PAGE_SIZE, info.Size())
+
+	datafile, _ := OSFS.OpenFile(path, os.O_RDONLY, 0)
+	_, err = FetchPage(int(root), PAGE_SIZE, datafile)
+	assert.NoError(t, err)
+	datafile.Close()
+
+	report, err := CheckFile(path, false, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Empty(t, report.Warnings)
+	assert.Equal(t, 100, report.Keys)
+}
+
+// every order survives a reopen, range reads, prefixes and the checker follow it
+func TestComparators(t *testing.T) {
+	keys := []int{math.MinInt, -300, -2, -1, 0, 1, 2, 300, math.MaxInt}
+
+	orders := map[string]func(a, b int) int{
+		"int64":       func(a, b int) int { return cmp.Compare(a, b) },
+		"int64-desc":  func(a, b int) int { return cmp.Compare(b, a) },
+		"uint64":      func(a, b int) int { return cmp.Compare(uint64(a), uint64(b)) },
+		"uint64-desc": func(a, b int) int { return cmp.Compare(uint64(b), uint64(a)) },
+	}
+	assert.Len(t, COMPARATORS, len(orders))
+
+	for name, compare := range orders {
+		path := filepath.Join(t.TempDir(), "db")
+		db, err := Open(path, &Options{MaxDegree: 3, CreateIfMissing: true, Comparator: name})
+		assert.NoError(t, err)
+
+		for _, k := range keys {
+			assert.NoError(t, db.Insert(k, []byte(strconv.Itoa(k))))
+		}
+		assert.NoError(t, db.Close())
+
+		other := DEFAULT_COMPARATOR
+		if name == other {
+			other = "uint64"
+		}
+
+		_, err = Open(path, &Options{Comparator: other})
+		assert.ErrorContains(t, err, fmt.Sprintf("ordered by %q", name))
+
+		db, err = Open(path, nil)
+		assert.NoError(t, err)
+		tree := db.tree
+
+		want := slices.Clone(keys)
+		slices.SortFunc(want, compare)
+
+		var scanned []int
+		tree.Scan(want[0], len(want), func(key int, value []byte) {
+			assert.Equal(t, strconv.Itoa(key), string(value))
+			scanned = append(scanned, key)
+		})
+		assert.Equal(t, want, scanned, name)
+		assert.Equal(t, want[2:6], tree.Range(want[2], want[6]), name)
+		assert.Equal(t, 4, tree.CountRange(want[2], want[6]), name)
+
+		first, _ := tree.Min()
+		last, _ := tree.Max()
+		assert.Equal(t, []int{want[0], want[len(want)-1]}, []int{first, last}, name)
+
+		higher, _ := tree.Higher(want[3])
+		assert.Equal(t, want[4], higher, name)
+		selected, _ := tree.Select(3)
+		assert.Equal(t, want[3], selected, name)
+		assert.Equal(t, 3, tree.Rank(want[3]), name)
+
+		// the prefix is of encodeKey whatever the order
+		assert.ElementsMatch(t, []int{0, 1, 2, 300}, tree.ScanPrefix(encodeKey(0)[:6]), name)
+
+		value, err := db.Get(math.MinInt)
+		assert.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(math.MinInt), string(value))
+
+		report, err := db.Check()
+		assert.NoError(t, err)
+		assert.Empty(t, report.Errors, name)
+		db.Close()
+	}
+}
+
+func TestSyncModes(t *testing.T) {
+	tests := []struct {
+		mode    SyncMode
+		close   bool
+		durable bool
+	}{
+		{SYNC_ALWAYS, false, true},
+		{SYNC_NEVER, false, false},
+		{SYNC_INTERVAL, false, false},
+		{SYNC_INTERVAL, true, true}, // close syncs the last interval
+	}
+
+	for _, tt := range tests {
+		fs := NewMemFS(1, Faults{LostWrite: 1})
+		opts := &Options{FS: fs, MaxDegree: 4, CreateIfMissing: true, SyncMode: tt.mode, SyncInterval: time.Hour}
+
+		db, err := Open("db", opts)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Insert(1, value))
+		assert.NoError(t, db.Checkpoint())
+
+		if tt.close {
+			assert.NoError(t, db.Close())
+		}
+
+		fs.Crash()
+		fs.Restart()
+
+		// without a sync the header of the checkpoint never reached the disk
+		db, err = Open("db", &Options{FS: fs})
+		assert.NoError(t, err, "mode %v", tt.mode)
+
+		want := 0
+		if tt.durable {
+			want = 1
+		}
+
+		assert.Equal(t, want, db.tree.Len(), "mode %v", tt.mode)
+	}
+}
+
+// the lazy modes only leave the last header to the OS, the pages of a checkpoint
+// are synced before it and so is the header of the one before
+func TestLazySyncKeepsTheBarrier(t *testing.T) {
+	for _, mode := range []SyncMode{SYNC_INTERVAL, SYNC_NEVER} {
+		fs := NewMemFS(1, Faults{LostWrite: 1})
+		db, err := Open("db", &Options{FS: fs, MaxDegree: 4, CreateIfMissing: true, SyncMode: mode, SyncInterval: time.Hour})
+		assert.NoError(t, err)
+
+		for k := 0; k < 50; k++ {
+			assert.NoError(t, db.Insert(k, value))
+		}
+		assert.NoError(t, db.Checkpoint())
+
+		assert.NoError(t, db.Insert(50, value))
+		assert.NoError(t, db.Checkpoint())
+
+		fs.Crash()
+		fs.Restart()
+
+		db, err = Open("db", &Options{FS: fs, ReadOnly: true})
+		assert.NoError(t, err, "mode %v", mode)
+		assert.Equal(t, 50, db.tree.Len(), "mode %v", mode)
+
+		report, err := db.Check()
+		assert.NoError(t, err)
+		assert.Empty(t, report.Errors, "mode %v", mode)
+		db.Close()
+	}
+}
+
+func TestSyncIntervalSyncsInTheBackground(t *testing.T) {
+	fs := NewMemFS(1, Faults{LostWrite: 1})
+
+	db, err := Open("db", &Options{FS: fs, MaxDegree: 4, CreateIfMissing: true, SyncMode: SYNC_INTERVAL, SyncInterval: time.Millisecond})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Insert(1, value))
+	assert.NoError(t, db.Checkpoint())
+
+	assert.Eventually(t, func() bool {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+
+		return len(fs.files["db"].unsynced) == 0
+	}, time.Second, time.Millisecond)
+
+	fs.Crash()
+	fs.Restart()
+
+	db, err = Open("db", &Options{FS: fs})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, db.tree.Len())
+}
+
+func TestOptionsLogger(t *testing.T) {
+	var out bytes.Buffer
+	db, err := Open(filepath.Join(t.TempDir(), "db"), &Options{CreateIfMissing: true, OnCorruption: QUARANTINE_CORRUPTION, Logger: log.New(&out, "", 0)})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	page, _ := db.storeManager.NewPage()
+	assert.NoError(t, page.Flush(db.datafile))
+
+	offset, _ := page.MapToOffset()
+	_, _ = db.datafile.WriteAt([]byte{0xff}, offset+PAGE_SIZE-1)
+
+	_, err = db.FetchPage(int(page.PageID))
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "quarantining page")
+}
+
+func TestOpenLocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+
+	db, err := OpenDB(path, 4)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Insert(1, value))
+	assert.NoError(t, db.Checkpoint())
+
+	_, err = OpenDB(path, 4)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	// a truncate can't pull the file from under the writer
+	_, err = InitDB(nil, path)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	_, err = CheckFile(path, true, nil)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	// readers share the file with the writer and each other, as of the last checkpoint
+	reader, err := Open(path, &Options{ReadOnly: true})
+	assert.NoError(t, err)
+
+	other, err := Open(path, &Options{ReadOnly: true})
+	assert.NoError(t, err)
+	other.Close()
+
+	assert.NoError(t, db.Insert(2, value))
+	assert.NoError(t, db.Checkpoint())
+
+	_, err = reader.Get(2)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	report, err := CheckFile(path, false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Keys)
+
+	// a writer can wait for the one before it to go away
+	go func(db *DB) {
+		time.Sleep(50 * time.Millisecond)
+		db.Close()
+	}(db)
+
+	next, err := Open(path, &Options{LockTimeout: 5 * time.Second})
+	assert.NoError(t, err)
+	next.Close()
+
+	// a repair waits for the readers too
+	_, err = CheckFile(path, true, nil)
+	assert.ErrorIs(t, err, ErrLocked)
+	reader.Close()
+
+	report, err = CheckFile(path, true, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Keys)
+}
+
+// readers opening while a writer checkpoints over and over load one checkpoint whole
+func TestOpenReadOnlyDuringCheckpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+
+	db, err := Open(path, &Options{MaxDegree: 4, CreateIfMissing: true})
+	assert.NoError(t, err)
+
+	write := func(round int) {
+		for k := 0; k < 500; k++ {
+			assert.NoError(t, db.Insert(k, []byte(fmt.Sprintf("round %v", round))))
+		}
+		assert.NoError(t, db.Checkpoint())
+	}
+	write(0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for round := 1; round <= 20; round++ {
+			write(round)
+		}
+	}()
+
+	for opened := 0; ; opened++ {
+		select {
+		case <-done:
+			assert.Positive(t, opened)
+			db.Close()
+			return
+		default:
+		}
+
+		reader, err := Open(path, &Options{ReadOnly: true})
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		first, err := reader.Get(0)
+		assert.NoError(t, err)
+
+		for k := 0; k < 500; k++ {
+			got, err := reader.Get(k)
+			assert.NoError(t, err)
+			assert.Equal(t, first, got, "key %v", k)
+		}
+		reader.Close()
+	}
+}
+
+func TestOpenPageSize(t *testing.T) {
+	for _, size := range []int{MIN_PAGE_SIZE, 16384, MAX_PAGE_SIZE} {
+		path := filepath.Join(t.TempDir(), "db")
+
+		db, err := Open(path, &Options{PageSize: size, MaxDegree: 8, CreateIfMissing: true, MmapSize: 1 << 30})
+		assert.NoError(t, err)
+
+		// the value limit follows the page
+		big := bytes.Repeat([]byte{'v'}, overflowThreshold(size, 0, 8))
+		assert.Error(t, db.Insert(0, append(big, 'v')))
+
+		for round := 0; round < 3; round++ {
+			for k := 0; k < 2000; k++ {
+				assert.NoError(t, db.Insert(k, big[:(k+round)%len(big)]))
+			}
+			assert.NoError(t, db.Checkpoint())
+		}
+		db.Close()
+
+		report, err := CheckFile(path, false, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(size), report.Header.PageSize)
+		assert.Empty(t, report.Errors)
+		assert.Empty(t, report.Warnings)
+		assert.Equal(t, 2000, report.Keys)
+
+		_, err = Open(path, &Options{PageSize: PAGE_SIZE})
+		assert.ErrorContains(t, err, fmt.Sprintf("%v byte pages", size))
+
+		// zero takes the page size of the file
+		db, err = Open(path, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, size, db.pageSize)
+
+		value, err := db.Get(1999)
+		assert.NoError(t, err)
+		assert.Equal(t, big[:(1999+2)%len(big)], value)
+		db.Close()
+	}
+}
+
+// the value limit follows the degree of the file, a degree no page fits is refused
+func TestOpenDegreeFitsPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, &Options{MaxDegree: 64, CreateIfMissing: true})
+	assert.NoError(t, err)
+
+	limit := db.maxValueSize()
+	assert.Less(t, limit, overflowThreshold(PAGE_SIZE, 0, DEFAULT_DEGREE))
+	assert.ErrorContains(t, db.Insert(0, make([]byte, 200)), "cell limit")
+
+	for k := 0; k < 1000; k++ {
+		assert.NoError(t, db.Insert(k, bytes.Repeat([]byte{'v'}, limit)))
+	}
+	assert.NoError(t, db.Checkpoint())
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, db.tree.Len())
+	db.Close()
+
+	_, err = Open(filepath.Join(t.TempDir(), "db"), &Options{PageSize: MIN_PAGE_SIZE, MaxDegree: 100, CreateIfMissing: true})
+	assert.ErrorContains(t, err, "does not fit a page")
+}
+
+func TestHeaderWithInvalidPageSize(t *testing.T) {
+	fs := NewMemFS(1, Faults{})
+	datafile, _ := fs.OpenFile("db", os.O_CREATE|os.O_RDWR, 0644)
+
+	sm := StoreManager{datafile: datafile}
+	assert.NoError(t, sm.InitHeader(8, PAGE_SIZE, CODEC_NONE, DEFAULT_COMPARATOR))
+
+	sm.header.PageSize = 3000
+	assert.NoError(t, sm.WriteHeader())
+
+	_, err := ReadHeader(datafile)
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestOpenCompression(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "db"), &Options{CreateIfMissing: true, Compression: "zstd"})
+	assert.ErrorContains(t, err, "unknown compression")
+
+	blocks := map[string]int64{}
+
+	for _, compression := range []string{"none", "lz4"} {
+		path := filepath.Join(t.TempDir(), "db")
+		db, err := Open(path, &Options{PageSize: 16384, MaxDegree: 32, CreateIfMissing: true, Compression: compression})
+		assert.NoError(t, err)
+
+		for k := 0; k < 5000; k++ {
+			assert.NoError(t, db.Insert(k, []byte(fmt.Sprintf("the value of key %v is mostly the same text", k%10))))
+		}
+		assert.NoError(t, db.Checkpoint())
+		assert.NoError(t, db.Checkpoint())
+		db.Close()
+
+		report, err := CheckFile(path, false, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, report.Errors)
+		assert.Equal(t, 5000, report.Keys)
+
+		var stat syscall.Stat_t
+		assert.NoError(t, syscall.Stat(path, &stat))
+		blocks[compression] = stat.Blocks
+
+		// the codec is recorded, the file reopens with it
+		db, err = Open(path, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, compression, db.storeManager.header.Codec.String())
+
+		value, err := db.Get(4999)
+		assert.NoError(t, err)
+		assert.Equal(t, "the value of key 9 is mostly the same text", string(value))
+		db.Close()
+	}
+
+	// holes are a property of the filesystem, ext4, xfs, btrfs and tmpfs have them
+	if blocks["lz4"] >= blocks["none"] {
+		t.Logf("no space saved (%v blocks against %v), the filesystem may not punch holes", blocks["lz4"], blocks["none"])
+	}
+}
+
+// pages keep the codec they were written with, switching only applies to new ones
+func TestSwitchCompression(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, _ := Open(path, &Options{MaxDegree: 8, CreateIfMissing: true, Compression: "lz4"})
+
+	for k := 0; k < 500; k++ {
+		_ = db.Insert(k, []byte("lz4 lz4 lz4 lz4"))
+	}
+	assert.NoError(t, db.Checkpoint())
+	db.Close()
+
+	db, err := Open(path, &Options{Compression: "none"})
+	assert.NoError(t, err)
+
+	for k := 500; k < 1000; k++ {
+		_ = db.Insert(k, []byte("none"))
+	}
+	assert.NoError(t, db.Checkpoint())
+	db.Close()
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, CODEC_NONE, db.storeManager.header.Codec)
+	assert.Equal(t, 1000, db.tree.Len())
+
+	value, _ := db.Get(1)
+	assert.Equal(t, "lz4 lz4 lz4 lz4", string(value))
+}
@@ -1,52 +1,169 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
-	"os"
+	"slices"
+	"sort"
+	"unsafe"
 )
 
 const (
-	// 4KiB
+	// 4KiB, the page size of a new datafile unless Options.PageSize says otherwise
 	PAGE_SIZE = 4096
 
-	// 255 bytes max cell data size, else overflow
-	OVERFLOW_PAGE_SIZE = 255
+	// page sizes are a power of two in between, slot offsets are uint16 see: high
+	MIN_PAGE_SIZE = 1024
+	MAX_PAGE_SIZE = 1 << 16
+
+	// 255 bytes max cell data size of a 4KiB page, else overflow see: overflowThreshold
+	OVERFLOW_PAGE_SIZE = PAGE_SIZE/16 - 1
+
+	// keys are stored in their 8 byte order preserving encoding see: encodeKey
+	KEY_SIZE = 8
+)
+
+// pages that don't hold a tree node
+const (
+	FREELIST_PAGE nodeType = LEAF_NODE + iota + 1
+)
+
+func (k nodeType) String() string {
+	switch k {
+	case ROOT_NODE:
+		return "root"
+	case INTERNAL_NODE:
+		return "internal"
+	case LEAF_NODE:
+		return "leaf"
+	case FREELIST_PAGE:
+		return "freelist"
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(k))
+}
+
+// cell layouts
+const (
+	// key/pointer cells found in internal pages
+	KEY_CELL byte = iota + 1
+	// key/value cells found in leaf pages
+	KEY_VALUE_CELL
 )
 
-// 17 byte page header
+// 32 byte page header
 type pageHeader struct {
-	PageID  uint32 // 4 bytes
-	Reserve uint32 // 4 bytes
+	PageID   uint32 // 4 bytes
+	Checksum uint32 // 4 bytes, crc32c of the page with this field zeroed
 
-	FreeSlots uint16 // 2 bytes
+	FreeSlots uint16 // 2 bytes, free bytes between the cell pointers and the cells
 	PLower    uint16 // 2 bytes
 	PHigh     uint16 // 2 bytes
 
-	NumSlots byte     // 1 byte (uint8)
+	NumSlots uint16   // 2 bytes
 	PageType nodeType // node type (root, internal, leaf)
 	// all cells are of type CellLayout ie is key/pointer or key/value cell?
 	CellLayout byte // 1 byte (uint8)
 
+	// prefix truncation: the key prefix shared by every cell is stored once
+	// right after the header and each cell only keeps the remaining suffix
+	PrefixLen   uint8  // 1 byte
+	RawKeyBytes uint16 // 2 bytes, key bytes before truncation
+	KeyBytes    uint16 // 2 bytes, key bytes actually stored (prefix + suffixes)
+
+	// internal pages hold one child pointer more than keys, the last one lives here
+	RightChild uint32 // 4 bytes
+
+	// how the page past the header is stored, a compressed page takes up the
+	// first PAGE_HEADER_SIZE+CompressedLen bytes of it's slot see: encode
+	Codec         Codec  // 1 byte
+	CompressedLen uint16 // 2 bytes
+	// bytes set aside right after the body for the nonce and tag of an encrypted
+	// page, 0 when it isn't encrypted see: pageCipher
+	Reserve uint8 // 1 byte
+
+	_ [1]byte // pad to 32 bytes
+}
+
+var PAGE_HEADER_SIZE = binary.Size(pageHeader{})
+
+// high is where the cells start, PHigh can't hold the 65536 of an empty 64KiB
+// page so it's stored as 0 (as sqlite does), the slot array is never empty of
+// the header so a real PHigh is never 0
+func (h *pageHeader) high() int {
+	if h.PHigh == 0 {
+		return MAX_PAGE_SIZE
+	}
+
+	return int(h.PHigh)
+}
+
+// overflowThreshold is the largest value a page of pageSize bytes takes, a 16th
+// of the page and less on small pages or large degrees so a full leaf still fits
+// next to the reserve. a cell is the key, a value length of up to 3 bytes and it's 2 byte slot
+func overflowThreshold(pageSize, reserve, degree int) int {
+	fits := (pageSize-PAGE_HEADER_SIZE-reserve)/(degree-1) - KEY_SIZE - 3 - 2
+	return max(0, min(pageSize/16-1, fits))
+}
+
+// validDegree rejects a degree whose full internal node doesn't fit a page, a
+// separator cell is at most a length byte, the key and the child id next to it's slot
+func validDegree(degree, pageSize, reserve int) error {
+	if room := pageSize - PAGE_HEADER_SIZE - reserve; (degree-1)*(1+KEY_SIZE+4+2) > room {
+		return fmt.Errorf("a degree of %v does not fit a page of %v bytes, lower the degree or raise the page size", degree, pageSize)
+	}
+
+	return nil
 }
 
-// 100 - 16 byte header = 4080 bytes
+func validPageSize(size int) error {
+	if size < MIN_PAGE_SIZE || size > MAX_PAGE_SIZE || size&(size-1) != 0 {
+		return fmt.Errorf("a page size of %v is not a power of two between %v and %v", size, MIN_PAGE_SIZE, MAX_PAGE_SIZE)
+	}
+
+	return nil
+}
+
+// CompressionRatio reports how much the prefix truncation saved on key bytes
+func (h *pageHeader) CompressionRatio() float64 {
+	if h.KeyBytes == 0 {
+		return 1
+	}
+
+	return float64(h.RawKeyBytes) / float64(h.KeyBytes)
+}
+
+// 4096 - 32 byte header = 4064 bytes
 // Page is (de)serialised disk block similar to: https://doxygen.postgresql.org/bufpage_8h_source.html
-// It is a contigous 4kiB chunk of memory maintained in-memory(on init) + a disk repr.
+// It is a contigous 4kiB (or the datafile's page size) chunk of memory maintained in-memory(on init) + a disk repr.
 // It is both a logical and physical representation of data.
 // logically a page is organised in 'slots':
-// [[header] [pointers/offsets to cells] [[cell][cell][cell]]]
+// [[header] [key prefix] [pointers/offsets to cells] -> ... <- [[cell][cell][cell]]]
 type Page struct {
 	pageHeader
 
-	cellPointers []int16
+	// the encoded page, cells are read in place. it's length is the page size
+	buf []byte
+
+	// what a leaf page is compressed with when written, see: StoreManager.NewPage
+	codec Codec
+	// what the page is encrypted with when written, nil to leave it as is
+	cipher *pageCipher
+	// offset of page 1 in the datafile, FILE_HEADER_SIZE when zero see: fileHeader.PageStart
+	start int64
+}
+
+func (p *Page) size() int {
+	return len(p.buf)
+}
 
-	/*
-		cells        []cell
-	*/
+// end is where the cell area stops, the reserve of an encrypted page follows it
+func (p *Page) end() int {
+	return p.size() - int(p.Reserve)
 }
 
 // cell's hold individual key/value records, either:
@@ -60,7 +177,38 @@ type cell struct {
 	data      []byte
 }
 
-func NewPage(datafile *os.File) (*Page, error) {
+var errPageFull = errors.New("page full: cells do not fit in a single page")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptPage is returned instead of decoding a page whose checksum does not
+// match it's contents, e.g a torn write or bit rot.
+type ErrCorruptPage struct {
+	PageID   uint32
+	Offset   int64
+	Checksum uint32 // as stored in the page header
+	Computed uint32 // over the bytes read from disk
+}
+
+func (e *ErrCorruptPage) Error() string {
+	return fmt.Sprintf("corrupt page %v at offset %v: checksum %#08x does not match contents %#08x",
+		e.PageID, e.Offset, e.Checksum, e.Computed)
+}
+
+// Unwrap makes a corrupt page match errors.Is(err, ErrCorrupt)
+func (e *ErrCorruptPage) Unwrap() error {
+	return ErrCorrupt
+}
+
+// pageChecksum covers the page as stored, the checksum field itself is read as zeros
+func pageChecksum(buf []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, buf[:4])
+	crc = crc32.Update(crc, castagnoli, make([]byte, 4))
+
+	return crc32.Update(crc, castagnoli, buf[8:])
+}
+
+func NewPage(datafile File) (*Page, error) {
 	return nil, nil
 }
 
@@ -74,103 +222,516 @@ page directory? - maps page ids to offsets
 https://www.postgresql.org/docs/current/storage-fsm.html
 */
 func (p *Page) MapToOffset() (int64, error) {
-	return 0, nil
+	return pageOffset(p.PageID, p.size(), p.start)
+}
+
+func pageOffset(pageId uint32, pageSize int, start int64) (int64, error) {
+	if pageId == 0 {
+		return 0, errors.New("page 0 is reserved for the file header")
+	}
+
+	if start == 0 {
+		start = FILE_HEADER_SIZE
+	}
+
+	return start + int64(pageId-1)*int64(pageSize), nil
+}
+
+// buffers start at a multiple of this, the block size direct I/O asks for
+const PAGE_ALIGNMENT = 4096
+
+// alignedBuffer allocates size bytes starting at a multiple of PAGE_ALIGNMENT,
+// the heap doesn't move so the alignment holds for the buffer's lifetime
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+PAGE_ALIGNMENT)
+	shift := (PAGE_ALIGNMENT - int(uintptr(unsafe.Pointer(&buf[0]))%PAGE_ALIGNMENT)) % PAGE_ALIGNMENT
+
+	return buf[shift : shift+size : shift+size]
 }
 
 // Allocate creates an in-memory buffer of 4KiB that eventually is persisted
 func (p *Page) Allocate() error {
+	return p.allocate(PAGE_SIZE)
+}
+
+// allocate is Allocate for the page size of a datafile
+func (p *Page) allocate(pageSize int) error {
 	// todo: lift the pageId autoincrement globally to the DB struct
 	// todo: create the page directory mechanism
-	// p.offsetEnd = p.id * PAGE_SIZE
-	// p.offsetBegin = p.offsetEnd - PAGE_SIZE
-	p.pageHeader.PageID = 1
-	p.pageHeader.FreeSlots = 64
-	p.pageHeader.NumSlots = 64
-	p.CellLayout = 1
-	p.pageHeader.PLower = 100
-	p.pageHeader.PHigh = 4196
-	p.pageHeader.Reserve = 0
-
-	/*
-			if err != nil {
-			return errors.New("internal error: could not allocate a new page")
+	if p.pageHeader.PageID == 0 {
+		p.pageHeader.PageID = 1
+	}
+
+	p.buf = alignedBuffer(pageSize)
+	p.reset()
+
+	return nil
+}
+
+// reset empties the slot array and the cell area
+func (p *Page) reset() {
+	p.NumSlots, p.PrefixLen = 0, 0
+	p.RawKeyBytes, p.KeyBytes = 0, 0
+	p.PLower = uint16(PAGE_HEADER_SIZE)
+	// wraps to 0 on a 64KiB page, see: high
+	p.PHigh = uint16(p.end())
+	p.FreeSlots = uint16(p.end() - PAGE_HEADER_SIZE)
+}
+
+// writeCells lays out a sorted run of keys into the page. leaf pages carry a
+// value per key, internal pages carry len(keys)+1 child page ids.
+func (p *Page) writeCells(keys []int, values [][]byte, children []uint32) error {
+	p.reset()
+
+	if children != nil {
+		if len(children) != len(keys)+1 {
+			return fmt.Errorf("%w: an internal page needs one more child than keys, got %v children for %v keys", ErrCorrupt, len(children), len(keys))
 		}
 
-	*/
+		p.CellLayout = KEY_CELL
+		p.RightChild = children[len(keys)]
+	} else {
+		p.CellLayout = KEY_VALUE_CELL
+		p.RightChild = 0
+	}
+
+	var prefix []byte
+	if len(keys) > 0 {
+		// keys are sorted so the first and last key bound the shared prefix
+		prefix = commonPrefix(encodeKey(keys[0]), encodeKey(keys[len(keys)-1]))
+	}
+
+	p.PrefixLen = uint8(len(prefix))
+	lower := PAGE_HEADER_SIZE + len(prefix) + 2*len(keys)
+	high := p.end()
+
+	if lower > high {
+		return errPageFull
+	}
+
+	copy(p.buf[PAGE_HEADER_SIZE:], prefix)
+	keyBytes := len(prefix)
+
+	for i, key := range keys {
+		suffix := encodeKey(key)[len(prefix):]
+		c := suffix
+
+		if children != nil {
+			// separators are chosen with as many trailing zero bytes as possible
+			// see: shortestSeparator, so only the significant bytes are kept
+			suffix = bytes.TrimRight(suffix, "\x00")
+			c = append([]byte{byte(len(suffix))}, suffix...)
+			c = binary.LittleEndian.AppendUint32(c, children[i])
+		} else {
+			var value []byte
+			if values != nil {
+				value = values[i]
+			}
+
+			c = binary.AppendUvarint(slices.Clip(c), uint64(len(value)))
+			c = append(c, value...)
+		}
+
+		keyBytes += len(suffix)
+		high -= len(c)
+		if high < lower {
+			return errPageFull
+		}
+
+		copy(p.buf[high:], c)
+		binary.LittleEndian.PutUint16(p.buf[PAGE_HEADER_SIZE+len(prefix)+2*i:], uint16(high))
+	}
+
+	p.NumSlots = uint16(len(keys))
+	p.PLower, p.PHigh = uint16(lower), uint16(high)
+	p.FreeSlots = uint16(high - lower)
+	p.RawKeyBytes = uint16(len(keys) * KEY_SIZE)
+	p.KeyBytes = uint16(keyBytes)
 
 	return nil
 }
 
+func commonPrefix(a, b []byte) []byte {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return a[:i]
+}
+
+func (p *Page) prefix() []byte {
+	return p.buf[PAGE_HEADER_SIZE : PAGE_HEADER_SIZE+int(p.PrefixLen)]
+}
+
+// cellOffset reads the i-th slot of the cell pointer array
+func (p *Page) cellOffset(i int) int {
+	slot := PAGE_HEADER_SIZE + int(p.PrefixLen) + 2*i
+	return int(binary.LittleEndian.Uint16(p.buf[slot:]))
+}
+
+// suffix is the truncated key stored in the i-th cell and the offset where it ends.
+// leaf cells keep a fixed size suffix, key cells are length prefixed and drop
+// their trailing zero bytes.
+func (p *Page) suffix(i int) ([]byte, int) {
+	offset := p.cellOffset(i)
+
+	if p.CellLayout == KEY_CELL {
+		size := int(p.buf[offset])
+		return p.buf[offset+1 : offset+1+size], offset + 1 + size
+	}
+
+	end := offset + KEY_SIZE - int(p.PrefixLen)
+	return p.buf[offset:end], end
+}
+
+// Key rebuilds the full key of the i-th cell from the page prefix
+func (p *Page) Key(i int) int {
+	suffix, _ := p.suffix(i)
+
+	key := make([]byte, KEY_SIZE)
+	copy(key, p.prefix())
+	copy(key[p.PrefixLen:], suffix)
+
+	return decodeKey(key)
+}
+
+func (p *Page) Keys() []int {
+	keys := make([]int, p.NumSlots)
+	for i := range keys {
+		keys[i] = p.Key(i)
+	}
+
+	return keys
+}
+
+// cell decodes the i-th cell, the key is left truncated
+func (p *Page) cell(i int) cell {
+	suffix, end := p.suffix(i)
+	c := cell{cellId: int16(i), keySize: uint64(len(suffix)), keys: suffix}
+	rest := p.buf[end:]
+
+	if p.CellLayout == KEY_CELL {
+		c.valueSize = 4
+		c.data = rest[:4]
+	} else {
+		size, n := binary.Uvarint(rest)
+		c.valueSize = size
+		c.data = rest[n : n+int(size)]
+	}
+
+	return c
+}
+
+// Value is the record stored alongside the i-th key in a leaf page
+func (p *Page) Value(i int) []byte {
+	return p.cell(i).data
+}
+
+// Child is the page id to the left of the i-th key in an internal page,
+// i == NumSlots yields the right most child
+func (p *Page) Child(i int) uint32 {
+	if i == int(p.NumSlots) {
+		return p.RightChild
+	}
+
+	return binary.LittleEndian.Uint32(p.cell(i).data)
+}
+
+// Search binary searches the slot array: the search key is first compared
+// against the page prefix and then only the suffixes are compared.
+func (p *Page) Search(key int) (int, bool) {
+	encoded := encodeKey(key)
+	n := int(p.NumSlots)
+
+	switch bytes.Compare(encoded[:p.PrefixLen], p.prefix()) {
+	case -1:
+		return 0, false
+	case 1:
+		return n, false
+	}
+
+	target := encoded[p.PrefixLen:]
+	if p.CellLayout == KEY_CELL {
+		// comparing with the trailing zeros dropped on both sides orders
+		// the same as comparing the zero padded keys
+		target = bytes.TrimRight(target, "\x00")
+	}
+
+	compare := func(i int) int {
+		suffix, _ := p.suffix(i)
+		return bytes.Compare(suffix, target)
+	}
+
+	idx := sort.Search(n, func(i int) bool {
+		return compare(i) >= 0
+	})
+
+	return idx, idx < n && compare(idx) == 0
+}
+
+// encodeHeader writes the header fields into the front of the page buffer
+func (p *Page) encodeHeader() error {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, &p.pageHeader); err != nil {
+		return err
+	}
+
+	copy(p.buf, buf.Bytes())
+	return nil
+}
+
 // Fetch: retrieve an existing page from the buffer pool or pull from disk
-// and decode the contents back into a memory page
-func FetchPage(pageId int, datafile *os.File) (Page, error) {
-	var page Page
+// and decode the contents back into a memory page. pages are looked for right
+// after the file header, where files from before fileHeader.PageStart have them
+func FetchPage(pageId int, pageSize int, datafile File) (Page, error) {
+	return openPage(pageId, pageSize, FILE_HEADER_SIZE, nil, datafile)
+}
 
-	datafile.Seek(100, io.SeekStart)
-	err := binary.Read(datafile, binary.LittleEndian, &page.pageHeader)
+// openPage is FetchPage for a datafile that may be encrypted, with page 1 at start
+func openPage(pageId int, pageSize int, start int64, c *pageCipher, datafile File) (Page, error) {
+	page, err := readPage(pageId, pageSize, start, datafile)
+	if err != nil {
+		return Page{}, err
+	}
+
+	if err = verifyPage(page, pageId); err != nil {
+		return Page{}, err
+	}
+
+	return page, page.unseal(c)
+}
+
+// verifyPage checks a page read from the offset of pageId is intact
+func verifyPage(page Page, pageId int) error {
+	if computed := pageChecksum(page.buf[:page.storedSize()]); computed != page.Checksum {
+		// the id in a corrupt header can't be trusted, the offset is where pageId was read
+		offset, _ := pageOffset(uint32(pageId), page.size(), page.start)
+		return &ErrCorruptPage{PageID: uint32(pageId), Offset: offset, Checksum: page.Checksum, Computed: computed}
+	}
+
+	if page.PageID != uint32(pageId) {
+		return fmt.Errorf("%w: page %v found at the offset of page %v", ErrCorrupt, page.PageID, pageId)
+	}
+
+	return nil
+}
 
+// readPage pulls a page from disk and decodes it's header as is, without
+// verifying the checksum. this is only useful for inspecting damaged pages.
+func readPage(pageId int, pageSize int, start int64, datafile File) (Page, error) {
+	page := Page{buf: alignedBuffer(pageSize), start: start}
+	page.PageID = uint32(pageId)
+
+	offset, err := page.MapToOffset()
 	if err != nil {
 		return Page{}, err
 	}
 
-	// todo: binsearch/decode cell
+	if err := readFullAt(datafile, page.buf, offset); err != nil {
+		return Page{}, readError(err, "reading page %v", pageId)
+	}
+
+	if page, err = decodePage(page.buf); err != nil {
+		return Page{}, err
+	}
+
+	page.start = start
+	return page, nil
+}
+
+// readFullAt is io.ReadFull for positional reads, a short read that made
+// progress is retried for the rest. only running out of file is an
+// io.ErrUnexpectedEOF
+func readFullAt(datafile File, buf []byte, offset int64) error {
+	for read := 0; read < len(buf); {
+		n, err := datafile.ReadAt(buf[read:], offset+int64(read))
+		read += n
+
+		switch {
+		case read == len(buf):
+			return nil
+		case n > 0 && (err == nil || err == io.ErrUnexpectedEOF):
+			continue
+		case err == nil || err == io.EOF:
+			if read == 0 {
+				return io.EOF
+			}
+
+			return io.ErrUnexpectedEOF
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storedSize is how much of the slot the page takes up, a compressed length
+// past the slot can only be corruption and fails the checksum of the whole slot
+func (p *Page) storedSize() int {
+	if n := PAGE_HEADER_SIZE + int(p.CompressedLen) + int(p.Reserve); p.Codec != CODEC_NONE && n <= p.size() {
+		return n
+	}
+
+	return p.size()
+}
+
+// bodyEnd is where the stored body ends, compressed or not
+func (p *Page) bodyEnd() int {
+	return p.storedSize() - int(p.Reserve)
+}
+
+// unseal decrypts and inflates a page that passed it's checksum
+func (p *Page) unseal(c *pageCipher) error {
+	if p.Reserve != 0 {
+		if err := c.open(p); err != nil {
+			return err
+		}
+	}
+
+	return p.inflate()
+}
+
+// inflate replaces a compressed page with the page it encodes, the page must
+// have passed it's checksum and been decrypted
+func (p *Page) inflate() error {
+	if p.Codec == CODEC_NONE {
+		return nil
+	}
+
+	buf := alignedBuffer(p.size())
+	copy(buf, p.buf[:PAGE_HEADER_SIZE])
+
+	if err := p.Codec.decompress(buf[PAGE_HEADER_SIZE:p.end()], p.buf[PAGE_HEADER_SIZE:p.bodyEnd()]); err != nil {
+		return fmt.Errorf("decompressing page %v: %w", p.PageID, err)
+	}
+
+	p.buf = buf
+	return nil
+}
+
+// decodePage decodes the header of an encoded page, the cells are read in place
+func decodePage(buf []byte) (Page, error) {
+	page := Page{buf: buf}
+
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &page.pageHeader); err != nil {
+		return Page{}, err
+	}
 
 	return page, nil
 }
 
-// TODO(nice-to-have): checksum pages using md5
 // Flush: flush dirty pages and encode mem layout into bytes and write out disk
-func (p *Page) Flush(datafile *os.File) error {
-	buf := new(bytes.Buffer)
+// the checksum is computed last, over the encoded page.
+// I/O errors are returned rather than fatal so a failed checkpoint can be told apart
+// from a crash, the previous checkpoint is still intact either way.
+func (p *Page) Flush(datafile File) error {
+	if err := p.write(datafile); err != nil {
+		return err
+	}
 
-	// Seek to the position of the pageHeader within the file
-	ret, err := datafile.Seek(int64(p.PLower), io.SeekStart)
-	_assert(ret != -1, "seek to invalid region")
+	if err := datafile.Sync(); err != nil {
+		return ioError(err, "fsync of page %v", p.PageID)
+	}
 
+	return nil
+}
+
+// write encodes the page and writes it at it's offset without syncing, it
+// doesn't touch the file offset so pages can be written concurrently
+func (p *Page) write(datafile File) error {
+	offset, err := p.MapToOffset()
 	if err != nil {
-		log.Fatalf("error seeking: %v", err)
+		return err
 	}
 
-	err = binary.Write(buf, binary.LittleEndian, &p.pageHeader)
+	stored, err := p.encode()
 	if err != nil {
-		log.Fatalf("buffer write failed: %v", err)
+		return err
 	}
 
-	n, err := buf.WriteTo(datafile)
-	if err != nil {
-		log.Fatalf("db-EIO: %v", err)
+	if _, err = datafile.WriteAt(stored, offset); err != nil {
+		return ioError(err, "writing page %v", p.PageID)
 	}
 
-	err = datafile.Sync()
-	if err != nil {
-		log.Fatalf("unrecoverable error during fsync: %v", err)
+	if len(stored) == p.size() {
+		return nil
+	}
+
+	// the last byte of the slot keeps the whole slot in the file, the page at the
+	// end of the file is read in full like any other
+	end := offset + int64(p.size())
+	if _, err = datafile.WriteAt([]byte{0}, end-1); err != nil {
+		return ioError(err, "writing page %v", p.PageID)
+	}
+
+	if err = punchSlot(datafile, offset+int64(len(stored)), end); err != nil {
+		return ioError(err, "punching the slot of page %v", p.PageID)
 	}
 
-	log.Printf("written %v bytes to disk at pageID %v", n, p.PageID)
 	return nil
 }
 
-func syncToOffset(file *os.File, value []byte) (int64, error) {
-	writer := bufio.NewWriter(file)
-	// TODO: sync this to use the new page layout
-	// seek to correct block position using the pageID
-	// make sure we get to disk
-	_, err := writer.Write(value)
-	fErr := writer.Flush()
+// encode lays out the page as it's stored with the checksum computed last.
+// leaf pages are compressed with the page's codec when it saves space, the
+// header stays as is and the rest of the page is compressed after it, then
+// the body is encrypted with the page's cipher
+func (p *Page) encode() ([]byte, error) {
+	stored := p.buf
+	p.Codec, p.CompressedLen, p.Checksum = CODEC_NONE, 0, 0
+
+	if p.codec != CODEC_NONE && p.CellLayout == KEY_VALUE_CELL && p.PageType != FREELIST_PAGE {
+		body := p.codec.compress(nil, p.buf[PAGE_HEADER_SIZE:p.end()])
+
+		if PAGE_HEADER_SIZE+len(body)+int(p.Reserve) < p.size() {
+			p.Codec, p.CompressedLen = p.codec, uint16(len(body))
+			stored = alignedBuffer(PAGE_HEADER_SIZE + len(body) + int(p.Reserve))
+			copy(stored[PAGE_HEADER_SIZE:], body)
+		}
+	}
 
-	if err != nil {
-		return 0, err
+	if err := p.encodeHeader(); err != nil {
+		return nil, err
 	}
 
-	if fErr != nil {
-		return 0, fErr
+	copy(stored, p.buf[:PAGE_HEADER_SIZE])
+
+	if p.Reserve != 0 {
+		// p.buf stays in the clear, it goes to the buffer pool
+		if len(stored) == p.size() {
+			stored = alignedBuffer(p.size())
+			copy(stored, p.buf)
+		}
+
+		if err := p.cipher.seal(stored, p.PageID, p.bodyEnd()); err != nil {
+			return nil, err
+		}
 	}
 
-	offset, err := file.Seek(0, io.SeekCurrent)
+	p.Checksum = pageChecksum(stored)
+	binary.LittleEndian.PutUint32(stored[4:8], p.Checksum)
+	binary.LittleEndian.PutUint32(p.buf[4:8], p.Checksum)
 
-	if err != nil {
-		return 0, err
+	return stored, nil
+}
+
+// punchSlot hands the unused end of a slot back to the filesystem, which only
+// frees whole blocks so the bytes around them are left as they are. they were
+// never part of the page, the checksum and the codec stop at it's stored size.
+// a filesystem without holes keeps the blocks
+func punchSlot(datafile File, from, to int64) error {
+	from += (PAGE_ALIGNMENT - from%PAGE_ALIGNMENT) % PAGE_ALIGNMENT
+	to -= to % PAGE_ALIGNMENT
+
+	if from >= to {
+		return nil
 	}
 
-	return offset, nil
+	if err := datafile.PunchHole(from, to-from); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+
+	return nil
 }
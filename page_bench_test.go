@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// leafCells are the cells of a leaf at the given degree, 8 byte values
+func leafCells(degree int) ([]int, [][]byte) {
+	keys, values := make([]int, degree), make([][]byte, degree)
+	for i := range keys {
+		keys[i] = 42<<32 | i*3
+		values[i] = encodeKey(i)
+	}
+
+	return keys, values
+}
+
+func BenchmarkPageEncode(b *testing.B) {
+	forEachDegree(b, func(b *testing.B, degree int) {
+		keys, values := leafCells(degree)
+		page := Page{}
+		_ = page.Allocate()
+
+		for i := 0; i < b.N; i++ {
+			if err := page.writeCells(keys, values, nil); err != nil {
+				b.Fatal(err)
+			}
+			_ = page.encodeHeader()
+		}
+	})
+}
+
+func BenchmarkPageDecode(b *testing.B) {
+	forEachDegree(b, func(b *testing.B, degree int) {
+		keys, values := leafCells(degree)
+		page := Page{}
+		_ = page.Allocate()
+		_ = page.writeCells(keys, values, nil)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			_ = page.Keys()
+			for j := 0; j < degree; j++ {
+				_ = page.Value(j)
+			}
+		}
+	})
+}
+
+func BenchmarkPageSearch(b *testing.B) {
+	forEachDegree(b, func(b *testing.B, degree int) {
+		keys, values := leafCells(degree)
+		page := Page{}
+		_ = page.Allocate()
+		_ = page.writeCells(keys, values, nil)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			_, _ = page.Search(keys[i%degree])
+		}
+	})
+}
+
+// BenchmarkPageFlush includes the fsync of every page
+func BenchmarkPageFlush(b *testing.B) {
+	for _, pages := range []int{1, 64} {
+		b.Run(fmt.Sprintf("pages=%v", pages), func(b *testing.B) {
+			b.ReportAllocs()
+
+			datafile, err := OSFS.OpenFile(filepath.Join(b.TempDir(), "db"), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer datafile.Close()
+
+			keys, values := leafCells(64)
+			page := Page{}
+			_ = page.Allocate()
+			_ = page.writeCells(keys, values, nil)
+			b.SetBytes(PAGE_SIZE)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				page.PageID = uint32(i%pages + 1)
+				if err := page.Flush(datafile); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFetchPage(b *testing.B) {
+	datafile, err := OSFS.OpenFile(filepath.Join(b.TempDir(), "db"), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer datafile.Close()
+
+	keys, values := leafCells(64)
+	page := Page{}
+	_ = page.Allocate()
+	_ = page.writeCells(keys, values, nil)
+	_ = page.Flush(datafile)
+
+	b.ReportAllocs()
+	b.SetBytes(PAGE_SIZE)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := FetchPage(1, PAGE_SIZE, datafile); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDBFetchPage compares read syscalls against the memory map, the
+// buffer pool is off so every fetch decodes and verifies the page
+func BenchmarkDBFetchPage(b *testing.B) {
+	for _, mmap := range []int64{0, 1 << 30} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap > 0), func(b *testing.B) {
+			db, err := Open(filepath.Join(b.TempDir(), "db"), &Options{MaxDegree: 64, CreateIfMissing: true, BufferPoolSize: -1, MmapSize: mmap})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			for k := 0; k < 10_000; k++ {
+				_ = db.Insert(k, encodeKey(k))
+			}
+
+			if err := db.Checkpoint(); err != nil {
+				b.Fatal(err)
+			}
+
+			pages := int(db.storeManager.header.PageCount)
+			b.ReportAllocs()
+			b.SetBytes(PAGE_SIZE)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := db.FetchPage(i%pages + 1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDBCheckpoint compares writing pages through the page cache against
+// O_DIRECT, every checkpoint rewrites the whole tree and fsyncs it
+func BenchmarkDBCheckpoint(b *testing.B) {
+	for _, direct := range []bool{false, true} {
+		b.Run(fmt.Sprintf("direct=%v", direct), func(b *testing.B) {
+			db, err := Open(filepath.Join(b.TempDir(), "db"), &Options{MaxDegree: 64, CreateIfMissing: true, DirectIO: direct})
+			if err != nil {
+				b.Skip(err)
+			}
+			defer db.Close()
+
+			for k := 0; k < 10_000; k++ {
+				_ = db.Insert(k, encodeKey(k))
+			}
+
+			if err := db.Checkpoint(); err != nil {
+				b.Fatal(err)
+			}
+
+			// the first checkpoint wrote every page of the tree, so does each one after it
+			b.SetBytes(int64(db.storeManager.header.PageCount) * PAGE_SIZE)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := db.Checkpoint(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,5 +1,179 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPagePrefixCompression(t *testing.T) {
+	page := Page{}
+	_ = page.Allocate()
+
+	// every key shares the tenant in the upper four bytes
+	keys, values := []int{}, [][]byte{}
+	for i := 0; i < 200; i++ {
+		keys = append(keys, 42<<32|i*3)
+		values = append(values, []byte{byte(i)})
+	}
+
+	err := page.writeCells(keys, values, nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint8(6), page.PrefixLen)
+	assert.Equal(t, uint16(200*KEY_SIZE), page.RawKeyBytes)
+	assert.Equal(t, uint16(6+200*2), page.KeyBytes)
+	assert.Greater(t, page.CompressionRatio(), 3.9)
+	assert.Equal(t, int(page.PHigh-page.PLower), int(page.FreeSlots))
+
+	assert.Equal(t, keys, page.Keys())
+
+	for i, key := range keys {
+		idx, found := page.Search(key)
+		assert.True(t, found)
+		assert.Equal(t, i, idx)
+		assert.Equal(t, values[i], page.Value(i))
+
+		idx, found = page.Search(key + 1)
+		assert.False(t, found)
+		assert.Equal(t, i+1, idx)
+	}
+
+	// keys outside of the prefix sort before or after every slot
+	idx, found := page.Search(41 << 32)
+	assert.Equal(t, 0, idx)
+	assert.False(t, found)
+
+	idx, _ = page.Search(43 << 32)
+	assert.Equal(t, 200, idx)
+}
+
+func TestPageInternalCells(t *testing.T) {
+	page := Page{}
+	_ = page.Allocate()
+
+	err := page.writeCells([]int{-10, 20, 30}, nil, []uint32{4, 5, 6, 7})
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint8(0), page.PrefixLen)
+	assert.Equal(t, 1.0, page.CompressionRatio())
+	assert.Equal(t, []int{-10, 20, 30}, page.Keys())
+
+	for i, child := range []uint32{4, 5, 6, 7} {
+		assert.Equal(t, child, page.Child(i))
+	}
+}
+
+func TestPageInternalCellsDropTrailingZeros(t *testing.T) {
+	page := Page{}
+	_ = page.Allocate()
+
+	// separators as picked by shortestSeparator
+	keys := []int{0x11 << 40, 0x12 << 40, 0x1280 << 32}
+	assert.NoError(t, page.writeCells(keys, nil, []uint32{1, 2, 3, 4}))
+
+	// the two byte prefix is shared and only the significant bytes are left per cell
+	assert.Equal(t, uint8(2), page.PrefixLen)
+	assert.Equal(t, uint16(2+1+1+2), page.KeyBytes)
+	assert.Equal(t, keys, page.Keys())
+
+	for i, key := range keys {
+		idx, found := page.Search(key)
+		assert.True(t, found)
+		assert.Equal(t, i, idx)
+	}
+
+	idx, found := page.Search(0x12<<40 + 1)
+	assert.False(t, found)
+	assert.Equal(t, 2, idx)
+	assert.Equal(t, uint32(3), page.Child(idx))
+}
+
+func TestFetchCorruptPage(t *testing.T) {
+	datafile, err := OSFS.OpenFile(filepath.Join(t.TempDir(), "db"), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	assert.NoError(t, err)
+	defer datafile.Close()
+
+	page := Page{}
+	page.PageID = 2
+	_ = page.Allocate()
+	assert.NoError(t, page.writeCells([]int{1, 2, 3}, nil, nil))
+	assert.NoError(t, page.Flush(datafile))
+	assert.NotZero(t, page.Checksum)
+
+	_, err = FetchPage(2, PAGE_SIZE, datafile)
+	assert.NoError(t, err)
+
+	// flip a single bit in the middle of the cell area
+	offset, _ := page.MapToOffset()
+	_, _ = datafile.WriteAt([]byte{page.buf[PAGE_SIZE-2] ^ 1}, offset+PAGE_SIZE-2)
+
+	_, err = FetchPage(2, PAGE_SIZE, datafile)
+
+	var corrupt *ErrCorruptPage
+	assert.True(t, errors.As(err, &corrupt))
+	assert.Equal(t, uint32(2), corrupt.PageID)
+	assert.Equal(t, offset, corrupt.Offset)
+	assert.Equal(t, page.Checksum, corrupt.Checksum)
+
+	// a smashed page id still reports the offset the page was read from
+	assert.NoError(t, page.Flush(datafile))
+	_, _ = datafile.WriteAt([]byte{0xde, 0xad, 0xbe, 0xef}, offset)
+	_, err = FetchPage(2, PAGE_SIZE, datafile)
+	assert.True(t, errors.As(err, &corrupt))
+	assert.Equal(t, uint32(2), corrupt.PageID)
+	assert.Equal(t, offset, corrupt.Offset)
+
+	// a page that was never written is caught too
+	_, _ = datafile.WriteAt(make([]byte, PAGE_SIZE), offset)
+	_, err = FetchPage(2, PAGE_SIZE, datafile)
+	assert.True(t, errors.As(err, &corrupt))
+}
+
+func TestPageFull(t *testing.T) {
+	page := Page{}
+	_ = page.Allocate()
+
+	keys := make([]int, PAGE_SIZE/KEY_SIZE)
+	for i := range keys {
+		keys[i] = i << 40
+	}
+
+	assert.ErrorIs(t, page.writeCells(keys, nil, nil), errPageFull)
+}
+
+func TestFlushAndFetchPage(t *testing.T) {
+	datafile, err := OSFS.OpenFile(filepath.Join(t.TempDir(), "db"), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	assert.NoError(t, err)
+	defer datafile.Close()
+
+	page := Page{}
+	page.PageID = 3
+	_ = page.Allocate()
+
+	keys := []int{1 << 20, 1<<20 + 1, 1<<20 + 2}
+	values := [][]byte{[]byte("a"), []byte("bb"), nil}
+	assert.NoError(t, page.writeCells(keys, values, nil))
+	assert.NoError(t, page.Flush(datafile))
+
+	size, _ := datafile.Size()
+	assert.Equal(t, int64(FILE_HEADER_SIZE+3*PAGE_SIZE), size)
+
+	fetched, err := FetchPage(3, PAGE_SIZE, datafile)
+	assert.NoError(t, err)
+	assert.Equal(t, page.pageHeader, fetched.pageHeader)
+	assert.Equal(t, keys, fetched.Keys())
+	assert.Equal(t, []byte("bb"), fetched.Value(1))
+	assert.Empty(t, fetched.Value(2))
+}
+
 /*
 func TestAllocandFlushRoot(t *testing.T) {
 	tree := NewBTree(2)
@@ -22,7 +196,7 @@ func TestAllocandFlushRoot(t *testing.T) {
 
 	assert.Equal(t, 117, int(stat.Size()))
 
-	p, err := FetchPage(1, db.datafile)
+	p, err := FetchPage(1, PAGE_SIZE, db.datafile)
 
 	if err != nil {
 		t.Error()
@@ -78,3 +252,194 @@ func TestFlushDirtyPage(t *testing.T) {
 }
 
 */
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, size := range []int{1, PAGE_SIZE, 3 * PAGE_SIZE} {
+		buf := alignedBuffer(size)
+		assert.Len(t, buf, size)
+		assert.Equal(t, size, cap(buf))
+		assert.Zero(t, uintptr(unsafe.Pointer(&buf[0]))%PAGE_ALIGNMENT)
+	}
+
+	page := Page{}
+	_ = page.Allocate()
+	assert.Zero(t, uintptr(unsafe.Pointer(&page.buf[0]))%PAGE_ALIGNMENT)
+}
+
+// pages are written and read at their offsets, many goroutines can share a file
+func TestConcurrentPageIO(t *testing.T) {
+	datafile, err := OSFS.OpenFile(filepath.Join(t.TempDir(), "db"), os.O_CREATE|os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	defer datafile.Close()
+
+	const PAGES = 64
+	var wg sync.WaitGroup
+
+	for id := 1; id <= PAGES; id++ {
+		wg.Add(1)
+
+		go func(id int) {
+			defer wg.Done()
+
+			page := Page{}
+			page.PageID = uint32(id)
+			_ = page.Allocate()
+			_ = page.writeCells([]int{id, id + 1}, [][]byte{{byte(id)}, {byte(id + 1)}}, nil)
+			assert.NoError(t, page.write(datafile))
+		}(id)
+	}
+	wg.Wait()
+
+	for reader := 0; reader < 8; reader++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for id := PAGES; id >= 1; id-- {
+				page, err := FetchPage(id, PAGE_SIZE, datafile)
+				assert.NoError(t, err)
+				assert.Equal(t, []int{id, id + 1}, page.Keys())
+				assert.Equal(t, []byte{byte(id)}, page.Value(0))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestReadPageRetriesShortReads(t *testing.T) {
+	fs := NewMemFS(1, Faults{ShortRead: 1})
+	datafile, _ := fs.OpenFile("db", os.O_CREATE|os.O_RDWR, 0644)
+
+	page := Page{}
+	_ = page.Allocate()
+	_ = page.writeCells([]int{1, 2, 3}, nil, nil)
+	assert.NoError(t, page.Flush(datafile))
+
+	fetched, err := FetchPage(1, PAGE_SIZE, datafile)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, fetched.Keys())
+
+	// running out of file is corruption, not an I/O error
+	assert.NoError(t, datafile.Truncate(FILE_HEADER_SIZE+PAGE_SIZE/2))
+	_, err = FetchPage(1, PAGE_SIZE, datafile)
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.NotErrorIs(t, err, ErrIO)
+}
+
+func TestValidPageSize(t *testing.T) {
+	for _, size := range []int{MIN_PAGE_SIZE, PAGE_SIZE, 8192, 16384, MAX_PAGE_SIZE} {
+		assert.NoError(t, validPageSize(size), size)
+	}
+
+	for _, size := range []int{0, 512, 3000, MAX_PAGE_SIZE + 1, 2 * MAX_PAGE_SIZE} {
+		assert.Error(t, validPageSize(size), size)
+	}
+
+	assert.Equal(t, OVERFLOW_PAGE_SIZE, overflowThreshold(PAGE_SIZE, 0, DEFAULT_DEGREE))
+}
+
+// every page size round trips a page filled to the brim, a 64KiB page records
+// the end of it's cell area as 0
+func TestPageSizes(t *testing.T) {
+	fs := NewMemFS(1, Faults{})
+
+	for _, size := range []int{MIN_PAGE_SIZE, PAGE_SIZE, 16384, MAX_PAGE_SIZE} {
+		datafile, _ := fs.OpenFile(fmt.Sprint(size), os.O_CREATE|os.O_RDWR, 0644)
+
+		page := Page{}
+		page.PageID = 2
+		_ = page.allocate(size)
+		assert.Equal(t, size, page.high())
+		assert.Equal(t, size-PAGE_HEADER_SIZE, int(page.FreeSlots))
+		assert.Empty(t, verifyLayout(&page))
+
+		// values of the largest size until the page is full
+		value := make([]byte, overflowThreshold(size, 0, DEFAULT_DEGREE))
+		var keys []int
+		var values [][]byte
+
+		for page.writeCells(append(keys, len(keys)), append(values, value), nil) == nil {
+			keys, values = append(keys, len(keys)), append(values, value)
+		}
+
+		assert.NoError(t, page.writeCells(keys, values, nil))
+		assert.GreaterOrEqual(t, len(keys), DEFAULT_DEGREE-1, "page size %v", size)
+		assert.NoError(t, page.Flush(datafile))
+
+		fetched, err := FetchPage(2, size, datafile)
+		assert.NoError(t, err)
+		assert.Empty(t, verifyLayout(&fetched))
+		assert.Equal(t, keys, fetched.Keys())
+		assert.Equal(t, value, fetched.Value(len(keys)-1))
+
+		offset, _ := fetched.MapToOffset()
+		assert.Equal(t, int64(FILE_HEADER_SIZE+size), offset)
+	}
+
+	empty := Page{}
+	_ = empty.allocate(MAX_PAGE_SIZE)
+	assert.Zero(t, empty.PHigh)
+}
+
+// a compressed leaf only takes up it's compressed size, the rest of the slot
+// isn't part of the page
+func TestCompressedPage(t *testing.T) {
+	datafile, _ := NewMemFS(1, Faults{}).OpenFile("db", os.O_CREATE|os.O_RDWR, 0644)
+
+	keys, values := make([]int, 100), make([][]byte, 100)
+	for i := range keys {
+		keys[i], values[i] = i, []byte(fmt.Sprintf("compressible value %v", i%7))
+	}
+
+	page := Page{codec: CODEC_LZ4}
+	page.PageID = 1
+	_ = page.allocate(PAGE_SIZE)
+	_ = page.writeCells(keys, values, nil)
+	page.PageType = LEAF_NODE
+	assert.NoError(t, page.Flush(datafile))
+
+	// garbage past the stored size of the page
+	raw, err := readPage(1, PAGE_SIZE, FILE_HEADER_SIZE, datafile)
+	assert.NoError(t, err)
+	assert.Equal(t, CODEC_LZ4, raw.Codec)
+	assert.Less(t, raw.storedSize(), PAGE_SIZE/2)
+	_, _ = datafile.WriteAt([]byte{0xff, 0xff}, FILE_HEADER_SIZE+PAGE_SIZE-2)
+
+	fetched, err := FetchPage(1, PAGE_SIZE, datafile)
+	assert.NoError(t, err)
+	assert.Empty(t, verifyLayout(&fetched))
+	assert.Equal(t, keys, fetched.Keys())
+	assert.Equal(t, values[99], fetched.Value(99))
+
+	// the checksum covers the compressed bytes
+	_, _ = datafile.WriteAt([]byte{0xff}, FILE_HEADER_SIZE+int64(raw.storedSize())-1)
+	_, err = FetchPage(1, PAGE_SIZE, datafile)
+	var corrupt *ErrCorruptPage
+	assert.ErrorAs(t, err, &corrupt)
+
+	// internal and freelist pages are stored as is
+	for _, kind := range []nodeType{INTERNAL_NODE, FREELIST_PAGE} {
+		page := Page{codec: CODEC_LZ4}
+		page.PageID = 2
+		_ = page.allocate(PAGE_SIZE)
+		_ = page.writeCells([]int{1, 2}, nil, []uint32{1, 2, 3})
+		page.PageType = kind
+		assert.NoError(t, page.Flush(datafile))
+
+		raw, _ := readPage(2, PAGE_SIZE, FILE_HEADER_SIZE, datafile)
+		assert.Equal(t, CODEC_NONE, raw.Codec, kind)
+	}
+
+	// and so are leaves that don't shrink
+	page = Page{codec: CODEC_LZ4}
+	page.PageID = 2
+	_ = page.allocate(PAGE_SIZE)
+	_, _ = rand.New(rand.NewSource(1)).Read(page.buf[PAGE_HEADER_SIZE:])
+	page.CellLayout, page.PageType = KEY_VALUE_CELL, LEAF_NODE
+
+	stored, err := page.encode()
+	assert.NoError(t, err)
+	assert.Equal(t, CODEC_NONE, page.Codec)
+	assert.Len(t, stored, PAGE_SIZE)
+}
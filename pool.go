@@ -0,0 +1,93 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// bufferPool caches decoded pages by id and evicts the least recently used.
+// pages are never updated in place (see: Checkpoint) so a cached page stays
+// valid until it's id is reused, which goes through put and replaces the entry.
+type bufferPool struct {
+	mu       sync.Mutex
+	capacity int
+	pages    map[uint32]*list.Element
+	lru      *list.List // of Page, most recently used at the front
+
+	hits, misses uint64
+}
+
+func newBufferPool(capacity int) *bufferPool {
+	return &bufferPool{capacity: capacity, pages: map[uint32]*list.Element{}, lru: list.New()}
+}
+
+func (p *bufferPool) get(pageId uint32) (Page, bool) {
+	if p == nil {
+		return Page{}, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.pages[pageId]
+	if !ok {
+		p.misses++
+		return Page{}, false
+	}
+
+	p.hits++
+	p.lru.MoveToFront(e)
+
+	return e.Value.(Page), true
+}
+
+func (p *bufferPool) put(page Page) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.pages[page.PageID]; ok {
+		e.Value = page
+		p.lru.MoveToFront(e)
+		return
+	}
+
+	p.pages[page.PageID] = p.lru.PushFront(page)
+
+	if p.lru.Len() > p.capacity {
+		oldest := p.lru.Remove(p.lru.Back()).(Page)
+		delete(p.pages, oldest.PageID)
+	}
+}
+
+// dropPast forgets the pages past last, a truncate cut them off the file
+func (p *bufferPool) dropPast(last uint32) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, e := range p.pages {
+		if id > last {
+			p.lru.Remove(e)
+			delete(p.pages, id)
+		}
+	}
+}
+
+// stats returns the hit and miss counts
+func (p *bufferPool) stats() (hits, misses uint64) {
+	if p == nil {
+		return 0, 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.hits, p.misses
+}
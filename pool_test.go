@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPoolEvictsLeastRecentlyUsed(t *testing.T) {
+	pool := newBufferPool(2)
+
+	for id := uint32(1); id <= 2; id++ {
+		page := Page{}
+		page.PageID = id
+		pool.put(page)
+	}
+
+	_, ok := pool.get(1)
+	assert.True(t, ok)
+
+	page := Page{}
+	page.PageID = 3
+	pool.put(page)
+
+	_, ok = pool.get(2)
+	assert.False(t, ok, "2 was the least recently used")
+
+	_, ok = pool.get(1)
+	assert.True(t, ok)
+
+	hits, misses := pool.stats()
+	assert.Equal(t, uint64(2), hits)
+	assert.Equal(t, uint64(1), misses)
+
+	// a nil pool caches nothing
+	var none *bufferPool
+	none.put(page)
+	_, ok = none.get(3)
+	assert.False(t, ok)
+}
+
+func TestBufferPoolServesFetchPage(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), &Options{MaxDegree: 4, CreateIfMissing: true})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	for k := 0; k < 100; k++ {
+		assert.NoError(t, db.Insert(k, value))
+	}
+	assert.NoError(t, db.Checkpoint())
+
+	// checkpointed pages are written through the pool
+	root := int(db.storeManager.header.RootPage)
+	page, err := db.FetchPage(root)
+	assert.NoError(t, err)
+
+	onDisk, _ := openPage(root, PAGE_SIZE, db.pageStart, nil, db.datafile)
+	assert.Equal(t, onDisk.Keys(), page.Keys())
+
+	hits, misses := db.storeManager.pool.stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Zero(t, misses)
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// fallocate(2) modes, the syscall package doesn't name them
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x1
+	FALLOC_FL_PUNCH_HOLE = 0x2
+)
+
+func punchHole(fd uintptr, offset, length int64) error {
+	return syscall.Fallocate(int(fd), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, offset, length)
+}
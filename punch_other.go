@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// darwin has F_PUNCHHOLE and freebsd fspacectl, compressed pages keep their whole slot there for now
+func punchHole(fd uintptr, offset, length int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const shellHelp = `commands:
+  get <key>                      read a key
+  put <key> <value>              insert or replace a key
+  del <key>                      delete a key
+  scan [hex-prefix [limit]]      list keys whose encoding starts with prefix
+  range <start> <end> [limit]    list keys within [start, end)
+  count [<start> <end>]          count all keys or those within [start, end)
+  stats                          tree and datafile statistics
+  check                          audit the last checkpoint on disk
+  begin | commit | rollback      group writes into a transaction
+  .tree                          print the tree level by level
+  help | exit
+outside of a transaction every write is checkpointed immediately,
+scans and counts only see committed data.`
+
+var shellCommands = []string{
+	"get", "put", "del", "scan", "range", "count", "stats", "check",
+	"begin", "commit", "rollback", ".tree", "help", "exit",
+}
+
+const scanLimit = 100
+
+var errQuit = errors.New("quit")
+
+type shell struct {
+	db  *DB
+	tx  *Tx
+	out io.Writer
+}
+
+// completeCommand completes the command name, the arguments are left alone
+func completeCommand(prefix string) []string {
+	if strings.ContainsRune(prefix, ' ') {
+		return nil
+	}
+
+	var candidates []string
+	for _, c := range shellCommands {
+		if strings.HasPrefix(c, prefix) {
+			candidates = append(candidates, c)
+		}
+	}
+
+	return candidates
+}
+
+func parseKey(arg string) (int, error) {
+	key, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, fmt.Errorf("keys are integers: %q", arg)
+	}
+
+	return key, nil
+}
+
+func parseLimit(args []string, at int) (int, error) {
+	if len(args) <= at {
+		return scanLimit, nil
+	}
+
+	return strconv.Atoi(args[at])
+}
+
+// exec runs a single command line
+func (sh *shell) exec(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	cmd, args := fields[0], fields[1:]
+	t := sh.db.tree
+
+	switch cmd {
+	case "get":
+		if len(args) != 1 {
+			return errors.New("usage: get <key>")
+		}
+
+		key, err := parseKey(args[0])
+		if err != nil {
+			return err
+		}
+
+		var value []byte
+		if sh.tx != nil {
+			value, err = sh.tx.Get(key)
+		} else {
+			value, err = t.Lookup(key)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(sh.out, "%q\n", value)
+
+	case "put":
+		if len(args) < 2 {
+			return errors.New("usage: put <key> <value>")
+		}
+
+		key, err := parseKey(args[0])
+		if err != nil {
+			return err
+		}
+
+		// the value is the rest of the line, spaces included
+		rest := strings.TrimSpace(strings.TrimSpace(line)[len(cmd):])
+		value := strings.TrimSpace(rest[len(args[0]):])
+
+		return sh.write(func(tx *Tx) error { return tx.Put(key, []byte(value)) })
+
+	case "del":
+		if len(args) != 1 {
+			return errors.New("usage: del <key>")
+		}
+
+		key, err := parseKey(args[0])
+		if err != nil {
+			return err
+		}
+
+		return sh.write(func(tx *Tx) error { return tx.Delete(key) })
+
+	case "scan":
+		var prefix []byte
+		var err error
+
+		if len(args) > 0 {
+			if prefix, err = hex.DecodeString(args[0]); err != nil {
+				return fmt.Errorf("prefix must be hex encoded: %v", err)
+			}
+		}
+
+		limit, err := parseLimit(args, 1)
+		if err != nil {
+			return err
+		}
+
+		sh.printCursor(t.SeekPrefix(prefix), limit)
+
+	case "range":
+		if len(args) < 2 {
+			return errors.New("usage: range <start> <end> [limit]")
+		}
+
+		start, err := parseKey(args[0])
+		if err != nil {
+			return err
+		}
+
+		end, err := parseKey(args[1])
+		if err != nil {
+			return err
+		}
+
+		limit, err := parseLimit(args, 2)
+		if err != nil {
+			return err
+		}
+
+		sh.printCursor(t.SeekRange(start, end), limit)
+
+	case "count":
+		switch len(args) {
+		case 0:
+			fmt.Fprintln(sh.out, t.Len())
+		case 2:
+			start, err := parseKey(args[0])
+			if err != nil {
+				return err
+			}
+
+			end, err := parseKey(args[1])
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintln(sh.out, t.CountRange(start, end))
+		default:
+			return errors.New("usage: count [<start> <end>]")
+		}
+
+	case "stats":
+		sh.stats()
+
+	case "check":
+		report, err := sh.db.Check()
+		if err != nil {
+			return err
+		}
+
+		report.Print(sh.out)
+
+	case "begin":
+		if sh.tx != nil {
+			return errors.New("a transaction is already open")
+		}
+
+		sh.tx = sh.db.Begin()
+
+	case "commit", "rollback":
+		if sh.tx == nil {
+			return errors.New("no transaction is open")
+		}
+
+		tx := sh.tx
+		sh.tx = nil
+
+		if cmd == "rollback" {
+			return tx.Rollback()
+		}
+
+		return tx.Commit()
+
+	case ".tree":
+		sh.printTree()
+
+	case "help":
+		fmt.Fprintln(sh.out, shellHelp)
+
+	case "exit", "quit", ".exit":
+		return errQuit
+
+	default:
+		return fmt.Errorf("unknown command %q, try help", cmd)
+	}
+
+	return nil
+}
+
+// write runs a single write in the open transaction or it's own one
+func (sh *shell) write(op func(tx *Tx) error) error {
+	if sh.tx != nil {
+		return op(sh.tx)
+	}
+
+	tx := sh.db.Begin()
+	if err := op(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (sh *shell) printCursor(c *Cursor, limit int) {
+	n := 0
+
+	for ; c.Valid() && n < limit; c.Next() {
+		fmt.Fprintf(sh.out, "%v = %q\n", c.Key(), c.Value())
+		n++
+	}
+
+	if c.Valid() {
+		fmt.Fprintf(sh.out, "... more than %v keys\n", limit)
+	}
+}
+
+func (sh *shell) stats() {
+	t := sh.db.tree
+	sm := &sh.db.storeManager
+
+	t.mu.RLock()
+	height := 1
+	for n := t.root; !n.isLeaf(); n = n.children[0] {
+		height++
+	}
+	t.mu.RUnlock()
+
+	// the header and the freelist move with checkpoints and compaction steps
+	sh.db.storeMu.Lock()
+	pages, free, generation := sm.header.PageCount, len(sm.free), sm.header.Generation
+	sh.db.storeMu.Unlock()
+
+	fmt.Fprintf(sh.out, "keys: %v\nheight: %v\ndegree: %v\npage size: %v\n", t.Len(), height, t.maxDegree, sh.db.pageSize)
+	fmt.Fprintf(sh.out, "pages: %v (%v free)\ngeneration: %v\n", pages, free, generation)
+
+	if quarantined := sh.db.Quarantined(); len(quarantined) > 0 {
+		fmt.Fprintf(sh.out, "quarantined pages: %v\n", quarantined)
+	}
+}
+
+// printTree prints the in-memory tree level by level, page ids are those of
+// the last checkpoint (0 for nodes that were never written)
+func (sh *shell) printTree() {
+	t := sh.db.tree
+
+	// a compaction moves the nodes to other pages under storeMu
+	sh.db.storeMu.Lock()
+	defer sh.db.storeMu.Unlock()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	level := []*node{t.root}
+
+	for depth := 0; len(level) > 0; depth++ {
+		var next []*node
+		parts := make([]string, len(level))
+
+		for i, n := range level {
+			if n.isLeaf() {
+				parts[i] = fmt.Sprintf("#%v%v", n.pageId, t.order.keys(n.data))
+			} else {
+				parts[i] = fmt.Sprintf("#%v%v", n.pageId, t.order.keys(n.keys))
+				next = append(next, n.children...)
+			}
+		}
+
+		fmt.Fprintf(sh.out, "level %v: %v\n", depth, strings.Join(parts, " "))
+		level = next
+	}
+}
+
+func (sh *shell) prompt() string {
+	if sh.tx != nil {
+		return "bubblegum(tx)> "
+	}
+
+	return "bubblegum> "
+}
+
+// bubblegum shell [--degree n] [--key-file path] <datafile>
+func runShell(args []string) error {
+	flags := flag.NewFlagSet("shell", flag.ExitOnError)
+	create := flags.Bool("create", false, "create the datafile if it doesn't exist")
+	degree := flags.Int("degree", DEFAULT_DEGREE, "degree of the tree when creating a new datafile")
+	readOnly := flags.Bool("read-only", false, "open the datafile for reading only, writes fail")
+	keyFile := flags.String("key-file", "", "file holding the key of an encrypted datafile hex encoded, a new datafile is encrypted with it")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: bubblegum shell [--create [--degree n]] [--read-only] [--key-file path] <datafile>")
+	}
+
+	keys, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	// a mistyped path shouldn't leave an empty datafile behind
+	opts := &Options{Keys: keys, ReadOnly: *readOnly, CreateIfMissing: *create && !*readOnly}
+	if info, err := os.Stat(flags.Arg(0)); *create && (err != nil || info.Size() == 0) {
+		opts.MaxDegree = *degree
+	}
+
+	db, err := Open(flags.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	home, _ := os.UserHomeDir()
+	editor := newLineEditor(os.Stdin, os.Stdout, filepath.Join(home, ".bubblegum_history"), completeCommand)
+
+	if restore, err := enableRaw(os.Stdin); err == nil {
+		editor.raw = true
+		defer restore()
+	}
+
+	sh := &shell{db: db, out: os.Stdout}
+	if editor.raw {
+		sh.out = crlfWriter{os.Stdout}
+	}
+
+	for {
+		line, err := editor.readLine(sh.prompt())
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if err := sh.exec(line); err == errQuit {
+			break
+		} else if err != nil {
+			fmt.Fprintf(sh.out, "error: %v\n", err)
+		}
+	}
+
+	if sh.tx != nil {
+		fmt.Fprintln(sh.out, "rolling back the open transaction")
+		sh.tx.Rollback()
+	}
+
+	return nil
+}
+
+// crlfWriter turns \n into \r\n, the terminal doesn't do it in raw mode
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	_, err := io.WriteString(c.w, strings.ReplaceAll(string(p), "\n", "\r\n"))
+
+	return len(p), err
+}
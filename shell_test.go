@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testShell(t *testing.T) (*shell, *bytes.Buffer) {
+	path := filepath.Join(t.TempDir(), "db")
+
+	db, err := OpenDB(path, 4)
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	out := &bytes.Buffer{}
+	return &shell{db: db, out: out}, out
+}
+
+func run(t *testing.T, sh *shell, out *bytes.Buffer, line string) string {
+	out.Reset()
+	assert.NoError(t, sh.exec(line))
+
+	return out.String()
+}
+
+func TestShellCommands(t *testing.T) {
+	sh, out := testShell(t)
+
+	for k := 0; k < 20; k++ {
+		run(t, sh, out, fmt.Sprintf("put %v value  %v", k, k))
+	}
+
+	assert.Equal(t, "\"value  7\"\n", run(t, sh, out, "get 7"))
+	assert.Equal(t, "20\n", run(t, sh, out, "count"))
+	assert.Equal(t, "5\n", run(t, sh, out, "count 5 10"))
+	assert.Equal(t, "5 = \"value  5\"\n6 = \"value  6\"\n", run(t, sh, out, "range 5 7"))
+	assert.Equal(t, "0 = \"value  0\"\n... more than 1 keys\n", run(t, sh, out, "scan 80 1"))
+
+	run(t, sh, out, "del 7")
+	assert.Error(t, sh.exec("get 7"))
+	assert.Equal(t, "19\n", run(t, sh, out, "count"))
+
+	assert.Contains(t, run(t, sh, out, "stats"), "keys: 19")
+	assert.Contains(t, run(t, sh, out, "check"), "ok")
+	assert.Contains(t, run(t, sh, out, ".tree"), "level 1:")
+
+	assert.Error(t, sh.exec("get seven"))
+	assert.Error(t, sh.exec("frobnicate"))
+	assert.Equal(t, errQuit, sh.exec("exit"))
+
+	// every write outside of a transaction is checkpointed
+	report, err := sh.db.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, 19, report.Keys)
+}
+
+func TestShellTransactions(t *testing.T) {
+	sh, out := testShell(t)
+
+	run(t, sh, out, "put 1 one")
+	run(t, sh, out, "begin")
+	assert.Equal(t, "bubblegum(tx)> ", sh.prompt())
+
+	run(t, sh, out, "put 2 two")
+	run(t, sh, out, "del 1")
+	assert.Equal(t, "\"two\"\n", run(t, sh, out, "get 2"))
+	assert.Equal(t, "1\n", run(t, sh, out, "count"))
+
+	run(t, sh, out, "rollback")
+	assert.Equal(t, "bubblegum> ", sh.prompt())
+	assert.Equal(t, "\"one\"\n", run(t, sh, out, "get 1"))
+	assert.Error(t, sh.exec("get 2"))
+
+	run(t, sh, out, "begin")
+	run(t, sh, out, "put 2 two")
+	run(t, sh, out, "commit")
+	assert.Equal(t, "2\n", run(t, sh, out, "count"))
+
+	// a write landing after begin fails the commit
+	run(t, sh, out, "begin")
+	run(t, sh, out, "put 3 three")
+	assert.NoError(t, sh.db.tree.Put(4, []byte("four")))
+	assert.Equal(t, ErrTxConflict, sh.exec("commit"))
+	assert.Error(t, sh.exec("commit"))
+}
+
+func TestShellCompletion(t *testing.T) {
+	assert.Equal(t, []string{"count", "check", "commit"}, completeCommand("c"))
+	assert.Equal(t, []string{"rollback"}, completeCommand("ro"))
+	assert.Nil(t, completeCommand("get 1"))
+}
+
+func TestLineEditor(t *testing.T) {
+	input := "pu\t1 x\r" + // tab completes put
+		"\x1b[A\x7f\x7fy\r" + // up arrow recalls the previous line
+		"sta\x01x\x05\r" + // ctrl-a and ctrl-e move the cursor
+		"ge\x03\x04"
+
+	e := &lineEditor{out: io.Discard, raw: true, complete: completeCommand,
+		reader: bufio.NewReader(strings.NewReader(input))}
+
+	var lines []string
+	for {
+		line, err := e.readLine("> ")
+		if err == io.EOF {
+			break
+		}
+
+		assert.NoError(t, err)
+		lines = append(lines, line)
+	}
+
+	assert.Equal(t, []string{"put 1 x", "put 1y", "xsta"}, lines)
+	assert.Equal(t, lines, e.history)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the faults every simulated disk suffers from
+var simFaults = Faults{ShortRead: 0.05, SyncEIO: 0.005, ENOSPC: 0.002, TornWrite: 0.3, LostWrite: 0.3}
+
+// TestSimulation runs random transactions against a MemFS, losing power at random
+// points. after every restart the tree must hold exactly the last commit that
+// returned nil, or the one in flight when it failed. a failure replays from it's seed:
+// go test -run 'TestSimulation/seed=N$'
+func TestSimulation(t *testing.T) {
+	seeds := 100
+	if testing.Short() {
+		seeds = 10
+	}
+
+	var fired FaultCounts
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		t.Run(fmt.Sprintf("seed=%v", seed), func(t *testing.T) {
+			f := simulate(t, seed, 200)
+
+			fired.ShortRead += f.ShortRead
+			fired.SyncEIO += f.SyncEIO
+			fired.ENOSPC += f.ENOSPC
+			fired.TornWrite += f.TornWrite
+			fired.LostWrite += f.LostWrite
+		})
+	}
+
+	// a fault that never fires is one the simulation doesn't cover
+	t.Logf("faults: %+v", fired)
+	assert.Positive(t, fired.ShortRead)
+	assert.Positive(t, fired.SyncEIO)
+	assert.Positive(t, fired.ENOSPC)
+	assert.Positive(t, fired.TornWrite)
+	assert.Positive(t, fired.LostWrite)
+}
+
+type simulation struct {
+	t   *testing.T
+	r   *rand.Rand
+	fs  *MemFS
+	db  *DB
+	log []string // what happened, printed on failure
+
+	// odd seeds compress their leaves, every third seed encrypts it's pages
+	compression string
+	keys        KeyProvider
+	// two in three seeds leave the header to the OS, the unsynced writes the disk
+	// faults act on only exist without O_DSYNC
+	sync SyncMode
+
+	// durable is the model: the contents as of the last successful commit
+	durable map[int][]byte
+	// the commit before it, the last one whose header may be on disk when the
+	// sync mode left the durable one's to the OS
+	previous map[int][]byte
+
+	commits, restarts, landed, lost int
+}
+
+func simulate(t *testing.T, seed int64, steps int) FaultCounts {
+	sim := &simulation{t: t, r: rand.New(rand.NewSource(seed)), fs: NewMemFS(seed, simFaults), durable: map[int][]byte{}}
+	sim.compression = codecNames[seed%2]
+	if seed%3 == 0 {
+		sim.keys = StaticKey(bytes.Repeat([]byte{byte(seed)}, 16))
+	}
+	sim.sync = SyncMode(seed / 2 % 3)
+	sim.previous = sim.durable
+	sim.restart()
+
+	for step := 0; step < steps && !t.Failed(); step++ {
+		if sim.r.Intn(8) == 0 {
+			n := sim.r.Intn(200) + 1
+			sim.fs.CrashAfter(n)
+			sim.logf("power loss armed in %v ops", n)
+		}
+
+		next := maps.Clone(sim.durable)
+		tx := sim.db.Begin()
+
+		for i := sim.r.Intn(20) + 1; i > 0; i-- {
+			key := sim.r.Intn(300)
+
+			if sim.r.Intn(4) == 0 {
+				if tx.Delete(key) == nil {
+					delete(next, key)
+				}
+			} else {
+				value := make([]byte, sim.r.Intn(64))
+				sim.r.Read(value)
+
+				assert.NoError(t, tx.Put(key, value))
+				next[key] = value
+			}
+		}
+
+		err := tx.Commit()
+		sim.logf("commit of %v keys: %v", len(next), err)
+
+		if err == nil {
+			sim.previous, sim.durable = sim.durable, next
+			sim.commits++
+
+			if sim.r.Intn(10) != 0 {
+				continue
+			}
+
+			// a compaction moves the tree without changing it, after a failed one
+			// the tree must still hold the last commit
+			err = sim.db.Compact(nil)
+			sim.logf("compaction: %v", err)
+
+			if err == nil {
+				continue
+			}
+		}
+
+		// any failed commit or compaction takes the process down, the fault may have been a crash
+		sim.fs.Crash()
+		sim.restart()
+
+		switch got := sim.contents(); {
+		case maps.EqualFunc(got, sim.durable, slices.Equal[[]byte]):
+		case maps.EqualFunc(got, next, slices.Equal[[]byte]):
+			// the header landed before the failure
+			sim.durable = next
+			sim.landed++
+		case sim.sync != SYNC_ALWAYS && maps.EqualFunc(got, sim.previous, slices.Equal[[]byte]):
+			// the last header was never synced
+			sim.durable = sim.previous
+			sim.lost++
+		default:
+			sim.fail("after restart the tree has %v keys, the last commit had %v and the failed one %v",
+				len(got), len(sim.durable), len(next))
+		}
+
+		// whatever the restart found is on disk
+		sim.previous = sim.durable
+	}
+
+	t.Logf("sync mode %v: %v commits, %v restarts, %v failed commits landed anyway, %v commits lost", sim.sync, sim.commits, sim.restarts, sim.landed, sim.lost)
+	return sim.fs.Fired()
+}
+
+// restart reopens the datafile after a crash until an open survives the faults
+func (sim *simulation) restart() {
+	for attempt := 0; ; attempt++ {
+		if sim.db != nil {
+			sim.db.Close()
+		}
+
+		sim.fs.Restart()
+		sim.restarts++
+
+		// the check takes a shared lock so it goes first, a new file has no header yet
+		report, err := checkFile(sim.fs, "db", false, sim.keys)
+		if err == nil && len(report.Errors) > 0 {
+			sim.fail("check after restart: %v", report.Errors)
+		}
+
+		// the background sync of SYNC_INTERVAL would race the seeded faults, an hour never comes
+		db, err := Open("db", &Options{FS: sim.fs, MaxDegree: 6, CreateIfMissing: true, CheckpointWriters: 1, Compression: sim.compression, Keys: sim.keys,
+			SyncMode: sim.sync, SyncInterval: time.Hour})
+		if err == nil {
+			sim.db = db
+			break
+		}
+
+		sim.logf("reopen failed: %v", err)
+		if attempt == 10 {
+			sim.fail("could not reopen the datafile: %v", err)
+			return
+		}
+	}
+
+	if got := sim.contents(); len(got) != sim.db.tree.Len() {
+		sim.fail("tree holds %v keys but counts %v", len(got), sim.db.tree.Len())
+	}
+}
+
+func (sim *simulation) contents() map[int][]byte {
+	contents := map[int][]byte{}
+
+	sim.db.tree.Scan(math.MinInt, sim.db.tree.Len()+1, func(key int, value []byte) {
+		contents[key] = value
+	})
+
+	return contents
+}
+
+func (sim *simulation) logf(format string, v ...any) {
+	sim.log = append(sim.log, fmt.Sprintf(format, v...))
+}
+
+func (sim *simulation) fail(format string, v ...any) {
+	tail := sim.log[max(len(sim.log)-20, 0):]
+	sim.t.Fatalf("%v\nlast steps:\n%v", fmt.Sprintf(format, v...), tail)
+}
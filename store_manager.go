@@ -1,34 +1,249 @@
 package main
 
 import (
-	"io"
-	"log"
-	"os"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"slices"
+	"sync"
 )
 
 // Storage manager - responsible for maintaining datafiles.
 // LIFO simple queue maybe
 // simple statstistics maybe
 
+// reserve first 100 bytes, later stuff meta info here
+const FILE_HEADER_SIZE = 100
+
+const FILE_FORMAT_VERSION = 1
+
+var FILE_MAGIC = [8]byte{'b', 'u', 'b', 'b', 'l', 'e', 'g', 'm'}
+
+// fileHeader is the fixed meta info at the start of the datafile, it is the
+// last thing written by a checkpoint and the only thing that points at the tree.
+type fileHeader struct {
+	Magic      [8]byte
+	Version    uint16
+	PageSize   uint32
+	MaxDegree  uint32
+	RootPage   uint32 // 0 until the first checkpoint
+	PageCount  uint32 // pages 1..PageCount are allocated
+	FreeList   uint32 // first page of the freelist chain, 0 when empty
+	KeyCount   uint64
+	Generation uint64 // bumped by every checkpoint
+	Checksum   uint32 // crc32c of the header with this field zeroed
+
+	// fields past the checksum were added later, files from before them read zeros
+	Comparator [16]byte // see: DEFAULT_COMPARATOR
+	Codec      Codec    // what new leaf pages are compressed with
+	// identifies the key pages are encrypted with, zero when they aren't see: pageCipher
+	KeyCheck      [8]byte
+	KeyGeneration uint32 // bumped by every DB.Rekey
+	// offset of page 1, zero for files from before it where pages follow the header
+	PageStart uint32
+}
+
+// the checksum stays where the first version of the header had it
+const HEADER_CHECKSUM_OFFSET = 46
+
 type StoreManager struct {
-	datafile *os.File
+	datafile File
+	header   fileHeader
+
+	// pages that are free as of the last checkpoint, safe to overwrite
+	free []uint32
+	// pages holding the freelist itself
+	freelistPages []uint32
+
+	// recently read or written pages, nil without a pool
+	pool *bufferPool
+	// how many pages a checkpoint writes at once
+	writers int
+	// what pages are encrypted with, nil if they aren't
+	cipher *pageCipher
+	// the fsync after the header is left to SYNC_INTERVAL or SYNC_NEVER, the one
+	// before it that orders the pages first is not
+	lazyHeader bool
+	// a header was written but not synced, see: syncHeader
+	unsynced bool
+}
+
+// InitHeader writes the header of an empty datafile, the degree, page size, codec, comparator
+// and the check value of the cipher are recorded right away so a crash before the first
+// checkpoint still leaves a valid file.
+func (s *StoreManager) InitHeader(maxDegree, pageSize int, codec Codec, comparator string) error {
+	s.header = fileHeader{Magic: FILE_MAGIC, Version: FILE_FORMAT_VERSION, PageSize: uint32(pageSize), MaxDegree: uint32(maxDegree), Codec: codec}
+	s.header.KeyCheck = s.cipher.checkValue()
+	copy(s.header.Comparator[:], comparator)
+	s.header.PageStart = PAGE_ALIGNMENT
+	s.free, s.freelistPages = nil, nil
+
+	if err := s.WriteHeader(); err != nil {
+		return fmt.Errorf("initial db setup failure: %w", err)
+	}
+
+	return nil
+}
+
+func encodeHeader(h fileHeader) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	h.Checksum = 0
+
+	if err := binary.Write(buf, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, FILE_HEADER_SIZE)
+	copy(header, buf.Bytes())
+
+	binary.LittleEndian.PutUint32(header[HEADER_CHECKSUM_OFFSET:], crc32.Checksum(header, castagnoli))
+	return header, nil
+}
+
+// WriteHeader persists the header and waits for it to hit the disk, unless
+// that's left to the sync mode see: lazyHeader
+func (s *StoreManager) WriteHeader() error {
+	header, err := encodeHeader(s.header)
+	if err != nil {
+		return err
+	}
+
+	if _, err = s.datafile.WriteAt(header, 0); err != nil {
+		return ioError(err, "writing the file header")
+	}
+
+	if s.lazyHeader {
+		s.unsynced = true
+		return nil
+	}
+
+	if err = s.datafile.Sync(); err != nil {
+		return ioError(err, "fsync of the file header")
+	}
+
+	return nil
 }
 
-func (s *StoreManager) InitHeader() {
-	// reserve first 100 bytes, later stuff meta info here
-	header := make([]byte, 100)
-	s.datafile.Seek(0, io.SeekStart)
+// syncHeader catches up on the fsync of a header left to the sync mode, it goes
+// before any write that lands on the pages that header freed since the one
+// before it may still be the header on disk and point at them
+func (s *StoreManager) syncHeader() error {
+	if !s.unsynced {
+		return nil
+	}
+
+	if err := s.datafile.Sync(); err != nil {
+		return ioError(err, "fsync of the file header")
+	}
+
+	s.unsynced = false
+	return nil
+}
 
-	_, err := s.datafile.Write(header)
+var errNotADatafile = fmt.Errorf("%w: not a bubblegum datafile", ErrCorrupt)
+
+func ReadHeader(datafile File) (fileHeader, error) {
+	var h fileHeader
+	buf := make([]byte, FILE_HEADER_SIZE)
+
+	if err := readFullAt(datafile, buf, 0); err != nil {
+		return h, readError(err, "reading the file header")
+	}
+
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h); err != nil {
+		return h, err
+	}
+
+	if h.Magic != FILE_MAGIC {
+		return h, errNotADatafile
+	}
 
+	stored := h.Checksum
+	h.Checksum = 0
+	expected, _ := encodeHeader(h)
+	h.Checksum = stored
+
+	if !bytes.Equal(buf, expected) {
+		return h, fmt.Errorf("%w: file header checksum %#08x does not match contents", ErrCorrupt, stored)
+	}
+
+	if err := validPageSize(int(h.PageSize)); err != nil {
+		return h, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+
+	return h, nil
+}
+
+// headerMoved is whether the header of datafile is no longer h, a writer sharing
+// the file has checkpointed or compacted since h was read
+func headerMoved(datafile File, h fileHeader) bool {
+	now, err := ReadHeader(datafile)
+	return err == nil && (now.Generation != h.Generation || now.Checksum != h.Checksum)
+}
+
+// Open reads back the header and the freelist of an existing datafile, an
+// encrypted one with the key of it's generation from keys
+func (s *StoreManager) Open(keys KeyProvider) error {
+	h, err := ReadHeader(s.datafile)
 	if err != nil {
-		log.Fatalf("initial db setup failure %v", err)
+		return err
+	}
+
+	if s.cipher, err = headerCipher(h, keys); err != nil {
+		return err
+	}
+
+	s.header = h
+	s.free, s.freelistPages, err = readFreelist(s.datafile, h, s.cipher)
+
+	return err
+}
+
+// pageStart is the offset of page 1. new files start their pages on a block so
+// each page is whole blocks and a direct I/O write doesn't read around it
+func (h fileHeader) pageStart() int64 {
+	if h.PageStart == 0 {
+		return FILE_HEADER_SIZE
+	}
+
+	return int64(h.PageStart)
+}
+
+// end is the size of a datafile holding PageCount pages, the header alone
+// until the first page is written
+func (h fileHeader) end() int64 {
+	if h.PageCount == 0 {
+		return FILE_HEADER_SIZE
 	}
+
+	return h.pageStart() + int64(h.PageCount)*int64(h.PageSize)
 }
 
-func (*StoreManager) NewPage() (*Page, error) {
+// pageSize is the size of every page of the datafile
+func (s *StoreManager) pageSize() int {
+	return int(s.header.PageSize)
+}
+
+// allocate hands out a page id, recycling free pages before growing the file
+func (s *StoreManager) allocate() uint32 {
+	if len(s.free) > 0 {
+		id := s.free[0]
+		s.free = s.free[1:]
+
+		return id
+	}
+
+	s.header.PageCount++
+	return s.header.PageCount
+}
+
+func (s *StoreManager) NewPage() (*Page, error) {
 	page := Page{}
-	err := page.Allocate()
+	page.PageID = s.allocate()
+	page.codec, page.cipher, page.start = s.header.Codec, s.cipher, s.header.pageStart()
+	page.Reserve = uint8(s.cipher.reserve())
+	err := page.allocate(s.pageSize())
 
 	if err != nil {
 		return nil, err
@@ -37,6 +252,62 @@ func (*StoreManager) NewPage() (*Page, error) {
 	return &page, nil
 }
 
+// flushPages writes pages with up to CheckpointWriters at once and syncs them
+// in one go, positional writes don't share the file offset
+func (s *StoreManager) flushPages(pages []*Page) error {
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+
+	writers := make(chan struct{}, max(s.writers, 1))
+
+	for _, page := range pages {
+		writers <- struct{}{}
+		wg.Add(1)
+
+		go func(page *Page) {
+			defer wg.Done()
+			defer func() { <-writers }()
+
+			if err := page.write(s.datafile); err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}(page)
+	}
+
+	wg.Wait()
+
+	if first != nil {
+		return first
+	}
+
+	if err := s.datafile.Sync(); err != nil {
+		return ioError(err, "fsync of %v pages", len(pages))
+	}
+
+	for _, page := range pages {
+		s.pool.put(*page)
+	}
+
+	return nil
+}
+
+// flush writes a page out through the pool
+func (s *StoreManager) flush(page *Page) error {
+	if err := page.Flush(s.datafile); err != nil {
+		return err
+	}
+
+	s.pool.put(*page)
+	return nil
+}
+
 // must implement mapper
 /*
 Database files often consist of multiple parts, with a lookup table aiding navigation
@@ -47,6 +318,89 @@ DBMS uses an indirection layer to map pageIDs to offsets.
 page directory? - maps page ids to offsets
 */
 
+// the freelist is a chain of FREELIST_PAGE pages, each holds a run of free
+// page ids as it's cells and points to the next page of the chain
+func freelistCapacity(pageSize, reserve int) int {
+	return (pageSize - PAGE_HEADER_SIZE - reserve) / (2 + KEY_SIZE + 1)
+}
+
+func readFreelist(datafile File, h fileHeader, c *pageCipher) (free, pages []uint32, err error) {
+	for id := h.FreeList; id != 0; {
+		if slices.Contains(pages, id) || id > h.PageCount {
+			return nil, nil, fmt.Errorf("%w: freelist chain is broken at page %v", ErrCorrupt, id)
+		}
+
+		page, err := openPage(int(id), int(h.PageSize), h.pageStart(), c, datafile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if page.PageType != FREELIST_PAGE {
+			return nil, nil, fmt.Errorf("%w: page %v in the freelist chain is not a freelist page", ErrCorrupt, id)
+		}
+
+		for _, k := range page.Keys() {
+			free = append(free, uint32(k))
+		}
+
+		pages = append(pages, id)
+		id = page.RightChild
+	}
+
+	return free, pages, nil
+}
+
+// writeFreelist records the remaining free pages plus pending as the new freelist.
+// pending pages are still referenced by the last checkpoint so they are only
+// listed, the pages for the chain itself come from the free pages or the end of the file.
+func (s *StoreManager) writeFreelist(pending []uint32) error {
+	var pages []*Page
+	capacity := freelistCapacity(s.pageSize(), s.cipher.reserve())
+
+	for len(pages)*capacity < len(s.free)+len(pending) {
+		page, err := s.NewPage()
+		if err != nil {
+			return err
+		}
+
+		pages = append(pages, page)
+	}
+
+	free := append(slices.Clone(s.free), pending...)
+	slices.Sort(free)
+	free = slices.Compact(free)
+
+	s.freelistPages = nil
+	next := uint32(0)
+
+	for i := len(pages) - 1; i >= 0; i-- {
+		page := pages[i]
+		run := free[min(i*capacity, len(free)):min((i+1)*capacity, len(free))]
+
+		ids := make([]int, len(run))
+		for j, id := range run {
+			ids[j] = int(id)
+		}
+
+		if err := page.writeCells(ids, nil, nil); err != nil {
+			return err
+		}
+
+		page.PageType, page.RightChild = FREELIST_PAGE, next
+		if err := s.flush(page); err != nil {
+			return err
+		}
+
+		next = page.PageID
+		s.freelistPages = append(s.freelistPages, page.PageID)
+	}
+
+	s.header.FreeList = next
+	s.free = free
+
+	return nil
+}
+
 /*
 todo: track empty page size/occupancy
 */
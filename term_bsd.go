@@ -0,0 +1,19 @@
+//go:build darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const ioctlGetTermios, ioctlSetTermios = syscall.TIOCGETA, syscall.TIOCSETA
+
+func ioctlTermios(fd uintptr, request uint, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(request), uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+const DEFAULT_IMPORT_BATCH = 10000
+
+// TransferOptions are shared by Import and Export.
+// keys are restricted to [Start, End) in the order of the db, an unbounded range
+// has no upper limit which is the only way to include it's last key.
+type TransferOptions struct {
+	Format   string // csv or jsonl
+	Encoding string // base64, hex or text
+	Start    int
+	End      int
+	Bounded  bool
+	// writes per import transaction, DEFAULT_IMPORT_BATCH when zero
+	Batch int
+
+	// Progress is called after every committed import batch and at the end of an export
+	Progress func(count int, last int)
+}
+
+func (o TransferOptions) within(key int, order keyOrder) bool {
+	stored := order.key(key)
+	return stored >= order.key(o.Start) && (!o.Bounded || stored < order.key(o.End))
+}
+
+// with base64 or hex the key is written in it's 8 byte order preserving
+// encoding, with text keys are decimal and values are written as is
+// which is only lossless for utf-8 values in jsonl.
+func (o TransferOptions) encodeBytes(b []byte) string {
+	switch o.Encoding {
+	case "hex":
+		return hex.EncodeToString(b)
+	case "text":
+		return string(b)
+	default:
+		return base64.StdEncoding.EncodeToString(b)
+	}
+}
+
+func (o TransferOptions) decodeBytes(s string) ([]byte, error) {
+	switch o.Encoding {
+	case "hex":
+		return hex.DecodeString(s)
+	case "text":
+		return []byte(s), nil
+	default:
+		return base64.StdEncoding.DecodeString(s)
+	}
+}
+
+func (o TransferOptions) encodeKey(key int) string {
+	if o.Encoding == "text" {
+		return strconv.Itoa(key)
+	}
+
+	return o.encodeBytes(encodeKey(key))
+}
+
+func (o TransferOptions) decodeKey(s string) (int, error) {
+	if o.Encoding == "text" {
+		return strconv.Atoi(s)
+	}
+
+	buf, err := o.decodeBytes(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(buf) != KEY_SIZE {
+		return 0, fmt.Errorf("key %q decodes to %v bytes, want %v", s, len(buf), KEY_SIZE)
+	}
+
+	return decodeKey(buf), nil
+}
+
+func (o TransferOptions) validate() error {
+	if o.Format != "csv" && o.Format != "jsonl" {
+		return fmt.Errorf("unknown format %q, want csv or jsonl", o.Format)
+	}
+
+	if o.Encoding != "base64" && o.Encoding != "hex" && o.Encoding != "text" {
+		return fmt.Errorf("unknown encoding %q, want base64, hex or text", o.Encoding)
+	}
+
+	return nil
+}
+
+type jsonRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Export streams the key/value pairs within the range in key order,
+// it returns the number of pairs written.
+func Export(t *BTree, w io.Writer, opts TransferOptions) (int, error) {
+	if err := opts.validate(); err != nil {
+		return 0, err
+	}
+
+	out := bufio.NewWriter(w)
+	csvOut := csv.NewWriter(out)
+	jsonOut := json.NewEncoder(out)
+
+	if opts.Format == "csv" {
+		csvOut.Write([]string{"key", "value"})
+	}
+
+	c := t.Seek(opts.Start)
+	c.end, c.bounded = t.order.key(opts.End), opts.Bounded
+
+	n, last := 0, 0
+	for ; c.Valid(); c.Next() {
+		key, value := opts.encodeKey(c.Key()), opts.encodeBytes(c.Value())
+
+		var err error
+		if opts.Format == "csv" {
+			err = csvOut.Write([]string{key, value})
+		} else {
+			err = jsonOut.Encode(jsonRecord{Key: key, Value: value})
+		}
+
+		if err != nil {
+			return n, err
+		}
+
+		n, last = n+1, c.Key()
+	}
+
+	csvOut.Flush()
+	if err := csvOut.Error(); err != nil {
+		return n, err
+	}
+
+	if opts.Progress != nil && n > 0 {
+		opts.Progress(n, last)
+	}
+
+	return n, out.Flush()
+}
+
+// recordReader yields decoded pairs from csv or jsonl input
+type recordReader struct {
+	opts  TransferOptions
+	csv   *csv.Reader
+	json  *json.Decoder
+	line  int
+	first bool
+}
+
+func newRecordReader(r io.Reader, opts TransferOptions) *recordReader {
+	rr := &recordReader{opts: opts, first: true}
+
+	if opts.Format == "csv" {
+		rr.csv = csv.NewReader(r)
+		rr.csv.FieldsPerRecord = 2
+	} else {
+		rr.json = json.NewDecoder(bufio.NewReader(r))
+	}
+
+	return rr
+}
+
+func (rr *recordReader) next() (int, []byte, error) {
+	var key, value string
+
+	for {
+		rr.line++
+
+		if rr.csv != nil {
+			fields, err := rr.csv.Read()
+			if err != nil {
+				return 0, nil, err
+			}
+
+			// the header row is optional
+			if rr.first && fields[0] == "key" && fields[1] == "value" {
+				rr.first = false
+				continue
+			}
+
+			key, value = fields[0], fields[1]
+		} else {
+			var record jsonRecord
+			if err := rr.json.Decode(&record); err != nil {
+				if err != io.EOF {
+					err = fmt.Errorf("record %v: %w", rr.line, err)
+				}
+
+				return 0, nil, err
+			}
+
+			key, value = record.Key, record.Value
+		}
+
+		rr.first = false
+		break
+	}
+
+	k, err := rr.opts.decodeKey(key)
+	if err != nil {
+		return 0, nil, fmt.Errorf("record %v: bad key: %w", rr.line, err)
+	}
+
+	v, err := rr.opts.decodeBytes(value)
+	if err != nil {
+		return 0, nil, fmt.Errorf("record %v: bad value: %w", rr.line, err)
+	}
+
+	return k, v, nil
+}
+
+// Import upserts the pairs within the range in transactions of opts.Batch
+// writes and checkpoints once at the end, a checkpoint rewrites the whole tree
+// so one per batch would write it over and over. an import that fails still
+// checkpoints the batches before the failure. it returns the number of pairs
+// the checkpoint kept.
+func Import(db *DB, r io.Reader, opts TransferOptions) (int, error) {
+	if err := opts.validate(); err != nil {
+		return 0, err
+	}
+
+	if opts.Batch <= 0 {
+		opts.Batch = DEFAULT_IMPORT_BATCH
+	}
+
+	rr := newRecordReader(r, opts)
+	tx := db.Begin()
+
+	// the order of the keys is the db's, previous starts out as it's first key
+	order := db.tree.order
+	applied, pending := 0, 0
+	last, previous, ordered := 0, order.key(math.MinInt), true
+
+	commit := func() error {
+		if pending == 0 {
+			return nil
+		}
+
+		if err := tx.commit(); err != nil {
+			return err
+		}
+
+		applied, last, pending = applied+pending, previous, 0
+		tx = db.Begin()
+
+		if opts.Progress != nil {
+			opts.Progress(applied, last)
+		}
+
+		return nil
+	}
+
+	// the batches are only kept once the checkpoint writes them
+	checkpoint := func() (int, error) {
+		if applied == 0 {
+			return 0, nil
+		}
+
+		if err := db.Checkpoint(); err != nil {
+			return 0, err
+		}
+
+		return applied, nil
+	}
+
+	for {
+		key, value, err := rr.next()
+		if err == io.EOF {
+			if err = commit(); err == nil {
+				tx.Rollback()
+				return checkpoint()
+			}
+		}
+
+		if err == nil && opts.within(key, order) {
+			err = tx.Put(key, value)
+			ordered = ordered && order.key(key) >= order.key(previous)
+			pending, previous = pending+1, key
+		}
+
+		if err == nil && pending >= opts.Batch {
+			err = commit()
+		}
+
+		if err != nil {
+			tx.Rollback()
+
+			kept, cerr := checkpoint()
+			if cerr != nil {
+				return 0, fmt.Errorf("%w\nthe %v keys imported before it weren't checkpointed either: %w", err, applied, cerr)
+			}
+
+			// sorted input, e.g an export, picks up right after the last checkpointed key.
+			// no key follows the last one of the order, the next would wrap around to the first
+			switch {
+			case ordered && kept > 0 && order.key(last) == math.MaxInt:
+				err = fmt.Errorf("%w\n%v keys checkpointed up to key %v, the largest there is, nothing is left to resume", err, kept, last)
+			case ordered && kept > 0:
+				err = fmt.Errorf("%w\n%v keys checkpointed up to key %v, rerun with --start %v to resume", err, kept, last, order.key(order.key(last)+1))
+			}
+
+			return kept, err
+		}
+	}
+}
+
+// transferFlags are the flags shared by import and export, the key file is
+// that of an encrypted datafile see: readKeyFile
+func transferFlags(name string, opts *TransferOptions) (flags *flag.FlagSet, keyFile *string, parsed func()) {
+	flags = flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&opts.Format, "format", "jsonl", "csv or jsonl")
+	flags.StringVar(&opts.Encoding, "encoding", "base64", "encoding of keys and values: base64, hex or text")
+	flags.IntVar(&opts.Start, "start", math.MinInt, "first key of the range, the first key of the datafile when unset")
+	flags.IntVar(&opts.End, "end", 0, "end of the range (exclusive), unbounded when unset")
+	keyFile = flags.String("key-file", "", "file holding the key of an encrypted datafile hex encoded")
+
+	return flags, keyFile, func() {
+		opts.Bounded = isSet(flags, "end")
+	}
+}
+
+func isSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+
+	return set
+}
+
+// startAt begins a range without --start at the first key in the order of the db
+func startAt(flags *flag.FlagSet, opts *TransferOptions, db *DB) {
+	if !isSet(flags, "start") {
+		opts.Start = db.tree.order.key(math.MinInt)
+	}
+}
+
+// bubblegum export [--format csv|jsonl] [--encoding base64|hex|text] [--start k] [--end k] [--key-file path] [--out file] <datafile>
+func runExport(args []string) error {
+	var opts TransferOptions
+
+	flags, keyFile, parsed := transferFlags("export", &opts)
+	outPath := flags.String("out", "", "write to a file instead of stdout")
+	flags.Parse(args)
+	parsed()
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: bubblegum export [--format csv|jsonl] [--encoding base64|hex|text] [--start k] [--end k] [--key-file path] [--out file] <datafile>")
+	}
+
+	keys, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	// an export reads alongside a writer and never creates the file it was pointed at
+	db, err := Open(flags.Arg(0), &Options{Keys: keys, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	startAt(flags, &opts, db)
+
+	out := os.Stdout
+	if *outPath != "" {
+		if out, err = os.Create(*outPath); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	opts.Progress = func(count, last int) {
+		fmt.Fprintf(os.Stderr, "exported %v keys, the last key is %v\n", count, last)
+	}
+
+	_, err = Export(db.tree, out, opts)
+	return err
+}
+
+// bubblegum import [--format csv|jsonl] [--encoding base64|hex|text] [--start k] [--end k] [--key-file path] [--batch n] [--degree n] [--in file] <datafile>
+func runImport(args []string) error {
+	var opts TransferOptions
+
+	flags, keyFile, parsed := transferFlags("import", &opts)
+	flags.IntVar(&opts.Batch, "batch", DEFAULT_IMPORT_BATCH, "keys per transaction, the import checkpoints once at the end")
+	inPath := flags.String("in", "", "read from a file instead of stdin")
+	degree := flags.Int("degree", DEFAULT_DEGREE, "degree of the tree when creating a new datafile")
+	flags.Parse(args)
+	parsed()
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: bubblegum import [--format csv|jsonl] [--encoding base64|hex|text] [--start k] [--end k] [--key-file path] [--batch n] [--degree n] [--in file] <datafile>")
+	}
+
+	keys, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if *inPath != "" {
+		if in, err = os.Open(*inPath); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	db, err := openDB(flags.Arg(0), *degree, keys)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	startAt(flags, &opts, db)
+
+	opts.Progress = func(count, last int) {
+		fmt.Fprintf(os.Stderr, "imported %v keys, the last key is %v\n", count, last)
+	}
+
+	_, err = Import(db, in, opts)
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := NewBTree(4)
+	for k := -50; k < 50; k++ {
+		assert.NoError(t, src.Put(k, []byte{byte(k), 0, ',', '"', '\n'}))
+	}
+
+	for _, format := range []string{"csv", "jsonl"} {
+		for _, encoding := range []string{"base64", "hex"} {
+			opts := TransferOptions{Format: format, Encoding: encoding, Start: -10, End: 10, Bounded: true, Batch: 7}
+
+			var buf bytes.Buffer
+			n, err := Export(src, &buf, opts)
+			assert.NoError(t, err)
+			assert.Equal(t, 20, n)
+
+			db, err := OpenDB(filepath.Join(t.TempDir(), "db"), 4)
+			assert.NoError(t, err)
+
+			n, err = Import(db, &buf, opts)
+			assert.NoError(t, err)
+			assert.Equal(t, 20, n)
+			assert.Equal(t, src.Range(-10, 10), db.tree.Range(-100, 100))
+
+			for _, k := range db.tree.Range(-100, 100) {
+				want, _ := src.Lookup(k)
+				got, _ := db.tree.Lookup(k)
+				assert.Equal(t, want, got, "%v/%v key %v", format, encoding, k)
+			}
+
+			db.Close()
+		}
+	}
+}
+
+func TestExportText(t *testing.T) {
+	tree := NewBTree(4)
+	_ = tree.Put(1, []byte("one"))
+	_ = tree.Put(2, []byte("two, three"))
+
+	var buf bytes.Buffer
+	_, err := Export(tree, &buf, TransferOptions{Format: "csv", Encoding: "text", Start: 0})
+	assert.NoError(t, err)
+	assert.Equal(t, "key,value\n1,one\n2,\"two, three\"\n", buf.String())
+
+	buf.Reset()
+	_, err = Export(tree, &buf, TransferOptions{Format: "jsonl", Encoding: "hex", Start: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"key":"8000000000000002","value":"74776f2c207468726565"}`+"\n", buf.String())
+}
+
+func TestImportResume(t *testing.T) {
+	var input strings.Builder
+	for k := 0; k < 30; k++ {
+		fmt.Fprintf(&input, "%v,value %v\n", k, k)
+	}
+
+	// a malformed record after the second batch
+	lines := strings.SplitAfter(input.String(), "\n")
+	broken := strings.Join(lines[:25], "") + "oops,\n" + strings.Join(lines[25:], "")
+
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := OpenDB(path, 4)
+	assert.NoError(t, err)
+
+	opts := TransferOptions{Format: "csv", Encoding: "text", Batch: 10}
+	n, err := Import(db, strings.NewReader(broken), opts)
+	assert.Equal(t, 20, n)
+	assert.ErrorContains(t, err, "rerun with --start 20 to resume")
+	db.Close()
+
+	// the committed batches survive a reopen, resuming fills in the rest
+	db, err = OpenDB(path, 4)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, 20, db.tree.Len())
+
+	opts.Start = 20
+	n, err = Import(db, strings.NewReader(input.String()), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, 30, db.tree.Len())
+
+	value, _ := db.tree.Lookup(29)
+	assert.Equal(t, "value 29", string(value))
+}
+
+// batches reach the tree as they come, the tree is checkpointed once. an import
+// whose checkpoint fails keeps nothing and has nothing to resume from
+func TestImportCheckpointsOnce(t *testing.T) {
+	var input strings.Builder
+	for k := 0; k < 100; k++ {
+		fmt.Fprintf(&input, "%v,value %v\n", k, k)
+	}
+
+	db, err := OpenDB(filepath.Join(t.TempDir(), "db"), 4)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	generation := db.storeManager.header.Generation
+	batches := 0
+	opts := TransferOptions{Format: "csv", Encoding: "text", Batch: 10, Progress: func(count, last int) {
+		batches++
+		assert.Equal(t, generation, db.storeManager.header.Generation, "no batch checkpoints")
+	}}
+
+	n, err := Import(db, strings.NewReader(input.String()), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, 10, batches)
+	assert.Equal(t, generation+1, db.storeManager.header.Generation)
+	assert.False(t, db.tree.unwritten())
+
+	db.datafile = failingSync{db.datafile}
+	db.storeManager.datafile = db.datafile
+	generation = db.storeManager.header.Generation
+
+	n, err = Import(db, strings.NewReader(input.String()+"oops,\n"), opts)
+	assert.Zero(t, n)
+	assert.ErrorIs(t, err, ErrIO)
+	assert.ErrorContains(t, err, "weren't checkpointed either")
+	assert.NotContains(t, err.Error(), "--start")
+}
+
+// the resume hint can't point past math.MaxInt
+func TestImportResumeAtMaxInt(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "db"), 4)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	input := fmt.Sprintf("%v,a\n%v,b\noops,\n", math.MaxInt-1, math.MaxInt)
+	n, err := Import(db, strings.NewReader(input), TransferOptions{Format: "csv", Encoding: "text", Batch: 1})
+	assert.Equal(t, 2, n)
+	assert.ErrorContains(t, err, "nothing is left to resume")
+	assert.NotContains(t, err.Error(), "--start")
+}
+
+// ranges and the resume hint follow the comparator of the db
+func TestTransferInComparatorOrder(t *testing.T) {
+	tree := NewBTree(4)
+	tree.order = COMPARATORS["int64-desc"]
+	for k := -5; k <= 5; k++ {
+		_ = tree.Put(k, []byte("v"))
+	}
+
+	var buf bytes.Buffer
+	_, err := Export(tree, &buf, TransferOptions{Format: "csv", Encoding: "text", Start: 2, End: -2, Bounded: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "key,value\n2,v\n1,v\n0,v\n-1,v\n", buf.String())
+
+	var input strings.Builder
+	for k := 29; k >= 0; k-- {
+		fmt.Fprintf(&input, "%v,value %v\n", k, k)
+	}
+
+	lines := strings.SplitAfter(input.String(), "\n")
+	broken := strings.Join(lines[:25], "") + "oops,\n"
+
+	db, err := Open(filepath.Join(t.TempDir(), "db"), &Options{MaxDegree: 4, CreateIfMissing: true, Comparator: "int64-desc"})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	n, err := Import(db, strings.NewReader(broken), TransferOptions{Format: "csv", Encoding: "text", Start: math.MaxInt, Batch: 10})
+	assert.Equal(t, 20, n)
+	assert.ErrorContains(t, err, "rerun with --start 9 to resume")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+var errTxDone = fmt.Errorf("transaction %w: it has already been committed or rolled back", ErrClosed)
+
+// Tx buffers writes in memory and applies them to the tree all at once on
+// commit followed by a checkpoint, a rolled back transaction never touches the tree.
+// concurrency control is optimistic and coarse: commit fails if any write
+// landed on the tree after Begin (first committer wins).
+type Tx struct {
+	db      *DB
+	version uint64
+
+	writes map[int]txWrite
+	done   bool
+}
+
+type txWrite struct {
+	value   []byte
+	deleted bool
+}
+
+func (db *DB) Begin() *Tx {
+	db.tree.mu.RLock()
+	defer db.tree.mu.RUnlock()
+
+	return &Tx{db: db, version: db.tree.version, writes: map[int]txWrite{}}
+}
+
+// Get reads the transaction's own writes before falling back to the tree
+func (tx *Tx) Get(key int) ([]byte, error) {
+	if w, ok := tx.writes[key]; ok {
+		if w.deleted {
+			return nil, fmt.Errorf("%w: %v", ErrNotFound, key)
+		}
+
+		return w.value, nil
+	}
+
+	return tx.db.tree.Lookup(key)
+}
+
+func (tx *Tx) Put(key int, value []byte) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	if limit := tx.db.maxValueSize(); len(value) > limit {
+		return fmt.Errorf("value of %v bytes exceeds the %v byte cell limit", len(value), limit)
+	}
+
+	tx.writes[key] = txWrite{value: slices.Clone(value)}
+	return nil
+}
+
+func (tx *Tx) Delete(key int) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	if _, err := tx.Get(key); err != nil {
+		return err
+	}
+
+	tx.writes[key] = txWrite{deleted: true}
+	return nil
+}
+
+// Commit applies the buffered writes under a single tree lock and checkpoints.
+func (tx *Tx) Commit() error {
+	if err := tx.commit(); err != nil {
+		return err
+	}
+
+	return tx.db.Checkpoint()
+}
+
+// commit is Commit without the checkpoint, the writes only reach the tree
+func (tx *Tx) commit() (err error) {
+	if tx.done {
+		return errTxDone
+	}
+
+	if err = tx.db.writable(); err != nil {
+		return err
+	}
+
+	tx.done = true
+	defer tx.db.recoverInvariant(&err)
+
+	return tx.apply()
+}
+
+// apply writes the buffered keys in order
+func (tx *Tx) apply() error {
+	t := tx.db.tree
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.version != tx.version {
+		return ErrTxConflict
+	}
+
+	keys := make([]int, 0, len(tx.writes))
+	for key := range tx.writes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		var err error
+
+		if w := tx.writes[key]; w.deleted {
+			err = t.remove(key)
+		} else {
+			err = t.put(key, w.value)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return errTxDone
+	}
+
+	tx.done, tx.writes = true, nil
+	return nil
+}
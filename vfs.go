@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// File is the part of *os.File the storage layer uses, the datafile is only
+// ever reached through it so tests can swap the disk for MemFS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+
+	Sync() error
+	Truncate(size int64) error
+	Size() (int64, error)
+	// PunchHole frees the blocks of a range of the file, it reads back as zeros
+	// and the size doesn't change. errors.ErrUnsupported if the filesystem can't
+	PunchHole(offset, length int64) error
+
+	// Lock takes an advisory lock on the whole file without waiting, it fails
+	// with ErrLocked if another handle holds a conflicting one. many handles can
+	// share a lock but an exclusive one excludes all others. locking again converts
+	// the lock the handle holds, Close releases it.
+	Lock(exclusive bool) error
+	Unlock() error
+}
+
+// VFS opens files, OSFS is the real filesystem
+type VFS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+}
+
+var OSFS VFS = osFS{}
+
+type osFS struct{}
+
+type osFile struct {
+	*os.File
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return osFile{f}, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (f osFile) Size() (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return stat.Size(), nil
+}
+
+func (f osFile) PunchHole(offset, length int64) error {
+	return punchHole(f.Fd(), offset, length)
+}
+
+// Lock is flock(2), the lock belongs to the open file so two opens in the
+// same process exclude each other too
+func (f osFile) Lock(exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+
+	return err
+}
+
+func (f osFile) Unlock() error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}